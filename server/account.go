@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL     = 1 * time.Hour
+	emailVerificationTTL = 48 * time.Hour
+	minPasswordLength    = 8
+)
+
+var errInvalidAuthToken = validationError("Invalid or expired token")
+
+// clearServerOwnedFields resets profile fields that only the server may set,
+// so values supplied by clients on register or UPDATE_PROFILE are ignored.
+func clearServerOwnedFields(u *User) {
+	u.IsVerified = false
+	u.TrustScore = 0
+	u.EloScore = 0
+	u.PartiesHosted = 0
+	u.FlakeCount = 0
+	u.EmailVerified = false
+	u.Role = ""
+}
+
+// accountLink builds a link for emails from PUBLIC_BASE_URL. Without it the
+// email only contains the raw token.
+func accountLink(path, token string) string {
+	base := strings.TrimRight(getEnv("PUBLIC_BASE_URL", ""), "/")
+	if base == "" {
+		return ""
+	}
+	return base + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendAuthTokenEmail issues a single-use token for the user and mails it.
+func sendAuthTokenEmail(u User, purpose AuthTokenPurpose) error {
+	token, hash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	var subject, intro, path string
+	switch purpose {
+	case PurposePasswordReset:
+		ttl = passwordResetTTL
+		subject = "Reset your WaterParty password"
+		intro = "Someone asked to reset the password for your WaterParty account. If this was not you, ignore this email."
+		path = "/password/reset"
+	case PurposeEmailVerification:
+		ttl = emailVerificationTTL
+		subject = "Confirm your WaterParty email"
+		intro = "Confirm this email address for your WaterParty account."
+		path = "/email/verify"
+	default:
+		return fmt.Errorf("unknown token purpose %q", purpose)
+	}
+
+	if err := CreateAuthToken(u.ID, purpose, u.Email, hash, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\n%s\n\nCode: %s\n", u.RealName, intro, token)
+	if link := accountLink(path, token); link != "" {
+		body += "\nOr open: " + link + "\n"
+	}
+	body += fmt.Sprintf("\nThis code expires in %s and can only be used once.\n", ttl)
+	return mailer.Send(u.Email, subject, body)
+}
+
+// handleForgotPassword emails a reset token. It always answers 200 so the
+// endpoint cannot be used to discover registered addresses.
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, methodNotAllowedError())
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		writeError(w, r, validationError("Invalid request"))
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	// Throttle per address and per IP so the endpoint can't be used to flood
+	// an inbox. Unknown addresses are counted too, so a 429 reveals nothing.
+	emailKey, ipKey := "email:"+email, "ip:"+clientIP(r)
+	emailWait := resetEmailLimiter.Reserve(emailKey)
+	ipWait := resetIPLimiter.Reserve(ipKey)
+	if emailWait > 0 || ipWait > 0 {
+		if emailWait == 0 {
+			resetEmailLimiter.Refund(emailKey)
+		}
+		if ipWait == 0 {
+			resetIPLimiter.Refund(ipKey)
+		}
+		writeError(w, r, rateLimitedError("Too many reset requests, try again later", max(emailWait, ipWait)))
+		return
+	}
+
+	// Lookup and delivery run in the background so response timing does not
+	// reveal whether the account exists
+	goBackground(func() {
+		u, _, err := GetUserByEmail(email)
+		if err != nil {
+			return
+		}
+		if err := sendAuthTokenEmail(u, PurposePasswordReset); err != nil {
+			log.Printf("Password reset email error for %s: %v", u.ID, err)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
+
+// handleResetPassword sets a new password from a reset token and signs the
+// user out of every device.
+func handleResetPassword(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, methodNotAllowedError())
+			return
+		}
+
+		var req struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			writeError(w, r, validationError("Invalid request"))
+			return
+		}
+		if len(req.Password) < minPasswordLength {
+			msg := fmt.Sprintf("Password must be at least %d characters", minPasswordLength)
+			writeError(w, r, validationError(msg, FieldError{"password", msg}))
+			return
+		}
+
+		userID, _, err := ConsumeAuthToken(hashOpaqueToken(req.Token), PurposePasswordReset)
+		if err != nil {
+			writeError(w, r, errInvalidAuthToken)
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, r, internalError("Failed to reset password", err))
+			return
+		}
+		if err := UpdatePasswordHash(userID, string(hash)); err != nil {
+			writeError(w, r, internalError("Failed to reset password", err))
+			return
+		}
+
+		sessions, err := RevokeAllSessions(userID)
+		if err != nil {
+			log.Printf("Session revoke after password reset failed: %v", err)
+		}
+		hub.DisconnectSessions(sessions...)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "password_reset"})
+	}
+}
+
+// handleVerifyEmail confirms an email address. The token is accepted as a
+// query parameter (link clicked in the email) or in a JSON body.
+func handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if token == "" {
+			var req struct {
+				Token string `json:"token"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			token = req.Token
+		}
+	default:
+		writeError(w, r, methodNotAllowedError())
+		return
+	}
+	if token == "" {
+		writeError(w, r, validationError("Token required"))
+		return
+	}
+
+	userID, email, err := ConsumeAuthToken(hashOpaqueToken(token), PurposeEmailVerification)
+	if err != nil {
+		writeError(w, r, errInvalidAuthToken)
+		return
+	}
+
+	ok, err := MarkEmailVerified(userID, email)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify email", err))
+		return
+	}
+	if !ok {
+		// The account's email changed after the link was sent
+		writeError(w, r, errInvalidAuthToken)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "verified"})
+}
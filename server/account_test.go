@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ==================== MAILER TESTS ====================
+
+func TestLogMailer_WritesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	m := &LogMailer{Path: path}
+
+	if err := m.Send("user@example.com", "Hello", "Body text"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read mail log: %v", err)
+	}
+	out := string(data)
+	if !strings.Contains(out, "To: user@example.com") || !strings.Contains(out, "Subject: Hello") || !strings.Contains(out, "Body text") {
+		t.Errorf("Unexpected mail log contents: %s", out)
+	}
+}
+
+func TestBuildMessage_StripsHeaderInjection(t *testing.T) {
+	msg := buildMessage("from@example.com", "to@example.com\r\nBcc: evil@example.com", "Hi", "body")
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Error("Recipient must not be able to inject headers")
+	}
+}
+
+func TestNewMailerFromEnv(t *testing.T) {
+	if _, ok := NewMailerFromEnv().(*LogMailer); !ok {
+		t.Error("Expected LogMailer without SMTP_HOST")
+	}
+
+	os.Setenv("SMTP_HOST", "smtp.example.com")
+	defer os.Unsetenv("SMTP_HOST")
+	m, ok := NewMailerFromEnv().(*SMTPMailer)
+	if !ok {
+		t.Fatal("Expected SMTPMailer when SMTP_HOST is set")
+	}
+	if m.Port != "587" {
+		t.Errorf("Expected default port 587, got %s", m.Port)
+	}
+}
+
+func TestAccountLink(t *testing.T) {
+	if link := accountLink("/email/verify", "abc"); link != "" {
+		t.Errorf("Expected no link without PUBLIC_BASE_URL, got %s", link)
+	}
+
+	os.Setenv("PUBLIC_BASE_URL", "https://api.example.com/")
+	defer os.Unsetenv("PUBLIC_BASE_URL")
+	if link := accountLink("/email/verify", "a+b"); link != "https://api.example.com/email/verify?token=a%2Bb" {
+		t.Errorf("Unexpected link %s", link)
+	}
+}
+
+// ==================== ACCOUNT RECOVERY HANDLER TESTS ====================
+
+func TestHandleForgotPassword_InvalidJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/password/forgot", strings.NewReader("not json"))
+
+	handleForgotPassword(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandleResetPassword_ShortPassword(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/password/reset", strings.NewReader(`{"token":"abc","password":"short"}`))
+
+	handleResetPassword(NewHub())(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandleResetPassword_InvalidToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/password/reset", strings.NewReader(`{"token":"unknown","password":"long-enough"}`))
+
+	handleResetPassword(NewHub())(rec, req)
+
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid or expired token") {
+		t.Errorf("Expected invalid token error, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleVerifyEmail_MissingToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleVerifyEmail(rec, httptest.NewRequest("GET", "/email/verify", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandleVerifyEmail_MethodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleVerifyEmail(rec, httptest.NewRequest("DELETE", "/email/verify?token=abc", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestHandleForgotPassword_RateLimited(t *testing.T) {
+	body := `{"email":"reset-flood-target@example.com"}`
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/password/forgot", strings.NewReader(body))
+		req.RemoteAddr = "198.51.100.20:1234"
+		handleForgotPassword(rec, req)
+		return rec
+	}
+
+	for i := 0; i <= emailResetPolicy.FreeAttempts; i++ {
+		if rec := send(); rec.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected %d, got %d", i+1, http.StatusOK, rec.Code)
+		}
+	}
+	rec := send()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestDecodeRegistration_Email(t *testing.T) {
+	cases := []struct {
+		name, body, want string
+	}{
+		{"nested", `{"password":"secret123","user":{"RealName":"A","Email":" Nested@Example.com "}}`, "nested@example.com"},
+		{"top-level", `{"email":"Top@Example.com","password":"secret123","user":{"RealName":"A"}}`, "top@example.com"},
+		{"top-level wins", `{"email":"top@example.com","password":"secret123","user":{"Email":"nested@example.com"}}`, "top@example.com"},
+	}
+	for _, c := range cases {
+		u, password, err := decodeRegistration(strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if u.Email != c.want {
+			t.Errorf("%s: expected email %q, got %q", c.name, c.want, u.Email)
+		}
+		if password != "secret123" {
+			t.Errorf("%s: expected password to be read, got %q", c.name, password)
+		}
+	}
+
+	if _, _, err := decodeRegistration(strings.NewReader(`{"user":"not an object"}`)); err == nil {
+		t.Error("Expected a malformed user to be rejected")
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+	ErrRevokedToken = errors.New("session revoked")
+)
+
+var (
+	tokenSecret     []byte
+	tokenSecretOnce sync.Once
+)
+
+// authSecret returns the HMAC key used to sign access tokens. It is read from
+// AUTH_TOKEN_SECRET; without it a random per-process key is generated, which
+// means tokens do not survive restarts or work across replicas.
+func authSecret() []byte {
+	tokenSecretOnce.Do(func() {
+		if s := getEnv("AUTH_TOKEN_SECRET", ""); s != "" {
+			tokenSecret = []byte(s)
+			return
+		}
+		log.Println("⚠️  AUTH_TOKEN_SECRET not set, using an ephemeral signing key")
+		tokenSecret = make([]byte, 32)
+		if _, err := rand.Read(tokenSecret); err != nil {
+			log.Fatalf("Unable to generate token secret: %v", err)
+		}
+	})
+	return tokenSecret
+}
+
+// TokenClaims is the payload of a signed access token (JWT, HS256).
+type TokenClaims struct {
+	Subject   string   `json:"sub"`
+	Role      UserRole `json:"role,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	Type      string   `json:"typ"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+type contextKey string
+
+// Request context keys set by authMiddleware
+const (
+	ctxUserID    contextKey = "uid"
+	ctxUserRole  contextKey = "role"
+	ctxSessionID contextKey = "sid"
+)
+
+// UserIDFromContext returns the authenticated caller's ID, or "" if none.
+func UserIDFromContext(ctx context.Context) string {
+	uid, _ := ctx.Value(ctxUserID).(string)
+	return uid
+}
+
+// UserRoleFromContext returns the authenticated caller's role.
+func UserRoleFromContext(ctx context.Context) UserRole {
+	role, _ := ctx.Value(ctxUserRole).(UserRole)
+	return role
+}
+
+// SessionIDFromContext returns the session the caller's access token belongs to.
+func SessionIDFromContext(ctx context.Context) string {
+	sid, _ := ctx.Value(ctxSessionID).(string)
+	return sid
+}
+
+// AuthResponse is returned by /login and /register. User fields are flattened
+// into the top level so clients that only read the profile keep working.
+type AuthResponse struct {
+	User
+	AccessToken           string    `json:"AccessToken"`
+	AccessTokenExpiresAt  time.Time `json:"AccessTokenExpiresAt"`
+	RefreshToken          string    `json:"RefreshToken"`
+	RefreshTokenExpiresAt time.Time `json:"RefreshTokenExpiresAt"`
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// IssueAccessToken signs a short-lived access token for the given user and session.
+func IssueAccessToken(userID string, role UserRole, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+	claims := TokenClaims{
+		Subject:   userID,
+		Role:      role,
+		SessionID: sessionID,
+		Type:      "access",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(body)
+	return signingInput + "." + signToken(signingInput), expiresAt, nil
+}
+
+// ParseAccessToken verifies the signature and expiry of an access token.
+func ParseAccessToken(token string) (TokenClaims, error) {
+	var claims TokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, ErrInvalidToken
+	}
+	expected := signToken(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return claims, ErrInvalidToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if claims.Type != "access" || claims.Subject == "" {
+		return claims, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+// sessionRevoked looks up whether a session was revoked; tests swap it out
+// to run without a database.
+var sessionRevoked = IsSessionRevoked
+
+// AuthenticateAccessToken parses an access token and also rejects it once its
+// session has been revoked, so logging out takes effect before the token
+// expires.
+func AuthenticateAccessToken(token string) (TokenClaims, error) {
+	claims, err := ParseAccessToken(token)
+	if err != nil || claims.SessionID == "" {
+		return claims, err
+	}
+	revoked, err := sessionRevoked(claims.SessionID)
+	if err != nil {
+		return claims, err
+	}
+	if revoked {
+		return claims, ErrRevokedToken
+	}
+	return claims, nil
+}
+
+// isAuthError reports whether err means the token itself was rejected, as
+// opposed to the revocation check failing.
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrExpiredToken) || errors.Is(err, ErrRevokedToken)
+}
+
+func signToken(signingInput string) string {
+	mac := hmac.New(sha256.New, authSecret())
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newOpaqueToken returns a random URL-safe token and the SHA-256 hash that is
+// stored server-side in its place.
+func newOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashOpaqueToken(token), nil
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newGuestID returns a random UUID (v4) so guest connections can still be
+// passed to queries that expect a user UUID without matching any real row.
+func newGuestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// IssueTokens starts a new session for the user on the requesting device and
+// returns its first access and refresh tokens.
+func IssueTokens(u User, r *http.Request) (AuthResponse, error) {
+	sessionID, err := CreateSession(u.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return AuthResponse{User: u}, err
+	}
+
+	resp := AuthResponse{User: u}
+	resp.AccessToken, resp.AccessTokenExpiresAt, err = IssueAccessToken(u.ID, u.Role, sessionID)
+	if err != nil {
+		return resp, err
+	}
+
+	refresh, refreshHash, err := newOpaqueToken()
+	if err != nil {
+		return resp, err
+	}
+	refreshExp := time.Now().Add(refreshTokenTTL)
+	if err := SaveRefreshToken(u.ID, sessionID, refreshHash, refreshExp); err != nil {
+		return resp, err
+	}
+
+	resp.RefreshToken = refresh
+	resp.RefreshTokenExpiresAt = refreshExp
+	return resp, nil
+}
+
+// trustedProxies lists the load balancers whose X-Forwarded-For is believed.
+// It is set once at startup by LoadTrustedProxies.
+var trustedProxies []netip.Prefix
+
+// LoadTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of IPs and
+// CIDR ranges. Without it X-Forwarded-For is ignored.
+func LoadTrustedProxies() error {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(getEnv("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the originating address. X-Forwarded-For is only honoured
+// when the peer is a trusted proxy, and then read from the right, skipping
+// trusted hops, since anything left of them is client-supplied.
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// bearerToken extracts a token from the Authorization header or the "token"
+// query parameter (browsers cannot set headers on WebSocket upgrades).
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+			return strings.TrimSpace(h[7:])
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// guestModeEnabled reports whether unauthenticated read-only WebSocket
+// sessions are allowed (ALLOW_GUEST_CONNECTIONS=true).
+func guestModeEnabled() bool {
+	return getEnv("ALLOW_GUEST_CONNECTIONS", "") == "true"
+}
+
+// handleRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. Each refresh token is single-use: presenting one that was
+// already rotated means it leaked, so the whole session is revoked.
+func handleRefreshToken(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, methodNotAllowedError())
+			return
+		}
+
+		var req struct {
+			RefreshToken string `json:"refreshToken"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			writeError(w, r, validationError("Invalid request"))
+			return
+		}
+
+		old, err := GetRefreshToken(hashOpaqueToken(req.RefreshToken))
+		if err != nil || old.RevokedAt != nil || old.SessionID == "" || time.Now().After(old.ExpiresAt) {
+			writeError(w, r, unauthorizedError("Invalid refresh token"))
+			return
+		}
+
+		newToken, newHash, err := newOpaqueToken()
+		if err != nil {
+			writeError(w, r, internalError("Failed to refresh token", err))
+			return
+		}
+		newExp := time.Now().Add(refreshTokenTTL)
+
+		if old.UsedAt == nil {
+			err = RotateRefreshToken(old, newHash, newExp)
+		} else {
+			err = ErrRefreshTokenReused
+		}
+		if err == ErrRefreshTokenReused {
+			log.Printf("⚠️  Refresh token reuse detected for session %s, revoking", old.SessionID)
+			if _, err := RevokeSession(old.UserID, old.SessionID); err != nil {
+				log.Printf("Session revoke error: %v", err)
+			}
+			hub.DisconnectSessions(old.SessionID)
+			writeError(w, r, unauthorizedError("Invalid refresh token"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, internalError("Failed to refresh token", err))
+			return
+		}
+
+		u, err := GetUser(old.UserID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to refresh token", err))
+			return
+		}
+
+		access, accessExp, err := IssueAccessToken(u.ID, u.Role, old.SessionID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to refresh token", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"AccessToken":           access,
+			"AccessTokenExpiresAt":  accessExp,
+			"RefreshToken":          newToken,
+			"RefreshTokenExpiresAt": newExp,
+		})
+	}
+}
+
+// handleLogout revokes the caller's current session, or every session when
+// the body is {"all": true}, and disconnects the affected WebSockets.
+func handleLogout(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, methodNotAllowedError())
+			return
+		}
+
+		var req struct {
+			All bool `json:"all"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, validationError("Invalid request"))
+				return
+			}
+		}
+
+		uid := UserIDFromContext(r.Context())
+		var revoked []string
+		if req.All {
+			ids, err := RevokeAllSessions(uid)
+			if err != nil {
+				writeError(w, r, internalError("Failed to log out", err))
+				return
+			}
+			revoked = ids
+		} else {
+			sid := SessionIDFromContext(r.Context())
+			if _, err := RevokeSession(uid, sid); err != nil {
+				writeError(w, r, internalError("Failed to log out", err))
+				return
+			}
+			revoked = []string{sid}
+		}
+		hub.DisconnectSessions(revoked...)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "logged_out"})
+	}
+}
+
+// handleSessions lists the caller's active devices (GET) or revokes one of
+// them by ?id= (DELETE).
+func handleSessions(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid := UserIDFromContext(r.Context())
+
+		switch r.Method {
+		case http.MethodGet:
+			sessions, err := GetActiveSessions(uid)
+			if err != nil {
+				writeError(w, r, internalError("Failed to list sessions", err))
+				return
+			}
+			current := SessionIDFromContext(r.Context())
+			online := hub.OnlineSessions(uid)
+			for i := range sessions {
+				sessions[i].Current = sessions[i].ID == current
+				sessions[i].Online = online[sessions[i].ID]
+			}
+			if sessions == nil {
+				sessions = []Session{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sessions)
+
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				writeError(w, r, validationError("Session ID required"))
+				return
+			}
+			found, err := RevokeSession(uid, id)
+			if err != nil {
+				writeError(w, r, internalError("Failed to revoke session", err))
+				return
+			}
+			if !found {
+				writeError(w, r, notFoundError("Session not found"))
+				return
+			}
+			hub.DisconnectSessions(id)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+
+		default:
+			writeError(w, r, methodNotAllowedError())
+		}
+	}
+}
+
+// handleLoginAttempts lets admins query the failed-login audit log by
+// ?email= and/or ?ip= (most recent first, ?limit= up to 500).
+func handleLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, methodNotAllowedError())
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 100
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	attempts, err := GetLoginAttempts(strings.ToLower(strings.TrimSpace(q.Get("email"))), q.Get("ip"), limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to load login attempts", err))
+		return
+	}
+	if attempts == nil {
+		attempts = []LoginAttempt{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
+
+// requireAdmin rejects callers without the admin role. Chain it inside
+// authMiddleware so the role is already in the context.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if UserRoleFromContext(r.Context()) != RoleAdmin {
+			writeError(w, r, forbiddenError("Forbidden"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// authMiddleware resolves the caller from a bearer token and injects their ID
+// and role into the request context. Requests without a valid token get 401.
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := AuthenticateAccessToken(bearerToken(r))
+		if err != nil && !isAuthError(err) {
+			writeError(w, r, internalError("Failed to check session", err))
+			return
+		}
+		if err != nil {
+			writeError(w, r, unauthorizedError("Unauthorized"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxUserID, claims.Subject)
+		ctx = context.WithValue(ctx, ctxUserRole, claims.Role)
+		ctx = context.WithValue(ctx, ctxSessionID, claims.SessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
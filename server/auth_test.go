@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ==================== ACCESS TOKEN TESTS ====================
+
+func TestIssueAndParseAccessToken(t *testing.T) {
+	token, expiresAt, err := IssueAccessToken("user-123", RoleUser, "")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	if strings.Count(token, ".") != 2 {
+		t.Errorf("Expected a three-part token, got %s", token)
+	}
+	if time.Until(expiresAt) > accessTokenTTL || time.Until(expiresAt) <= 0 {
+		t.Errorf("Unexpected expiry %v", expiresAt)
+	}
+
+	claims, err := ParseAccessToken(token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if claims.Subject != "user-123" {
+		t.Errorf("Expected subject user-123, got %s", claims.Subject)
+	}
+}
+
+func TestParseAccessToken_Tampered(t *testing.T) {
+	token, _, _ := IssueAccessToken("user-123", RoleUser, "")
+	parts := strings.Split(token, ".")
+
+	forged, _ := json.Marshal(TokenClaims{
+		Subject:   "someone-else",
+		Type:      "access",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+
+	if _, err := ParseAccessToken(strings.Join(parts, ".")); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestParseAccessToken_Expired(t *testing.T) {
+	body, _ := json.Marshal(TokenClaims{
+		Subject:   "user-123",
+		Type:      "access",
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	})
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(body)
+	token := signingInput + "." + signToken(signingInput)
+
+	if _, err := ParseAccessToken(token); err != ErrExpiredToken {
+		t.Errorf("Expected ErrExpiredToken, got %v", err)
+	}
+}
+
+func TestParseAccessToken_Garbage(t *testing.T) {
+	for _, token := range []string{"", "abc", "a.b.c", tokenHeader + ".e30.sig"} {
+		if _, err := ParseAccessToken(token); err == nil {
+			t.Errorf("Expected error for token %q", token)
+		}
+	}
+}
+
+func TestOpaqueTokenHashing(t *testing.T) {
+	token, hash, err := newOpaqueToken()
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if hash != hashOpaqueToken(token) {
+		t.Error("Stored hash should match hash of token")
+	}
+	if token == hash {
+		t.Error("Token must not be stored in plain text")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Authorization", "Bearer header-token")
+	if got := bearerToken(req); got != "header-token" {
+		t.Errorf("Expected header-token, got %q", got)
+	}
+
+	req = httptest.NewRequest("GET", "/ws?token=query-token", nil)
+	if got := bearerToken(req); got != "query-token" {
+		t.Errorf("Expected query-token, got %q", got)
+	}
+
+	req = httptest.NewRequest("GET", "/ws", nil)
+	if got := bearerToken(req); got != "" {
+		t.Errorf("Expected empty token, got %q", got)
+	}
+}
+
+func TestNewGuestID(t *testing.T) {
+	id := newGuestID()
+	if len(id) != 36 || id[14] != '4' {
+		t.Errorf("Expected a v4 UUID, got %s", id)
+	}
+}
+
+// ==================== WEBSOCKET AUTH TESTS ====================
+
+func TestServeWs_InvalidToken(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ws?token=not-a-token", nil)
+	ServeWs(hub, rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestServeWs_UIDQueryIgnored(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?uid=victim", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	hub.mu.RLock()
+	_, exists := hub.clients["victim"]
+	hub.mu.RUnlock()
+	if exists {
+		t.Error("A bare uid query parameter must not register a client")
+	}
+}
+
+func TestServeWs_FirstMessageToken(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+
+	auth, _ := json.Marshal(WSMessage{Event: "AUTH", Token: testAccessToken("first-frame-user")})
+	ws.WriteMessage(websocket.TextMessage, auth)
+
+	ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read auth response: %v", err)
+	}
+	var resp WSMessage
+	json.Unmarshal(msg, &resp)
+	if resp.Event != "AUTHENTICATED" {
+		t.Errorf("Expected AUTHENTICATED, got %s", resp.Event)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	hub.mu.RLock()
+	_, exists := hub.clients["first-frame-user"]
+	hub.mu.RUnlock()
+	if !exists {
+		t.Error("Client should be registered after first-frame authentication")
+	}
+}
+
+func TestServeWs_GuestMode(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ws?guest=true", nil)
+	ServeWs(hub, rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Guest access should be rejected when disabled, got %d", rec.Code)
+	}
+
+	os.Setenv("ALLOW_GUEST_CONNECTIONS", "true")
+	defer os.Unsetenv("ALLOW_GUEST_CONNECTIONS")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?guest=true", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial as guest: %v", err)
+	}
+	defer ws.Close()
+
+	// Guests cannot use mutating events
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"Event":"DELETE_USER","Payload":{"UserID":"x"}}`))
+	ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var resp WSMessage
+	json.Unmarshal(msg, &resp)
+	payload, _ := resp.Payload.(map[string]interface{})
+	if resp.Event != "ERROR" || payload["message"] != "Sign in required" {
+		t.Errorf("Expected sign-in error, got %s %v", resp.Event, resp.Payload)
+	}
+}
+
+// ==================== REST AUTH MIDDLEWARE TESTS ====================
+
+func TestAuthMiddleware_RejectsMissingToken(t *testing.T) {
+	called := false
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/profile", nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if called {
+		t.Error("Handler must not run without a valid token")
+	}
+}
+
+func TestAuthMiddleware_InjectsCaller(t *testing.T) {
+	var gotID string
+	var gotRole UserRole
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		gotID = UserIDFromContext(r.Context())
+		gotRole = UserRoleFromContext(r.Context())
+	})
+
+	token, _, _ := IssueAccessToken("admin-1", RoleAdmin, "")
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler(httptest.NewRecorder(), req)
+
+	if gotID != "admin-1" || gotRole != RoleAdmin {
+		t.Errorf("Expected admin-1/admin in context, got %s/%s", gotID, gotRole)
+	}
+}
+
+func TestHandleProfile_DeleteOtherUserForbidden(t *testing.T) {
+	handler := authMiddleware(handleProfile)
+
+	req := httptest.NewRequest("DELETE", "/profile?id=victim", nil)
+	req.Header.Set("Authorization", "Bearer "+testAccessToken("attacker"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestHandleProfile_AdminMayDeleteOthers(t *testing.T) {
+	handler := authMiddleware(handleProfile)
+
+	token, _, _ := IssueAccessToken("admin-1", RoleAdmin, "")
+	req := httptest.NewRequest("DELETE", "/profile?id=victim", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	// Authorization passes; without a database the delete itself fails
+	if rec.Code == http.StatusForbidden || rec.Code == http.StatusUnauthorized {
+		t.Errorf("Admin delete should be authorized, got %d", rec.Code)
+	}
+}
+
+// ==================== SESSION TESTS ====================
+
+// stubSessionRevoked replaces the session revocation lookup for one test.
+func stubSessionRevoked(t *testing.T, fn func(string) (bool, error)) {
+	prev := sessionRevoked
+	sessionRevoked = fn
+	t.Cleanup(func() { sessionRevoked = prev })
+}
+
+func TestAuthMiddleware_InjectsSession(t *testing.T) {
+	stubSessionRevoked(t, func(string) (bool, error) { return false, nil })
+	var gotSession string
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		gotSession = SessionIDFromContext(r.Context())
+	})
+
+	token, _, _ := IssueAccessToken("user-1", RoleUser, "session-1")
+	req := httptest.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler(httptest.NewRecorder(), req)
+
+	if gotSession != "session-1" {
+		t.Errorf("Expected session-1 in context, got %q", gotSession)
+	}
+}
+
+func TestAuthMiddleware_RejectsRevokedSession(t *testing.T) {
+	stubSessionRevoked(t, func(sid string) (bool, error) { return sid == "session-1", nil })
+	called := false
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	token, _, _ := IssueAccessToken("user-1", RoleUser, "session-1")
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if called {
+		t.Error("Expected handler not to be called for a revoked session")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestAuthMiddleware_SessionLookupFailure(t *testing.T) {
+	stubSessionRevoked(t, func(string) (bool, error) { return false, errors.New("db down") })
+	called := false
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	token, _, _ := IssueAccessToken("user-1", RoleUser, "session-1")
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if called {
+		t.Error("Expected handler not to be called when the session can't be checked")
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+func TestServeWs_RevokedSession(t *testing.T) {
+	stubSessionRevoked(t, func(string) (bool, error) { return true, nil })
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	token, _, _ := IssueAccessToken("user-1", RoleUser, "session-1")
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	ServeWs(hub, rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestServeWs_FirstMessageRevokedSession(t *testing.T) {
+	stubSessionRevoked(t, func(string) (bool, error) { return true, nil })
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+
+	token, _, _ := IssueAccessToken("revoked-user", RoleUser, "session-1")
+	auth, _ := json.Marshal(WSMessage{Event: "AUTH", Token: token})
+	ws.WriteMessage(websocket.TextMessage, auth)
+
+	ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected policy violation close, got %v", err)
+	}
+}
+
+func TestHandleRefreshToken_UnknownToken(t *testing.T) {
+	hub := NewHub()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/token/refresh", strings.NewReader(`{"refreshToken":"unknown"}`))
+	handleRefreshToken(hub)(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestHandleSessions_MethodNotAllowed(t *testing.T) {
+	hub := NewHub()
+
+	rec := httptest.NewRecorder()
+	handleSessions(hub)(rec, httptest.NewRequest("POST", "/sessions", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	if got := clientIP(req); got != "10.0.0.1" {
+		t.Errorf("Expected 10.0.0.1, got %s", got)
+	}
+
+	// Without trusted proxies the header is client-controlled and ignored
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	if got := clientIP(req); got != "10.0.0.1" {
+		t.Errorf("Expected X-Forwarded-For to be ignored, got %s", got)
+	}
+}
+
+func TestClientIP_TrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+	if err := LoadTrustedProxies(); err != nil {
+		t.Fatalf("LoadTrustedProxies: %v", err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"10.0.0.1:5555", "203.0.113.7", "203.0.113.7"},
+		// A spoofed leftmost hop is skipped: the proxy appended the real peer
+		{"10.0.0.1:5555", "1.2.3.4, 203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1:5555", "203.0.113.7, 192.0.2.1, 10.0.0.2", "203.0.113.7"},
+		{"10.0.0.1:5555", "", "10.0.0.1"},
+		// Untrusted peers can't claim another address
+		{"198.51.100.9:5555", "203.0.113.7", "198.51.100.9"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := clientIP(req); got != c.want {
+			t.Errorf("%s via %q: expected %s, got %s", c.remote, c.forwarded, c.want, got)
+		}
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "not-an-ip")
+	if err := LoadTrustedProxies(); err == nil {
+		t.Error("Expected an invalid entry to be rejected")
+	}
+}
+
+func TestHubDisconnectSessions(t *testing.T) {
+	stubSessionRevoked(t, func(string) (bool, error) { return false, nil })
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	revokedToken, _, _ := IssueAccessToken("revoked-user", RoleUser, "session-revoked")
+	keptToken, _, _ := IssueAccessToken("kept-user", RoleUser, "session-kept")
+
+	revoked, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+revokedToken, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer revoked.Close()
+	kept, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+keptToken, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer kept.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	hub.DisconnectSessions("session-revoked")
+
+	revoked.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = revoked.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected policy-violation close, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	hub.mu.RLock()
+	_, revokedExists := hub.clients["revoked-user"]
+	_, keptExists := hub.clients["kept-user"]
+	hub.mu.RUnlock()
+	if revokedExists {
+		t.Error("Revoked session should be unregistered")
+	}
+	if !keptExists {
+		t.Error("Other sessions must stay connected")
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Backplane message kinds
+const (
+	fanoutRoom       = "room"
+	fanoutUser       = "user"
+	fanoutGlobal     = "global"
+	fanoutDisconnect = "disconnect"
+	fanoutEvict      = "evict"
+	fanoutJoin       = "join"
+)
+
+// BackplaneMessage is an event every Hub replica receives and delivers to
+// its own local clients.
+type BackplaneMessage struct {
+	Kind    string          `json:"kind"`
+	Target  string          `json:"target,omitempty"`  // room or user ID
+	Targets []string        `json:"targets,omitempty"` // session IDs to disconnect, or user IDs to evict or join
+	Payload json.RawMessage `json:"payload,omitempty"` // encoded WSMessage frame
+}
+
+// Backplane carries Hub events between server replicas. Publish must also
+// deliver to the publishing replica's own subscriber.
+type Backplane interface {
+	Publish(msg BackplaneMessage) error
+	Subscribe(handler func(BackplaneMessage)) error
+	Close() error
+}
+
+// PresenceTracker records which replicas hold a live socket for each user, so
+// a user is only announced offline once no replica has them. Backplanes that
+// don't implement it leave presence replica-local.
+type PresenceTracker interface {
+	// Connected records userID on replicaID and reports whether another
+	// replica already had them.
+	Connected(userID, replicaID string) (elsewhere bool, err error)
+	// Disconnected forgets userID on replicaID and reports whether another
+	// replica still has them.
+	Disconnected(userID, replicaID string) (elsewhere bool, err error)
+	// Heartbeat refreshes replicaID's users and expires those of replicas that
+	// stopped sending heartbeats. It returns the users that are now offline
+	// everywhere as a result.
+	Heartbeat(replicaID string, userIDs []string) (gone []string, err error)
+}
+
+// NewBackplaneFromEnv returns the Postgres backplane when HUB_BACKPLANE is
+// "postgres", and an in-process one otherwise (single replica).
+func NewBackplaneFromEnv() (Backplane, error) {
+	switch getEnv("HUB_BACKPLANE", "memory") {
+	case "memory":
+		return NewMemoryBackplane(), nil
+	case "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("postgres backplane needs a database")
+		}
+		return NewPostgresBackplane(db, getEnv("HUB_BACKPLANE_CHANNEL", "hub_events")), nil
+	default:
+		return nil, fmt.Errorf("unknown HUB_BACKPLANE %q", getEnv("HUB_BACKPLANE", ""))
+	}
+}
+
+// ==========================================
+// IN-MEMORY BACKPLANE
+// ==========================================
+
+// MemoryBackplane delivers synchronously to every subscriber in the process.
+// Sharing one between several Hubs simulates a multi-replica deployment.
+type MemoryBackplane struct {
+	mu   sync.RWMutex
+	subs []func(BackplaneMessage)
+
+	// presence: UserID -> replicas the user is connected to
+	presence map[string]map[string]bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+func (b *MemoryBackplane) Publish(msg BackplaneMessage) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, handler := range subs {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(BackplaneMessage)) error {
+	b.mu.Lock()
+	b.subs = append(b.subs, handler)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	b.subs = nil
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *MemoryBackplane) Connected(userID, replicaID string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.presence == nil {
+		b.presence = make(map[string]map[string]bool)
+	}
+	if b.presence[userID] == nil {
+		b.presence[userID] = make(map[string]bool)
+	}
+	replicas := b.presence[userID]
+	elsewhere := len(replicas) > 1 || len(replicas) == 1 && !replicas[replicaID]
+	replicas[replicaID] = true
+	return elsewhere, nil
+}
+
+func (b *MemoryBackplane) Disconnected(userID, replicaID string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	replicas := b.presence[userID]
+	delete(replicas, replicaID)
+	if len(replicas) == 0 {
+		delete(b.presence, userID)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Heartbeat reconciles replicaID's users. Replicas sharing a MemoryBackplane
+// live in one process, so none can vanish without disconnecting its users.
+func (b *MemoryBackplane) Heartbeat(replicaID string, userIDs []string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.presence == nil {
+		b.presence = make(map[string]map[string]bool)
+	}
+	live := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		live[userID] = true
+		if b.presence[userID] == nil {
+			b.presence[userID] = make(map[string]bool)
+		}
+		b.presence[userID][replicaID] = true
+	}
+	for userID, replicas := range b.presence {
+		if replicas[replicaID] && !live[userID] {
+			delete(replicas, replicaID)
+			if len(replicas) == 0 {
+				delete(b.presence, userID)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ==========================================
+// POSTGRES LISTEN/NOTIFY BACKPLANE
+// ==========================================
+
+const (
+	// NOTIFY payloads are capped at 8000 bytes; larger messages are parked in
+	// backplane_payloads and the notification carries only their ID.
+	maxNotifyPayload     = 7000
+	backplanePayloadTTL  = time.Minute
+	backplaneReconnectIn = 2 * time.Second
+	// A replica's user_presence rows expire this long after its last
+	// heartbeat, e.g. when it crashed without disconnecting its users.
+	presenceTTL = 90 * time.Second
+)
+
+// PostgresBackplane fans events out with LISTEN/NOTIFY on one channel.
+type PostgresBackplane struct {
+	pool    *pgxpool.Pool
+	channel string
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewPostgresBackplane(pool *pgxpool.Pool, channel string) *PostgresBackplane {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PostgresBackplane{pool: pool, channel: channel, ctx: ctx, cancel: cancel}
+}
+
+func (b *PostgresBackplane) Publish(msg BackplaneMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+
+	notification := string(data)
+	if len(data) > maxNotifyPayload {
+		var id int64
+		err := b.pool.QueryRow(ctx,
+			`INSERT INTO backplane_payloads (payload) VALUES ($1) RETURNING id`, data).Scan(&id)
+		if err != nil {
+			return err
+		}
+		notification = "ref:" + strconv.FormatInt(id, 10)
+	}
+	_, err = b.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, b.channel, notification)
+	return err
+}
+
+// Subscribe listens on a dedicated connection until Close, reconnecting
+// after errors. Events published while disconnected are lost.
+func (b *PostgresBackplane) Subscribe(handler func(BackplaneMessage)) error {
+	go func() {
+		for b.ctx.Err() == nil {
+			if err := b.listen(handler); err != nil && b.ctx.Err() == nil {
+				log.Printf("Backplane listen error: %v", err)
+				time.Sleep(backplaneReconnectIn)
+			}
+		}
+	}()
+	go b.sweep()
+	return nil
+}
+
+func (b *PostgresBackplane) listen(handler func(BackplaneMessage)) error {
+	conn, err := b.pool.Acquire(b.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(b.ctx, `LISTEN "`+b.channel+`"`); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(b.ctx)
+		if err != nil {
+			return err
+		}
+		msg, err := b.decode(n.Payload)
+		if err != nil {
+			log.Printf("Backplane decode error: %v", err)
+			continue
+		}
+		handler(msg)
+	}
+}
+
+func (b *PostgresBackplane) decode(notification string) (BackplaneMessage, error) {
+	var msg BackplaneMessage
+	data := []byte(notification)
+	if len(notification) > 4 && notification[:4] == "ref:" {
+		id, err := strconv.ParseInt(notification[4:], 10, 64)
+		if err != nil {
+			return msg, err
+		}
+		if err := b.pool.QueryRow(b.ctx,
+			`SELECT payload FROM backplane_payloads WHERE id = $1`, id).Scan(&data); err != nil {
+			return msg, err
+		}
+	}
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// sweep drops parked payloads once every replica has had time to read them.
+func (b *PostgresBackplane) sweep() {
+	ticker := time.NewTicker(backplanePayloadTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := b.pool.Exec(b.ctx,
+				`DELETE FROM backplane_payloads WHERE created_at < NOW() - $1::interval`,
+				backplanePayloadTTL.String())
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("Backplane sweep error: %v", err)
+			}
+		}
+	}
+}
+
+func (b *PostgresBackplane) Connected(userID, replicaID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+	_, err := b.pool.Exec(ctx, `
+		INSERT INTO user_presence (user_id, replica_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, replica_id) DO UPDATE SET heartbeat_at = NOW()`,
+		userID, replicaID)
+	if err != nil {
+		return false, err
+	}
+	return b.onlineElsewhere(ctx, userID, replicaID)
+}
+
+func (b *PostgresBackplane) Disconnected(userID, replicaID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+	_, err := b.pool.Exec(ctx,
+		`DELETE FROM user_presence WHERE user_id = $1 AND replica_id = $2`, userID, replicaID)
+	if err != nil {
+		return false, err
+	}
+	return b.onlineElsewhere(ctx, userID, replicaID)
+}
+
+// onlineElsewhere reports whether a replica other than replicaID has a fresh
+// row for userID.
+func (b *PostgresBackplane) onlineElsewhere(ctx context.Context, userID, replicaID string) (bool, error) {
+	var elsewhere bool
+	err := b.pool.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM user_presence
+			WHERE user_id = $1 AND replica_id <> $2 AND heartbeat_at > NOW() - $3::interval)`,
+		userID, replicaID, presenceTTL.String()).Scan(&elsewhere)
+	return elsewhere, err
+}
+
+// Heartbeat upserts replicaID's users, drops its rows for users who have
+// left, and expires every replica's stale rows. Only the replica whose DELETE
+// removed a stale row reports that user, so each is announced once.
+func (b *PostgresBackplane) Heartbeat(replicaID string, userIDs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	_, err := b.pool.Exec(ctx, `
+		INSERT INTO user_presence (user_id, replica_id)
+		SELECT unnest($2::text[]), $1
+		ON CONFLICT (user_id, replica_id) DO UPDATE SET heartbeat_at = NOW()`,
+		replicaID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	_, err = b.pool.Exec(ctx,
+		`DELETE FROM user_presence WHERE replica_id = $1 AND NOT (user_id = ANY($2::text[]))`,
+		replicaID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := b.pool.Query(ctx, `
+		WITH expired AS (
+			DELETE FROM user_presence WHERE heartbeat_at < NOW() - $1::interval
+			RETURNING user_id
+		)
+		SELECT DISTINCT e.user_id FROM expired e
+		WHERE NOT EXISTS (
+			SELECT 1 FROM user_presence p
+			WHERE p.user_id = e.user_id AND p.heartbeat_at >= NOW() - $1::interval)`,
+		presenceTTL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var gone []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		gone = append(gone, userID)
+	}
+	return gone, rows.Err()
+}
+
+func (b *PostgresBackplane) Close() error {
+	b.cancel()
+	return nil
+}
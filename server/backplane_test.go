@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// newReplicas returns two running hubs sharing one backplane, as two server
+// replicas would.
+func newReplicas(t *testing.T) (*Hub, *Hub) {
+	t.Helper()
+	bp := NewMemoryBackplane()
+	a, b := NewHubWithBackplane(bp), NewHubWithBackplane(bp)
+	go a.Run()
+	go b.Run()
+	t.Cleanup(func() {
+		a.quit <- true
+		b.quit <- true
+	})
+	return a, b
+}
+
+func connectClient(h *Hub, uid string) *Client {
+	c := &Client{UID: uid, send: make(chan []byte, 10), hub: h}
+	h.register <- c
+	return c
+}
+
+func expectFrame(t *testing.T, c *Client, want string) {
+	t.Helper()
+	select {
+	case got := <-c.send:
+		if string(got) != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("Timeout waiting for %s on %s", want, c.UID)
+	}
+}
+
+func TestBackplane_RoomEventReachesOtherReplica(t *testing.T) {
+	a, b := newReplicas(t)
+	local, remote := connectClient(a, "room-local"), connectClient(b, "room-remote")
+	a.JoinRoom("room-1", local)
+	b.JoinRoom("room-1", remote)
+
+	msg := `{"Event":"NEW_MESSAGE","Payload":{}}`
+	a.PublishToRoom("room-1", []byte(msg))
+
+	expectFrame(t, local, msg)
+	expectFrame(t, remote, msg)
+}
+
+func TestBackplane_UserEventReachesOtherReplica(t *testing.T) {
+	a, b := newReplicas(t)
+	bystander := connectClient(a, "dm-bystander")
+	recipient := connectClient(b, "dm-recipient")
+	time.Sleep(10 * time.Millisecond)
+
+	msg := `{"Event":"NEW_MESSAGE","Payload":{"Content":"hi"}}`
+	a.PublishToUser("dm-recipient", []byte(msg))
+
+	expectFrame(t, recipient, msg)
+	if len(bystander.send) != 0 {
+		t.Error("User-targeted event must not reach other users")
+	}
+}
+
+func TestBackplane_GlobalEventReachesEveryReplica(t *testing.T) {
+	a, b := newReplicas(t)
+	first, second := connectClient(a, "global-a"), connectClient(b, "global-b")
+	time.Sleep(10 * time.Millisecond)
+
+	msg := `{"Event":"NEW_PARTY","Payload":{}}`
+	b.broadcastGlobal([]byte(msg))
+
+	expectFrame(t, first, msg)
+	expectFrame(t, second, msg)
+}
+
+func TestBackplane_DisconnectIgnoresEmptySessions(t *testing.T) {
+	bp := &recordingBackplane{}
+	NewHubWithBackplane(bp).DisconnectSessions("", "")
+	if len(bp.published) != 0 {
+		t.Errorf("Expected nothing published for empty session IDs, got %v", bp.published)
+	}
+}
+
+func TestBackplane_PublishFailureDeliversLocally(t *testing.T) {
+	hub := NewHubWithBackplane(&recordingBackplane{err: errors.New("connection refused")})
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+	c := connectClient(hub, "fallback-user")
+	time.Sleep(10 * time.Millisecond)
+
+	msg := `{"Event":"APPLICATION_UPDATED","Payload":{}}`
+	hub.PublishToUser("fallback-user", []byte(msg))
+	expectFrame(t, c, msg)
+}
+
+func TestNewBackplaneFromEnv(t *testing.T) {
+	os.Unsetenv("HUB_BACKPLANE")
+	if bp, err := NewBackplaneFromEnv(); err != nil {
+		t.Fatalf("Expected default backplane, got %v", err)
+	} else if _, ok := bp.(*MemoryBackplane); !ok {
+		t.Errorf("Expected memory backplane by default, got %T", bp)
+	}
+
+	os.Setenv("HUB_BACKPLANE", "carrier-pigeon")
+	defer os.Unsetenv("HUB_BACKPLANE")
+	if _, err := NewBackplaneFromEnv(); err == nil {
+		t.Error("Expected unknown backplane to be rejected")
+	}
+}
+
+func TestPostgresBackplane_DecodeInline(t *testing.T) {
+	bp := NewPostgresBackplane(nil, "hub_events")
+	defer bp.Close()
+
+	msg, err := bp.decode(`{"kind":"room","target":"room-1","payload":{"Event":"PING"}}`)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if msg.Kind != fanoutRoom || msg.Target != "room-1" || string(msg.Payload) != `{"Event":"PING"}` {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+	if _, err := bp.decode("ref:not-a-number"); err == nil {
+		t.Error("Expected malformed reference to fail")
+	}
+}
+
+func TestBackplane_EvictFromRoomAcrossReplicas(t *testing.T) {
+	a, b := newReplicas(t)
+	host := connectClient(a, "evict-host")
+	guest := connectClient(b, "evict-guest")
+	time.Sleep(10 * time.Millisecond)
+	a.JoinRoom("room-evict", host)
+	b.JoinRoom("room-evict", guest)
+
+	a.EvictFromRoom("room-evict", "evict-guest")
+
+	b.mu.RLock()
+	_, remoteRoom := b.rooms["room-evict"]
+	b.mu.RUnlock()
+	a.mu.RLock()
+	stillMember := a.rooms["room-evict"][host]
+	a.mu.RUnlock()
+	if remoteRoom {
+		t.Error("Evicted guest should be removed from the room on its replica")
+	}
+	if !stillMember {
+		t.Error("Eviction must not touch other members")
+	}
+}
+
+func TestBackplane_AddToRoomAcrossReplicas(t *testing.T) {
+	a, b := newReplicas(t)
+	sender := connectClient(a, "join-sender")
+	phone, laptop := connectClient(b, "join-recipient"), connectClient(b, "join-recipient")
+	bystander := connectClient(b, "join-bystander")
+	time.Sleep(10 * time.Millisecond)
+
+	a.AddToRoom("room-dm", "join-sender", "join-recipient")
+	time.Sleep(20 * time.Millisecond)
+
+	if !a.InRoom("room-dm", sender) || !b.InRoom("room-dm", phone) || !b.InRoom("room-dm", laptop) {
+		t.Error("Expected every device of both users to join the room")
+	}
+	if b.InRoom("room-dm", bystander) {
+		t.Error("Only the named users may join")
+	}
+}
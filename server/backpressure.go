@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// SlowClientPolicy decides what gives way when a client's send queue is full.
+type SlowClientPolicy string
+
+const (
+	// PolicyDropOldest discards the oldest queued frame to make room. Clients
+	// notice the gap in Seq and SYNC.
+	PolicyDropOldest SlowClientPolicy = "drop_oldest"
+	// PolicyCoalesce first discards queued frames superseded by the new one
+	// (e.g. an older status of the same party), then falls back to drop_oldest.
+	PolicyCoalesce SlowClientPolicy = "coalesce"
+	// PolicyDisconnect unregisters the client, which reconnects and SYNCs.
+	PolicyDisconnect SlowClientPolicy = "disconnect"
+)
+
+const (
+	defaultSendQueue  = 256
+	defaultHubShards  = 8
+	hubShardQueueSize = 1024
+)
+
+// HubConfig tunes per-client queues and room fan-out.
+type HubConfig struct {
+	SendQueue int              // frames buffered per client (WS_SEND_QUEUE)
+	Policy    SlowClientPolicy // WS_SLOW_CLIENT_POLICY
+	Shards    int              // room fan-out workers (HUB_SHARDS)
+}
+
+// HubConfigFromEnv reads the hub tuning variables, ignoring invalid values.
+func HubConfigFromEnv() HubConfig {
+	cfg := HubConfig{SendQueue: defaultSendQueue, Policy: PolicyDropOldest, Shards: defaultHubShards}
+	if n, err := strconv.Atoi(getEnv("WS_SEND_QUEUE", "")); err == nil && n > 0 {
+		cfg.SendQueue = n
+	}
+	switch p := SlowClientPolicy(getEnv("WS_SLOW_CLIENT_POLICY", "")); p {
+	case PolicyDropOldest, PolicyCoalesce, PolicyDisconnect:
+		cfg.Policy = p
+	case "":
+	default:
+		log.Printf("⚠️  Unknown WS_SLOW_CLIENT_POLICY %q, using %s", p, cfg.Policy)
+	}
+	if n, err := strconv.Atoi(getEnv("HUB_SHARDS", "")); err == nil && n > 0 {
+		cfg.Shards = n
+	}
+	return cfg
+}
+
+// HubMetrics are counters exported on /metrics.
+type HubMetrics struct {
+	Dropped         atomic.Int64 // frames discarded for full client queues
+	Coalesced       atomic.Int64 // queued frames replaced by a newer one
+	SlowDisconnects atomic.Int64 // clients dropped by PolicyDisconnect
+	RoomDropped     atomic.Int64 // room events discarded for a full shard queue
+}
+
+// shardFor maps a room to its fan-out worker, so every event of one room is
+// delivered in order by the same worker.
+func (h *Hub) shardFor(roomID string) chan RoomEvent {
+	f := fnv.New32a()
+	f.Write([]byte(roomID))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+// runShard fans room events out until stop is closed.
+func (h *Hub) runShard(events chan RoomEvent, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case ev := <-events:
+			h.mu.RLock()
+			for client := range h.rooms[ev.RoomID] {
+				client.enqueue(ev.Message)
+			}
+			h.mu.RUnlock()
+		}
+	}
+}
+
+// overflow handles a frame for a client whose queue is full, following the
+// hub's policy. It runs with c.sendMu held and reports whether msg was queued.
+func (h *Hub) overflow(c *Client, msg []byte) bool {
+	switch h.config.Policy {
+	case PolicyDisconnect:
+		h.metrics.Dropped.Add(1)
+		h.dropSlowClient(c)
+		return false
+	case PolicyCoalesce:
+		if c.coalesce(msg) {
+			h.metrics.Coalesced.Add(1)
+			return true
+		}
+	}
+
+	select {
+	case <-c.send:
+	default:
+	}
+	h.metrics.Dropped.Add(1)
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropSlowClient unregisters c once, however many frames overflow meanwhile.
+func (h *Hub) dropSlowClient(c *Client) {
+	if c.dropping.CompareAndSwap(false, true) {
+		h.metrics.SlowDisconnects.Add(1)
+		go func() { h.unregister <- c }()
+	}
+}
+
+// coalescableEvents carry a full snapshot, so only the newest per key matters.
+var coalescableEvents = map[string]bool{
+	"PARTY_STATUS_UPDATED": true,
+	"FUNDRAISER_UPDATED":   true,
+}
+
+// coalesceKey identifies frames that supersede each other, or "" if the
+// frame must not be dropped in favour of a newer one.
+func coalesceKey(frame []byte) string {
+	var f struct {
+		Event   string `json:"Event"`
+		Payload struct {
+			ID      string `json:"ID"`
+			PartyID string `json:"PartyID"`
+			ChatID  string `json:"ChatID"`
+			UserID  string `json:"UserID"`
+		} `json:"Payload"`
+	}
+	if json.Unmarshal(frame, &f) != nil || !coalescableEvents[f.Event] {
+		return ""
+	}
+	p := f.Payload
+	return f.Event + "|" + p.ID + "|" + p.PartyID + "|" + p.ChatID + "|" + p.UserID
+}
+
+// coalesce removes queued frames that msg supersedes and queues msg in their
+// place. It runs with c.sendMu held, so the queue only shrinks meanwhile.
+func (c *Client) coalesce(msg []byte) bool {
+	key := coalesceKey(msg)
+	if key == "" {
+		return false
+	}
+
+	queued := make([][]byte, 0, len(c.send))
+	for len(c.send) > 0 {
+		select {
+		case frame := <-c.send:
+			queued = append(queued, frame)
+		default:
+		}
+	}
+	kept := queued[:0]
+	for _, frame := range queued {
+		if coalesceKey(frame) != key {
+			kept = append(kept, frame)
+		}
+	}
+	replaced := len(kept) < len(queued)
+	for _, frame := range kept {
+		c.send <- frame
+	}
+	if !replaced {
+		return false
+	}
+	c.send <- msg
+	return true
+}
+
+// handleMetrics serves hub counters and queue depths in the Prometheus text
+// format. Set METRICS_TOKEN to require it as a bearer token.
+func handleMetrics(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := getEnv("METRICS_TOKEN", ""); token != "" && bearerToken(r) != token {
+			writeError(w, r, unauthorizedError("Invalid metrics token"))
+			return
+		}
+
+		hub.mu.RLock()
+		var clients, depth, maxDepth int
+		for _, devices := range hub.clients {
+			for c := range devices {
+				clients++
+				n := len(c.send)
+				depth += n
+				if n > maxDepth {
+					maxDepth = n
+				}
+			}
+		}
+		rooms := len(hub.rooms)
+		hub.mu.RUnlock()
+		var shardDepth int
+		for _, s := range hub.shards {
+			shardDepth += len(s)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metric := func(name, kind, help string, value int64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+		}
+		metric("waterparty_ws_clients", "gauge", "Connected WebSocket clients.", int64(clients))
+		metric("waterparty_ws_rooms", "gauge", "Rooms with at least one local member.", int64(rooms))
+		metric("waterparty_ws_send_queue_depth", "gauge", "Frames queued across all clients.", int64(depth))
+		metric("waterparty_ws_send_queue_max_depth", "gauge", "Longest client send queue.", int64(maxDepth))
+		metric("waterparty_ws_send_queue_limit", "gauge", "Send queue size per client.", int64(hub.config.SendQueue))
+		metric("waterparty_hub_room_queue_depth", "gauge", "Room events waiting for fan-out.", int64(shardDepth))
+		metric("waterparty_ws_dropped_total", "counter", "Frames dropped because a client queue was full.", hub.metrics.Dropped.Load())
+		metric("waterparty_ws_coalesced_total", "counter", "Queued frames replaced by a newer frame.", hub.metrics.Coalesced.Load())
+		metric("waterparty_ws_slow_disconnects_total", "counter", "Clients disconnected for falling behind.", hub.metrics.SlowDisconnects.Load())
+		metric("waterparty_hub_room_dropped_total", "counter", "Room events dropped because fan-out was behind.", hub.metrics.RoomDropped.Load())
+	}
+}
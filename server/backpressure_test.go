@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPolicyClient(policy SlowClientPolicy, queue int) (*Hub, *Client) {
+	hub := NewHubWithConfig(NewMemoryBackplane(), HubConfig{SendQueue: queue, Policy: policy, Shards: 2})
+	return hub, &Client{UID: "slow-" + string(policy), send: make(chan []byte, queue), hub: hub}
+}
+
+func drain(c *Client) []string {
+	var frames []string
+	for len(c.send) > 0 {
+		frames = append(frames, string(<-c.send))
+	}
+	return frames
+}
+
+func TestEnqueue_DropOldest(t *testing.T) {
+	hub, c := newPolicyClient(PolicyDropOldest, 2)
+	for _, f := range []string{"1", "2", "3"} {
+		if !c.enqueue([]byte(f)) {
+			t.Errorf("Expected frame %s to be queued", f)
+		}
+	}
+
+	if got := strings.Join(drain(c), ","); got != "2,3" {
+		t.Errorf("Expected oldest frame dropped, got %s", got)
+	}
+	if hub.metrics.Dropped.Load() != 1 {
+		t.Errorf("Expected 1 dropped frame, got %d", hub.metrics.Dropped.Load())
+	}
+}
+
+func TestEnqueue_Coalesce(t *testing.T) {
+	hub, c := newPolicyClient(PolicyCoalesce, 2)
+	old := `{"Event":"PARTY_STATUS_UPDATED","Payload":{"ID":"p1","Status":"OPEN"}}`
+	chat := `{"Event":"NEW_MESSAGE","Payload":{"ID":"m1"}}`
+	latest := `{"Event":"PARTY_STATUS_UPDATED","Payload":{"ID":"p1","Status":"LOCKED"}}`
+	c.enqueue([]byte(old))
+	c.enqueue([]byte(chat))
+	c.enqueue([]byte(latest))
+
+	frames := drain(c)
+	if len(frames) != 2 || frames[0] != chat || frames[1] != latest {
+		t.Errorf("Expected stale status replaced in order, got %v", frames)
+	}
+	if hub.metrics.Coalesced.Load() != 1 || hub.metrics.Dropped.Load() != 0 {
+		t.Errorf("Expected 1 coalesced and 0 dropped, got %d and %d", hub.metrics.Coalesced.Load(), hub.metrics.Dropped.Load())
+	}
+
+	// Nothing to coalesce with: fall back to dropping the oldest frame
+	c.enqueue([]byte(chat))
+	c.enqueue([]byte(chat))
+	c.enqueue([]byte(latest))
+	if hub.metrics.Dropped.Load() != 1 {
+		t.Errorf("Expected fallback drop, got %d", hub.metrics.Dropped.Load())
+	}
+}
+
+func TestEnqueue_Disconnect(t *testing.T) {
+	hub, c := newPolicyClient(PolicyDisconnect, 1)
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+	hub.register <- c
+	time.Sleep(10 * time.Millisecond)
+
+	c.enqueue([]byte("1"))
+	c.enqueue([]byte("2"))
+	c.enqueue([]byte("3"))
+	time.Sleep(20 * time.Millisecond)
+
+	if hub.IsOnline(c.UID) {
+		t.Error("Slow client should be unregistered")
+	}
+	if hub.metrics.SlowDisconnects.Load() != 1 {
+		t.Errorf("Expected a single disconnect, got %d", hub.metrics.SlowDisconnects.Load())
+	}
+	// Late frames for a closed client are discarded, not sent on a closed channel
+	if c.enqueue([]byte("4")) {
+		t.Error("Expected enqueue after close to be refused")
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	a := coalesceKey([]byte(`{"Event":"FUNDRAISER_UPDATED","Payload":{"ID":"f1","PartyID":"p1"}}`))
+	b := coalesceKey([]byte(`{"Event":"FUNDRAISER_UPDATED","Payload":{"ID":"f2","PartyID":"p2"}}`))
+	if a == "" || a == b {
+		t.Errorf("Expected distinct keys per fundraiser, got %q and %q", a, b)
+	}
+	for _, frame := range []string{`{"Event":"NEW_MESSAGE","Payload":{"ID":"m1"}}`, `not json`, `{"Event":"PARTY_STATUS_UPDATED","Payload":[1]}`} {
+		if key := coalesceKey([]byte(frame)); key != "" {
+			t.Errorf("Expected %s not to coalesce, got %q", frame, key)
+		}
+	}
+}
+
+func TestShardFor_StablePerRoom(t *testing.T) {
+	hub := NewHubWithConfig(NewMemoryBackplane(), HubConfig{SendQueue: 1, Policy: PolicyDropOldest, Shards: 4})
+	if hub.shardFor("room-1") != hub.shardFor("room-1") {
+		t.Error("A room must always map to the same shard")
+	}
+}
+
+func TestHubConfigFromEnv(t *testing.T) {
+	os.Setenv("WS_SEND_QUEUE", "64")
+	os.Setenv("WS_SLOW_CLIENT_POLICY", "coalesce")
+	os.Setenv("HUB_SHARDS", "nope")
+	defer func() {
+		os.Unsetenv("WS_SEND_QUEUE")
+		os.Unsetenv("WS_SLOW_CLIENT_POLICY")
+		os.Unsetenv("HUB_SHARDS")
+	}()
+
+	cfg := HubConfigFromEnv()
+	if cfg.SendQueue != 64 || cfg.Policy != PolicyCoalesce || cfg.Shards != defaultHubShards {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	hub, c := newPolicyClient(PolicyDropOldest, 1)
+	hub.clients[c.UID] = map[*Client]bool{c: true}
+	c.enqueue([]byte("1"))
+	c.enqueue([]byte("2"))
+
+	rec := httptest.NewRecorder()
+	handleMetrics(hub)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{"waterparty_ws_clients 1", "waterparty_ws_send_queue_depth 1", "waterparty_ws_dropped_total 1"} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected %q in metrics, got:\n%s", line, body)
+		}
+	}
+
+	os.Setenv("METRICS_TOKEN", "scrape-secret")
+	defer os.Unsetenv("METRICS_TOKEN")
+	rec = httptest.NewRecorder()
+	handleMetrics(hub)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 401 {
+		t.Errorf("Expected 401 without the metrics token, got %d", rec.Code)
+	}
+}
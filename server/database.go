@@ -14,12 +14,15 @@ import (
 	"image/jpeg"
 	_ "image/png"
 	"log"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	_ "golang.org/x/image/bmp"
 	_ "golang.org/x/image/webp"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/nfnt/resize"
 )
@@ -47,6 +50,13 @@ func InitDB(connString string) {
 	fmt.Println("✅ Database initialized and schema verified.")
 }
 
+// CloseDB waits for checked-out connections and closes the pool.
+func CloseDB() {
+	if db != nil {
+		db.Close()
+	}
+}
+
 // ==========================================
 // ASSET / FILE METHODS
 // ==========================================
@@ -62,6 +72,63 @@ func SaveAsset(data []byte, mimeType string) (string, error) {
 	return hashStr, err
 }
 
+// RecordAssetUpload notes that userID uploaded the asset hash.
+func RecordAssetUpload(hash, userID string) error {
+	if !uuidPattern.MatchString(userID) {
+		return nil
+	}
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO asset_uploads (hash, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		hash, userID)
+	return err
+}
+
+// IsAssetUploadedBy reports whether userID uploaded the asset hash.
+func IsAssetUploadedBy(hash, userID string) (bool, error) {
+	if !uuidPattern.MatchString(userID) {
+		return false, nil
+	}
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+	var uploaded bool
+	err := db.QueryRow(context.Background(),
+		"SELECT EXISTS(SELECT 1 FROM asset_uploads WHERE hash = $1 AND user_id = $2)",
+		hash, userID).Scan(&uploaded)
+	return uploaded, err
+}
+
+// GetAssetMedia returns the metadata and thumbnail hash cached for an asset
+// by SaveAssetMedia. found is false until the asset has been probed.
+func GetAssetMedia(hash string) (meta map[string]interface{}, thumbnail string, found bool, err error) {
+	var raw []byte
+	err = db.QueryRow(context.Background(),
+		"SELECT media_metadata, COALESCE(thumbnail_hash, '') FROM assets WHERE hash = $1 AND media_metadata IS NOT NULL",
+		hash).Scan(&raw, &thumbnail)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, "", false, err
+	}
+	return meta, thumbnail, true, nil
+}
+
+// SaveAssetMedia caches an asset's probed metadata and derived thumbnail.
+func SaveAssetMedia(hash string, meta map[string]interface{}, thumbnail string) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(context.Background(),
+		"UPDATE assets SET media_metadata = $2, thumbnail_hash = NULLIF($3, '') WHERE hash = $1",
+		hash, raw, thumbnail)
+	return err
+}
+
 // GetAsset retrieves binary data and mime type by hash.
 func GetAsset(hash string) ([]byte, string, error) {
 	var data []byte
@@ -102,7 +169,7 @@ func CreateUser(u User) (string, error) {
 		date_of_birth,height_cm, gender, drinking_pref, smoking_pref,job_title, company, school, degree,
 		instagram_handle, linkedin_handle, x_handle, tiktok_handle,is_verified, 
 		trust_score, elo_score, parties_hosted, flake_count,wallet_data, 
-		location_lat, location_lon, bio, updated_at, thumbnail
+		location_lat, location_lon, bio, updated_at, thumbnail, last_active_at
 	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, 
 		$13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30) 
 	RETURNING id`
@@ -114,7 +181,7 @@ func CreateUser(u User) (string, error) {
 		u.DateOfBirth, u.HeightCm, u.Gender, u.DrinkingPref, u.SmokingPref, u.JobTitle, u.Company, u.School, u.Degree,
 		u.InstagramHandle, u.LinkedinHandle, u.XHandle, u.TikTokHandle, u.IsVerified,
 		u.TrustScore, u.EloScore, u.PartiesHosted, u.FlakeCount, walletJSON,
-		u.LocationLat, u.LocationLon, u.Bio, &now, u.Thumbnail,
+		u.LocationLat, u.LocationLon, u.Bio, &now, u.Thumbnail, &now,
 	).Scan(&id)
 	return id, err
 }
@@ -124,12 +191,13 @@ func GetUser(id string) (User, error) {
 	var passwordHash string
 	var walletJSON []byte
 	var profilePhotos []string
-	query := `SELECT id, real_name, COALESCE(phone_number, ''), email, password_hash, COALESCE(profile_photos, '{}'), age, 
-		date_of_birth, height_cm, gender, COALESCE(drinking_pref, ''), COALESCE(smoking_pref, ''), 
+	query := `SELECT id, real_name, COALESCE(phone_number, ''), COALESCE(email, ''), COALESCE(password_hash, ''), COALESCE(profile_photos, '{}'), COALESCE(age, 0), 
+		date_of_birth, COALESCE(height_cm, 0), gender, COALESCE(drinking_pref, ''), COALESCE(smoking_pref, ''), 
 		COALESCE(job_title, ''), COALESCE(company, ''), COALESCE(school, ''), COALESCE(degree, ''), COALESCE(instagram_handle, ''), 
 		COALESCE(linkedin_handle, ''), COALESCE(x_handle, ''), COALESCE(tiktok_handle, ''), is_verified, trust_score, 
-		elo_score, parties_hosted, flake_count, COALESCE(wallet_data::text, '{}'), location_lat, location_lon, 
-		updated_at, created_at, COALESCE(bio, ''), COALESCE(thumbnail, '') 
+		elo_score, parties_hosted, flake_count, COALESCE(wallet_data::text, '{}'), COALESCE(location_lat, 0), COALESCE(location_lon, 0), 
+		updated_at, created_at, COALESCE(bio, ''), COALESCE(thumbnail, ''), COALESCE(role, 'user'),
+		COALESCE(email_verified, FALSE), COALESCE(dm_privacy, 'EVERYONE')
 		FROM users WHERE id = $1`
 
 	err := db.QueryRow(context.Background(), query, id).Scan(
@@ -138,7 +206,7 @@ func GetUser(id string) (User, error) {
 		&u.JobTitle, &u.Company, &u.School, &u.Degree, &u.InstagramHandle,
 		&u.LinkedinHandle, &u.XHandle, &u.TikTokHandle, &u.IsVerified, &u.TrustScore,
 		&u.EloScore, &u.PartiesHosted, &u.FlakeCount, &walletJSON, &u.LocationLat, &u.LocationLon,
-		&u.UpdatedAt, &u.CreatedAt, &u.Bio, &u.Thumbnail,
+		&u.UpdatedAt, &u.CreatedAt, &u.Bio, &u.Thumbnail, &u.Role, &u.EmailVerified, &u.DMPrivacy,
 	)
 	if err == nil {
 		json.Unmarshal(walletJSON, &u.WalletData)
@@ -149,15 +217,19 @@ func GetUser(id string) (User, error) {
 
 func GetUserByEmail(email string) (User, string, error) {
 	var u User
+	if db == nil {
+		return u, "", fmt.Errorf("database not initialized")
+	}
 	var passwordHash string
 	var walletJSON []byte
 	var profilePhotos []string
-	query := `SELECT id, real_name, COALESCE(phone_number, ''), email, password_hash, COALESCE(profile_photos, '{}'), age, 
-		date_of_birth, height_cm, gender, COALESCE(drinking_pref, ''), COALESCE(smoking_pref, ''), 
+	query := `SELECT id, real_name, COALESCE(phone_number, ''), COALESCE(email, ''), COALESCE(password_hash, ''), COALESCE(profile_photos, '{}'), COALESCE(age, 0), 
+		date_of_birth, COALESCE(height_cm, 0), gender, COALESCE(drinking_pref, ''), COALESCE(smoking_pref, ''), 
 		 COALESCE(job_title, ''), COALESCE(company, ''), COALESCE(school, ''), COALESCE(degree, ''), COALESCE(instagram_handle, ''), 
 		COALESCE(linkedin_handle, ''), COALESCE(x_handle, ''), COALESCE(tiktok_handle, ''), is_verified, trust_score, 
-		elo_score, parties_hosted, flake_count, COALESCE(wallet_data::text, '{}'), location_lat, location_lon, 
-		updated_at, created_at, COALESCE(bio, ''), COALESCE(thumbnail, '') 
+		elo_score, parties_hosted, flake_count, COALESCE(wallet_data::text, '{}'), COALESCE(location_lat, 0), COALESCE(location_lon, 0), 
+		updated_at, created_at, COALESCE(bio, ''), COALESCE(thumbnail, ''), COALESCE(role, 'user'),
+		COALESCE(email_verified, FALSE), COALESCE(dm_privacy, 'EVERYONE')
 		FROM users WHERE email = $1`
 
 	err := db.QueryRow(context.Background(), query, email).Scan(
@@ -166,7 +238,7 @@ func GetUserByEmail(email string) (User, string, error) {
 		&u.JobTitle, &u.Company, &u.School, &u.Degree, &u.InstagramHandle,
 		&u.LinkedinHandle, &u.XHandle, &u.TikTokHandle, &u.IsVerified, &u.TrustScore,
 		&u.EloScore, &u.PartiesHosted, &u.FlakeCount, &walletJSON, &u.LocationLat, &u.LocationLon,
-		&u.UpdatedAt, &u.CreatedAt, &u.Bio, &u.Thumbnail,
+		&u.UpdatedAt, &u.CreatedAt, &u.Bio, &u.Thumbnail, &u.Role, &u.EmailVerified, &u.DMPrivacy,
 	)
 	if err == nil {
 		json.Unmarshal(walletJSON, &u.WalletData)
@@ -235,9 +307,12 @@ func UpdateUser(u User) error {
 	thumbnail := nullString(_thumb)
 	bio := nullString(u.Bio)
 
+	// Changing the phone number drops verification until the new number passes OTP.
+	// Server-owned fields (trust/elo scores, counters) are never written here.
 	query := `UPDATE users SET 
 		real_name=CAST($1 AS TEXT), 
 		phone_number=CAST($2 AS TEXT), 
+		is_verified=CASE WHEN COALESCE(phone_number, '') = COALESCE(CAST($2 AS TEXT), '') THEN is_verified ELSE FALSE END,
 		profile_photos=CAST($3 AS TEXT[]), 
 		bio=CAST($4 AS TEXT),
 		location_lat=$5, 
@@ -345,162 +420,617 @@ func DeleteUser(id string) error {
 }
 
 // ==========================================
-// PARTY CRUD
+// AUTH TOKENS
 // ==========================================
 
-func CreateParty(p Party) (string, error) {
-	// Use atomic transaction to ensure party and chat room are created together
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// CreateSession records a new signed-in device for the user.
+func CreateSession(userID, userAgent, ipAddress string) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database not initialized")
+	}
+	var id string
+	err := db.QueryRow(context.Background(),
+		"INSERT INTO sessions (user_id, user_agent, ip_address) VALUES ($1, $2, $3) RETURNING id",
+		userID, userAgent, ipAddress).Scan(&id)
+	return id, err
+}
+
+// GetActiveSessions lists the user's sessions that have not been revoked.
+func GetActiveSessions(userID string) ([]Session, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	query := `SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at
+		FROM sessions WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_used_at DESC`
+	rows, err := db.Query(context.Background(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// IsSessionRevoked reports whether a session has been revoked. Unknown
+// sessions count as revoked.
+func IsSessionRevoked(sessionID string) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+	var revoked bool
+	err := db.QueryRow(context.Background(),
+		"SELECT revoked_at IS NOT NULL FROM sessions WHERE id = $1", sessionID).Scan(&revoked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	return revoked, err
+}
+
+// RevokeSession revokes one of the user's sessions and its refresh tokens.
+// It reports whether an active session was found.
+func RevokeSession(userID, sessionID string) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
 	tx, err := db.Begin(context.Background())
 	if err != nil {
-		return "", fmt.Errorf("failed to begin transaction: %w", err)
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback(context.Background())
 
-	// Insert party
-	partyQuery := `INSERT INTO parties (
-		host_id, title, description, party_photos, start_time, duration_hours, status,
-		is_location_revealed, address, city, geo_lat, geo_lon, max_capacity, current_guest_count,
-		vibe_tags, rules, chat_room_id, thumbnail, created_at, updated_at
-	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20) 
-	RETURNING id`
-
-	var partyID string
-	now := time.Now()
-	err = tx.QueryRow(context.Background(), partyQuery,
-		p.HostID, p.Title, p.Description, p.PartyPhotos, p.StartTime, p.DurationHours, p.Status,
-		p.IsLocationRevealed, p.Address, p.City, p.GeoLat, p.GeoLon, p.MaxCapacity, 1, // current_guest_count = 1 (creator)
-		p.VibeTags, p.Rules, p.ChatRoomID, p.Thumbnail, now, now,
-	).Scan(&partyID)
+	tag, err := tx.Exec(context.Background(),
+		"UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
 
+	_, err = tx.Exec(context.Background(),
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE session_id = $1 AND revoked_at IS NULL",
+		sessionID)
 	if err != nil {
-		return "", fmt.Errorf("failed to insert party: %w", err)
+		return false, err
 	}
+	return true, tx.Commit(context.Background())
+}
 
-	// Insert chat room with creator as participant (for authorization filtering)
-	chatRoomQuery := `INSERT INTO chat_rooms (
-		id, party_id, host_id, title, is_group, participant_ids, is_active, created_at
-	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+// RevokeAllSessions revokes every active session of the user and returns their IDs.
+func RevokeAllSessions(userID string) ([]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
 
-	var chatRoomID string
-	err = tx.QueryRow(context.Background(), chatRoomQuery,
-		p.ChatRoomID, partyID, p.HostID, p.Title, true, []string{p.HostID}, true, now,
-	).Scan(&chatRoomID)
+	rows, err := tx.Query(context.Background(),
+		"UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL RETURNING id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
 
+	_, err = tx.Exec(context.Background(),
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create chat room: %w", err)
+		return nil, err
 	}
+	return ids, tx.Commit(context.Background())
+}
 
-	// Create crowdfunding/rotation pool if specified
-	if p.RotationPool != nil {
-		contribs, _ := json.Marshal(p.RotationPool.Contributors)
-		rotationQuery := `INSERT INTO crowdfunding (
-			party_id, target_amount, current_amount, currency, contributors, is_funded
-		) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+// SaveRefreshToken stores the hash of a newly issued refresh token.
+func SaveRefreshToken(userID, sessionID, tokenHash string, expiresAt time.Time) error {
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO refresh_tokens (user_id, session_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, sessionID, tokenHash, expiresAt)
+	return err
+}
 
-		var rotationID string
-		err = tx.QueryRow(context.Background(), rotationQuery,
-			partyID, p.RotationPool.TargetAmount, p.RotationPool.CurrentAmount,
-			p.RotationPool.Currency, contribs, p.RotationPool.IsFunded,
-		).Scan(&rotationID)
-		if err != nil {
-			return "", fmt.Errorf("failed to create rotation pool: %w", err)
-		}
+// GetRefreshToken looks up a refresh token by hash. A token counts as revoked
+// when either the token itself or its session has been revoked.
+func GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	var t RefreshToken
+	if db == nil {
+		return t, fmt.Errorf("database not initialized")
 	}
+	query := `SELECT rt.id, rt.user_id, COALESCE(rt.session_id::text, ''), rt.expires_at, rt.used_at,
+		COALESCE(rt.revoked_at, s.revoked_at)
+		FROM refresh_tokens rt
+		LEFT JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1`
+	err := db.QueryRow(context.Background(), query, tokenHash).Scan(
+		&t.ID, &t.UserID, &t.SessionID, &t.ExpiresAt, &t.UsedAt, &t.RevokedAt)
+	return t, err
+}
 
-	// Commit transaction
-	if err := tx.Commit(context.Background()); err != nil {
-		return "", fmt.Errorf("failed to commit transaction: %w", err)
+// RotateRefreshToken marks the old token as used and stores its replacement
+// in the same session. If the old token was used concurrently it returns
+// ErrRefreshTokenReused.
+func RotateRefreshToken(old RefreshToken, newHash string, expiresAt time.Time) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(context.Background())
 
-	log.Printf("CreateParty: Successfully created party %s with chat room %s and participant record", partyID, chatRoomID)
-	return partyID, nil
+	tag, err := tx.Exec(context.Background(),
+		"UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1 AND used_at IS NULL",
+		old.ID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO refresh_tokens (user_id, session_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		old.UserID, old.SessionID, newHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE sessions SET last_used_at = NOW() WHERE id = $1", old.SessionID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
 }
 
-func GetParty(id string) (Party, error) {
-	var p Party
-	query := `SELECT id, host_id, title, description, party_photos, start_time, duration_hours, status,
-		is_location_revealed, address, city, geo_lat, geo_lon, max_capacity, current_guest_count,
-		auto_lock_on_full, vibe_tags, rules, chat_room_id,
-		created_at, updated_at, thumbnail FROM parties WHERE id = $1`
+// CreateAuthToken stores a single-use token for a password reset or email
+// verification. Outstanding tokens of the same purpose are invalidated so only
+// the most recent email works.
+func CreateAuthToken(userID string, purpose AuthTokenPurpose, email, tokenHash string, expiresAt time.Time) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
 
-	err := db.QueryRow(context.Background(), query, id).Scan(
-		&p.ID, &p.HostID, &p.Title, &p.Description, &p.PartyPhotos, &p.StartTime, &p.DurationHours,
-		&p.Status, &p.IsLocationRevealed, &p.Address, &p.City, &p.GeoLat, &p.GeoLon,
-		&p.MaxCapacity, &p.CurrentGuestCount, &p.AutoLockOnFull, &p.VibeTags,
-		&p.Rules, &p.ChatRoomID, &p.CreatedAt, &p.UpdatedAt, &p.Thumbnail,
-	)
-	return p, err
+	_, err = tx.Exec(context.Background(),
+		"UPDATE auth_tokens SET used_at = NOW() WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+		userID, purpose)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO auth_tokens (user_id, purpose, email, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		userID, purpose, email, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
 }
 
-func UpdateParty(p Party) error {
-	query := `UPDATE parties SET 
-		title=$1, description=$2, status=$3, is_location_revealed=$4, address=$5,
-		city=$6, max_capacity=$7, thumbnail=$8, updated_at=NOW()
-		WHERE id=$9`
-	_, err := db.Exec(context.Background(), query, p.Title, p.Description, p.Status,
-		p.IsLocationRevealed, p.Address, p.City, p.MaxCapacity, p.Thumbnail, p.ID)
-	return err
+// ConsumeAuthToken atomically marks an unexpired, unused token as used and
+// returns the user and email it was issued for.
+func ConsumeAuthToken(tokenHash string, purpose AuthTokenPurpose) (string, string, error) {
+	if db == nil {
+		return "", "", fmt.Errorf("database not initialized")
+	}
+	var userID, email string
+	err := db.QueryRow(context.Background(),
+		`UPDATE auth_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, email`,
+		tokenHash, purpose).Scan(&userID, &email)
+	return userID, email, err
 }
 
-func UpdatePartyStatus(partyID string, status PartyStatus) error {
-	_, err := db.Exec(context.Background(), "UPDATE parties SET status = $1, updated_at = NOW() WHERE id = $2", status, partyID)
+// UpdatePasswordHash replaces the user's bcrypt hash.
+func UpdatePasswordHash(userID, passwordHash string) error {
+	_, err := db.Exec(context.Background(),
+		"UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2",
+		passwordHash, userID)
 	return err
 }
 
-func DeleteParty(id string) error {
-	_, err := db.Exec(context.Background(), "DELETE FROM parties WHERE id = $1", id)
-	return err
+// MarkEmailVerified flags the user's email as verified, provided it is still
+// the address the verification was sent to.
+func MarkEmailVerified(userID, email string) (bool, error) {
+	tag, err := db.Exec(context.Background(),
+		"UPDATE users SET email_verified = TRUE, updated_at = NOW() WHERE id = $1 AND email = $2",
+		userID, email)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
 }
 
-func GetApplicantsForParty(partyID string) ([]map[string]interface{}, error) {
-	// CRITICAL FIX: Select ALL User fields to prevent data truncation in UI
-	// Previously only selected 11 fields, now selecting all 33 fields
-	query := `SELECT 
-		pa.party_id, pa.user_id, pa.status, pa.applied_at,
-		-- Complete User object fields (all 33 fields)
-		u.id, u.real_name, u.phone_number, u.email, u.profile_photos, u.age, 
-		u.date_of_birth, u.height_cm, u.gender, u.drinking_pref, u.smoking_pref,
-		u.job_title, u.company, u.school, u.degree, u.instagram_handle, 
-		u.linkedin_handle, u.x_handle, u.tiktok_handle, u.is_verified, 
-		u.trust_score, u.elo_score, u.parties_hosted, u.flake_count, 
-		u.wallet_data, u.location_lat, u.location_lon, u.last_active_at,
-		u.created_at, u.bio, u.thumbnail
-		FROM party_applications pa
-		JOIN users u ON pa.user_id = u.id
-		WHERE pa.party_id = $1
-		ORDER BY u.elo_score DESC`
+// RecordLoginAttempt appends a failed login to the audit log.
+func RecordLoginAttempt(a LoginAttempt) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO login_attempts (email, user_id, ip_address, user_agent, reason) VALUES ($1, $2, $3, $4, $5)",
+		a.Email, nullString(a.UserID), a.IPAddress, a.UserAgent, a.Reason)
+	return err
+}
 
-	rows, err := db.Query(context.Background(), query, partyID)
+// GetLoginAttempts returns the most recent failed logins, optionally
+// filtered by email and/or IP address.
+func GetLoginAttempts(email, ipAddress string, limit int) ([]LoginAttempt, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	query := `SELECT id, email, COALESCE(user_id::text, ''), ip_address, COALESCE(user_agent, ''), reason, created_at
+		FROM login_attempts
+		WHERE ($1 = '' OR email = $1) AND ($2 = '' OR ip_address = $2)
+		ORDER BY created_at DESC LIMIT $3`
+	rows, err := db.Query(context.Background(), query, email, ipAddress, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var apps []map[string]interface{}
+	var attempts []LoginAttempt
 	for rows.Next() {
-		// Application fields
-		var partyID, userID, status string
-		var appliedAt time.Time
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.Email, &a.UserID, &a.IPAddress, &a.UserAgent, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
 
-		// Complete User fields (all 33 fields) - NOT NULL enforced by schema
-		var id, realName, phoneNumber, email string
-		var bio, thumbnail string
-		var profilePhotos []string
-		var age int
-		var dateOfBirth *time.Time
-		var heightCm int
-		var gender, drinkingPref, smokingPref string
-		var jobTitle, company, school, degree string
-		var instagramHandle, linkedinHandle, xHandle, tiktokHandle string
-		var isVerified bool
-		var trustScore, eloScore float64
-		var partiesHosted, flakeCount int
-		var walletDataJSON []byte
-		var locationLat, locationLon float64
-		var lastActiveAt, createdAt *time.Time
+// ==========================================
+// EXTERNAL IDENTITIES
+// ==========================================
 
-		// Scan all 33 User fields - no COALESCE needed due to schema constraints
-		err := rows.Scan(
+// GetUserIDByIdentity finds the user linked to a provider subject and
+// records the sign-in.
+func GetUserIDByIdentity(provider, subject string) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database not initialized")
+	}
+	var userID string
+	err := db.QueryRow(context.Background(),
+		"UPDATE user_identities SET last_login_at = NOW() WHERE provider = $1 AND subject = $2 RETURNING user_id",
+		provider, subject).Scan(&userID)
+	return userID, err
+}
+
+// LinkIdentity attaches a provider identity to an existing user and marks
+// the email verified. With secure set, the account's password is cleared,
+// for accounts whose email had never been proven.
+func LinkIdentity(userID, provider, subject, email string, secure bool) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		userID, provider, subject, email)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE users SET email_verified = TRUE, updated_at = NOW() WHERE id = $1"
+	if secure {
+		query = "UPDATE users SET email_verified = TRUE, password_hash = NULL, updated_at = NOW() WHERE id = $1"
+	}
+	if _, err := tx.Exec(context.Background(), query, userID); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// CreateUserWithIdentity creates a password-less account for a provider identity.
+func CreateUserWithIdentity(u User, provider, subject string) (string, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var id string
+	err = tx.QueryRow(context.Background(),
+		`INSERT INTO users (real_name, email, email_verified, role, age, height_cm, location_lat, location_lon)
+		VALUES ($1, $2, $3, $4, 0, 0, 0, 0) RETURNING id`,
+		u.RealName, nullString(u.Email), u.EmailVerified, u.Role).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		id, provider, subject, u.Email)
+	if err != nil {
+		return "", err
+	}
+	return id, tx.Commit(context.Background())
+}
+
+// ==========================================
+// PHONE VERIFICATION
+// ==========================================
+
+// GetPhoneChallengeStats returns how many OTPs the user requested since the
+// given time and when the most recent one was sent.
+func GetPhoneChallengeStats(userID string, since time.Time) (int, *time.Time, error) {
+	if db == nil {
+		return 0, nil, fmt.Errorf("database not initialized")
+	}
+	var count int
+	var last *time.Time
+	err := db.QueryRow(context.Background(),
+		"SELECT COUNT(*) FILTER (WHERE created_at > $2), MAX(created_at) FROM phone_verifications WHERE user_id = $1",
+		userID, since).Scan(&count, &last)
+	return count, last, err
+}
+
+// CreatePhoneChallenge stores a new OTP challenge and retires any pending one.
+func CreatePhoneChallenge(userID, phoneNumber, codeHash string, expiresAt time.Time) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE phone_verifications SET consumed_at = NOW() WHERE user_id = $1 AND consumed_at IS NULL",
+		userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO phone_verifications (user_id, phone_number, code_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, phoneNumber, codeHash, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// GetActivePhoneChallenge returns the user's latest unexpired, unconsumed challenge.
+func GetActivePhoneChallenge(userID string) (PhoneChallenge, error) {
+	var c PhoneChallenge
+	if db == nil {
+		return c, fmt.Errorf("database not initialized")
+	}
+	query := `SELECT id, user_id, phone_number, code_hash, attempts, expires_at
+		FROM phone_verifications
+		WHERE user_id = $1 AND consumed_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC LIMIT 1`
+	err := db.QueryRow(context.Background(), query, userID).Scan(
+		&c.ID, &c.UserID, &c.PhoneNumber, &c.CodeHash, &c.Attempts, &c.ExpiresAt)
+	return c, err
+}
+
+// ClaimPhoneChallengeAttempt atomically counts a verification attempt. It
+// returns pgx.ErrNoRows once maxAttempts have been used, so parallel guesses
+// cannot exceed the limit.
+func ClaimPhoneChallengeAttempt(challengeID string, maxAttempts int) (int, error) {
+	var attempts int
+	err := db.QueryRow(context.Background(),
+		`UPDATE phone_verifications SET attempts = attempts + 1
+		WHERE id = $1 AND attempts < $2 AND consumed_at IS NULL
+		RETURNING attempts`,
+		challengeID, maxAttempts).Scan(&attempts)
+	return attempts, err
+}
+
+// CompletePhoneVerification consumes the challenge and marks the user's
+// phone number as verified.
+func CompletePhoneVerification(c PhoneChallenge) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	tag, err := tx.Exec(context.Background(),
+		"UPDATE phone_verifications SET consumed_at = NOW() WHERE id = $1 AND consumed_at IS NULL",
+		c.ID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("challenge already used")
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE users SET phone_number = $1, is_verified = TRUE, updated_at = NOW() WHERE id = $2",
+		c.PhoneNumber, c.UserID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// ==========================================
+// PARTY CRUD
+// ==========================================
+
+func CreateParty(p Party) (string, error) {
+	// Use atomic transaction to ensure party and chat room are created together
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Insert party
+	partyQuery := `INSERT INTO parties (
+		host_id, title, description, party_photos, start_time, duration_hours, status,
+		is_location_revealed, address, city, geo_lat, geo_lon, max_capacity, current_guest_count,
+		vibe_tags, rules, chat_room_id, thumbnail, created_at, updated_at
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20) 
+	RETURNING id`
+
+	var partyID string
+	now := time.Now()
+	err = tx.QueryRow(context.Background(), partyQuery,
+		p.HostID, p.Title, p.Description, p.PartyPhotos, p.StartTime, p.DurationHours, p.Status,
+		p.IsLocationRevealed, p.Address, p.City, p.GeoLat, p.GeoLon, p.MaxCapacity, 1, // current_guest_count = 1 (creator)
+		p.VibeTags, p.Rules, p.ChatRoomID, p.Thumbnail, now, now,
+	).Scan(&partyID)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to insert party: %w", err)
+	}
+
+	// Insert chat room with creator as participant (for authorization filtering)
+	chatRoomQuery := `INSERT INTO chat_rooms (
+		id, party_id, host_id, title, is_group, participant_ids, is_active, created_at
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+
+	var chatRoomID string
+	err = tx.QueryRow(context.Background(), chatRoomQuery,
+		p.ChatRoomID, partyID, p.HostID, p.Title, true, []string{p.HostID}, true, now,
+	).Scan(&chatRoomID)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create chat room: %w", err)
+	}
+
+	// Create crowdfunding/rotation pool if specified
+	if p.RotationPool != nil {
+		contribs, _ := json.Marshal(p.RotationPool.Contributors)
+		rotationQuery := `INSERT INTO crowdfunding (
+			party_id, target_amount, current_amount, currency, contributors, is_funded
+		) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+		var rotationID string
+		err = tx.QueryRow(context.Background(), rotationQuery,
+			partyID, p.RotationPool.TargetAmount, p.RotationPool.CurrentAmount,
+			p.RotationPool.Currency, contribs, p.RotationPool.IsFunded,
+		).Scan(&rotationID)
+		if err != nil {
+			return "", fmt.Errorf("failed to create rotation pool: %w", err)
+		}
+	}
+
+	// Commit transaction
+	if err := tx.Commit(context.Background()); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	log.Printf("CreateParty: Successfully created party %s with chat room %s and participant record", partyID, chatRoomID)
+	return partyID, nil
+}
+
+func GetParty(id string) (Party, error) {
+	var p Party
+	query := `SELECT id, host_id, title, description, party_photos, start_time, duration_hours, status,
+		is_location_revealed, address, city, geo_lat, geo_lon, max_capacity, current_guest_count,
+		auto_lock_on_full, vibe_tags, rules, chat_room_id,
+		created_at, updated_at, thumbnail FROM parties WHERE id = $1`
+
+	err := db.QueryRow(context.Background(), query, id).Scan(
+		&p.ID, &p.HostID, &p.Title, &p.Description, &p.PartyPhotos, &p.StartTime, &p.DurationHours,
+		&p.Status, &p.IsLocationRevealed, &p.Address, &p.City, &p.GeoLat, &p.GeoLon,
+		&p.MaxCapacity, &p.CurrentGuestCount, &p.AutoLockOnFull, &p.VibeTags,
+		&p.Rules, &p.ChatRoomID, &p.CreatedAt, &p.UpdatedAt, &p.Thumbnail,
+	)
+	return p, err
+}
+
+func UpdateParty(p Party) error {
+	query := `UPDATE parties SET 
+		title=$1, description=$2, status=$3, is_location_revealed=$4, address=$5,
+		city=$6, max_capacity=$7, thumbnail=$8, updated_at=NOW()
+		WHERE id=$9`
+	_, err := db.Exec(context.Background(), query, p.Title, p.Description, p.Status,
+		p.IsLocationRevealed, p.Address, p.City, p.MaxCapacity, p.Thumbnail, p.ID)
+	return err
+}
+
+func UpdatePartyStatus(partyID string, status PartyStatus) error {
+	_, err := db.Exec(context.Background(), "UPDATE parties SET status = $1, updated_at = NOW() WHERE id = $2", status, partyID)
+	return err
+}
+
+func DeleteParty(id string) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM parties WHERE id = $1", id)
+	return err
+}
+
+func GetApplicantsForParty(partyID string) ([]map[string]interface{}, error) {
+	// CRITICAL FIX: Select ALL User fields to prevent data truncation in UI
+	// Previously only selected 11 fields, now selecting all 33 fields
+	query := `SELECT 
+		pa.party_id, pa.user_id, pa.status, pa.applied_at,
+		-- Complete User object fields (all 33 fields)
+		u.id, u.real_name, u.phone_number, u.email, u.profile_photos, u.age, 
+		u.date_of_birth, u.height_cm, u.gender, u.drinking_pref, u.smoking_pref,
+		u.job_title, u.company, u.school, u.degree, u.instagram_handle, 
+		u.linkedin_handle, u.x_handle, u.tiktok_handle, u.is_verified, 
+		u.trust_score, u.elo_score, u.parties_hosted, u.flake_count, 
+		u.wallet_data, u.location_lat, u.location_lon, u.last_active_at,
+		u.created_at, u.bio, u.thumbnail
+		FROM party_applications pa
+		JOIN users u ON pa.user_id = u.id
+		WHERE pa.party_id = $1
+		ORDER BY u.elo_score DESC`
+
+	rows, err := db.Query(context.Background(), query, partyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []map[string]interface{}
+	for rows.Next() {
+		// Application fields
+		var partyID, userID, status string
+		var appliedAt time.Time
+
+		// Complete User fields (all 33 fields) - NOT NULL enforced by schema
+		var id, realName, phoneNumber, email string
+		var bio, thumbnail string
+		var profilePhotos []string
+		var age int
+		var dateOfBirth *time.Time
+		var heightCm int
+		var gender, drinkingPref, smokingPref string
+		var jobTitle, company, school, degree string
+		var instagramHandle, linkedinHandle, xHandle, tiktokHandle string
+		var isVerified bool
+		var trustScore, eloScore float64
+		var partiesHosted, flakeCount int
+		var walletDataJSON []byte
+		var locationLat, locationLon float64
+		var lastActiveAt, createdAt *time.Time
+
+		// Scan all 33 User fields - no COALESCE needed due to schema constraints
+		err := rows.Scan(
 			// Application fields (4)
 			&partyID, &userID, &status, &appliedAt,
 			// User fields (29) - all text columns have NOT NULL DEFAULT ''
@@ -676,9 +1206,14 @@ func UpdateApplicationStatus(partyID, userID, status string) error {
 		_, err = tx.Exec(context.Background(),
 			"UPDATE chat_rooms SET participant_ids = array_append(participant_ids, $1) WHERE party_id = $2 AND NOT ($1 = ANY(participant_ids))",
 			userID, partyID)
-		if err != nil {
-			return err
-		}
+	} else {
+		// Anyone no longer accepted loses access to the party chat
+		_, err = tx.Exec(context.Background(),
+			"UPDATE chat_rooms SET participant_ids = array_remove(participant_ids, $1) WHERE party_id = $2 AND host_id != $1",
+			userID, partyID)
+	}
+	if err != nil {
+		return err
 	}
 
 	return tx.Commit(context.Background())
@@ -698,12 +1233,14 @@ func GetChatRoom(id string) (ChatRoom, error) {
 	var partyID, title, imageURL *string
 	var partyStartTime *time.Time
 	query := `
-		SELECT cr.id, cr.party_id, cr.host_id, COALESCE(cr.title, p.title, '') as title, cr.image_url, cr.is_group, cr.participant_ids, cr.is_active, cr.created_at, p.start_time
+		SELECT cr.id, cr.party_id, cr.host_id, COALESCE(cr.title, p.title, '') as title, cr.image_url, cr.is_group, cr.participant_ids, cr.is_active, cr.created_at, p.start_time,
+		       COALESCE(cr.dm_key, ''), COALESCE(cr.dm_status, ''), COALESCE(cr.dm_requested_by::TEXT, '')
 		FROM chat_rooms cr
 		LEFT JOIN parties p ON cr.party_id = p.id
 		WHERE cr.id = $1`
 	err := db.QueryRow(context.Background(), query, id).Scan(
 		&cr.ID, &partyID, &cr.HostID, &title, &imageURL, &cr.IsGroup, &cr.ParticipantIDs, &cr.IsActive, &cr.CreatedAt, &partyStartTime,
+		&cr.DMKey, &cr.DMStatus, &cr.DMRequestedBy,
 	)
 	if err == nil {
 		if partyID != nil {
@@ -755,7 +1292,8 @@ func GetChatRoomsForUser(userID string) ([]map[string]interface{}, error) {
 		       p.thumbnail as party_thumbnail,
 		       (SELECT u.thumbnail FROM users u WHERE u.id = ANY(cr.participant_ids) AND u.id != $1 LIMIT 1) as dm_thumbnail,
 		       p.title as p_title,
-		       p.start_time as party_start_time
+		       p.start_time as party_start_time,
+		       ` + unreadCountSQL("cr.id") + ` as unread_count
 		FROM chat_rooms cr
 		LEFT JOIN parties p ON cr.party_id = p.id
 		WHERE $1::UUID = ANY(cr.participant_ids)
@@ -784,9 +1322,10 @@ func GetChatRoomsForUser(userID string) ([]map[string]interface{}, error) {
 		var partyThumbnail, dmThumbnail *string
 		var pTitle *string
 		var partySTime *time.Time
+		var unread int64
 
 		err := rows.Scan(&id, &partyID, &hostID, &title, &imageURL, &isGroup, &participantIDs, &isActive, &createdAt,
-			&lastMsgContent, &lastMsgAt, &partyThumbnail, &dmThumbnail, &pTitle, &partySTime)
+			&lastMsgContent, &lastMsgAt, &partyThumbnail, &dmThumbnail, &pTitle, &partySTime, &unread)
 		if err != nil {
 			return nil, err
 		}
@@ -802,7 +1341,7 @@ func GetChatRoomsForUser(userID string) ([]map[string]interface{}, error) {
 			"IsActive":       isActive,
 			"CreatedAt":      createdAt,
 			"RecentMessages": []interface{}{}, // Initial list empty
-			"UnreadCount":    0,               // Placeholder
+			"UnreadCount":    unread,
 		}
 
 		if partyID != nil {
@@ -848,37 +1387,184 @@ func GetChatRoomsForUser(userID string) ([]map[string]interface{}, error) {
 	return rooms, nil
 }
 
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// chatMembership matches chat_rooms cr (left-joined to parties p) that user
+// $1 belongs to: listed in the room, for party chats still the host or an
+// accepted guest, and for DMs not blocked by either side and, until a message
+// request is accepted, only its sender.
+const chatMembership = `
+	($1::UUID = cr.host_id OR $1::UUID = ANY(cr.participant_ids))
+	AND (
+		cr.party_id IS NULL
+		OR p.host_id = $1::UUID
+		OR EXISTS (SELECT 1 FROM party_applications WHERE party_id = cr.party_id AND user_id = $1::UUID AND status = 'ACCEPTED')
+	)
+	AND NOT (cr.dm_key IS NOT NULL AND EXISTS (
+		SELECT 1 FROM blocked_users bu
+		WHERE bu.blocker_id = ANY(cr.participant_ids) AND bu.blocked_id = ANY(cr.participant_ids)
+	))
+	AND (cr.dm_key IS NULL OR cr.dm_status = 'ACCEPTED' OR cr.dm_requested_by = $1::UUID)`
+
+// CanAccessChat reports whether userID may join, read and post in chatID,
+// which is either a chat_rooms ID or a generateDMChatId pair key. A DM pair
+// is closed once either side blocks the other, and a message request is
+// closed to its recipient until accepted.
+func CanAccessChat(userID, chatID string) (bool, error) {
+	a, b, isDM := parseDMChatId(chatID)
+	if isDM && userID != a && userID != b {
+		return false, nil
+	}
+	if !isDM && (!uuidPattern.MatchString(chatID) || !uuidPattern.MatchString(userID)) {
+		return false, nil
+	}
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+
+	if isDM {
+		var open bool
+		err := db.QueryRow(context.Background(),
+			`SELECT NOT EXISTS(SELECT 1 FROM blocked_users
+			 WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))
+			 AND NOT EXISTS(SELECT 1 FROM chat_rooms
+			 WHERE dm_key = $3 AND dm_status <> 'ACCEPTED' AND dm_requested_by IS DISTINCT FROM $4::UUID)`,
+			a, b, chatID, userID).Scan(&open)
+		return open, err
+	}
+
+	var member bool
+	query := `SELECT EXISTS(
+		SELECT 1 FROM chat_rooms cr
+		LEFT JOIN parties p ON cr.party_id = p.id
+		WHERE cr.id = $2 AND` + chatMembership + `)`
+	err := db.QueryRow(context.Background(), query, userID, chatID).Scan(&member)
+	return member, err
+}
+
+// TouchLastActive stamps userID's last_active_at with the current time.
+func TouchLastActive(userID string) error {
+	if !uuidPattern.MatchString(userID) {
+		return nil
+	}
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec(context.Background(), "UPDATE users SET last_active_at = NOW() WHERE id = $1", userID)
+	return err
+}
+
+// GetChatRoomIDsForUser returns the IDs of every chat room userID belongs to.
+func GetChatRoomIDsForUser(userID string) ([]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	if !uuidPattern.MatchString(userID) {
+		return nil, nil
+	}
+	query := `SELECT cr.id FROM chat_rooms cr
+		LEFT JOIN parties p ON cr.party_id = p.id
+		WHERE` + chatMembership
+
+	rows, err := db.Query(context.Background(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // ==========================================
 // CHANNEL / CHAT METHODS
 // ==========================================
 
-func SaveMessage(m ChatMessage) (string, error) {
+// SaveMessage stores m with the next sequence number of its chat and returns
+// it with the server-assigned ID, Seq and CreatedAt. If the sender already
+// stored a message with the same ClientMessageID, that message is returned
+// instead and created is false.
+func SaveMessage(m ChatMessage) (stored ChatMessage, created bool, err error) {
 	meta, _ := json.Marshal(m.Metadata)
-	query := `INSERT INTO chat_messages (chat_id, sender_id, type, content, media_url, 
-		thumbnail_url, metadata, reply_to_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
-
-	var id string
-	var replyID interface{} = nil
+	var replyID, clientID interface{}
 	if m.ReplyToID != "" {
 		replyID = m.ReplyToID
 	}
+	if m.ClientMessageID != "" {
+		clientID = m.ClientMessageID
+	}
 
-	err := db.QueryRow(context.Background(), query, m.ChatID, m.SenderID, m.Type, m.Content,
-		m.MediaURL, m.ThumbnailURL, meta, replyID).Scan(&id)
-	return id, err
-}
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return m, false, err
+	}
+	defer tx.Rollback(ctx)
 
-func GetChatHistory(chatID string, limit int) ([]ChatMessage, error) {
-	query := `SELECT m.id, m.sender_id, m.type, m.content, m.media_url, m.thumbnail_url, m.metadata, m.reply_to_id, m.created_at,
-		u.real_name as sender_name, COALESCE(u.thumbnail, '') as sender_thumbnail
-		FROM chat_messages m
-		JOIN users u ON m.sender_id = u.id
-		WHERE m.chat_id = $1 ORDER BY m.created_at DESC LIMIT $2`
+	// Locking the chat's counter row orders concurrent senders, and makes the
+	// duplicate check below safe against a retry racing the original
+	_, err = tx.Exec(ctx, `INSERT INTO chat_sequences (chat_id, last_seq) VALUES ($1, 0) ON CONFLICT (chat_id) DO NOTHING`, m.ChatID)
+	if err != nil {
+		return m, false, err
+	}
+	var lastSeq int64
+	err = tx.QueryRow(ctx, `SELECT last_seq FROM chat_sequences WHERE chat_id = $1 FOR UPDATE`, m.ChatID).Scan(&lastSeq)
+	if err != nil {
+		return m, false, err
+	}
 
-	rows, err := db.Query(context.Background(), query, chatID, limit)
+	if m.ClientMessageID != "" {
+		rows, err := tx.Query(ctx, `SELECT `+chatMessageColumns+`
+			FROM chat_messages m
+			JOIN users u ON m.sender_id = u.id
+			WHERE m.chat_id = $1 AND m.sender_id = $2 AND m.client_message_id = $3`, m.ChatID, m.SenderID, m.ClientMessageID)
+		if err != nil {
+			return m, false, err
+		}
+		existing, err := scanChatMessages(rows, m.ChatID)
+		if err != nil {
+			return m, false, err
+		}
+		if len(existing) > 0 {
+			return existing[0], false, nil
+		}
+	}
+
+	m.Seq = lastSeq + 1
+	if _, err := tx.Exec(ctx, `UPDATE chat_sequences SET last_seq = $2 WHERE chat_id = $1`, m.ChatID, m.Seq); err != nil {
+		return m, false, err
+	}
+
+	query := `INSERT INTO chat_messages (chat_id, sender_id, type, content, media_url, 
+		thumbnail_url, metadata, reply_to_id, seq, client_message_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at`
+	err = tx.QueryRow(ctx, query, m.ChatID, m.SenderID, m.Type, m.Content,
+		m.MediaURL, m.ThumbnailURL, meta, replyID, m.Seq, clientID).Scan(&m.ID, &m.CreatedAt)
 	if err != nil {
-		return nil, err
+		return m, false, err
 	}
+	return m, true, tx.Commit(ctx)
+}
+
+const chatMessageColumns = `m.id, m.seq, COALESCE(m.client_message_id, ''), m.sender_id, m.type, m.content, m.media_url, m.thumbnail_url, m.metadata, m.reply_to_id, m.created_at,
+		m.edited_at, m.deleted_at IS NOT NULL, ` + reactionsAggregate + `,
+		u.real_name as sender_name, COALESCE(u.thumbnail, '') as sender_thumbnail`
+
+// reactionsAggregate renders the reactions of message m as a JSON array of
+// Reaction, in the order each emoji was first used.
+const reactionsAggregate = `COALESCE((
+		SELECT json_agg(json_build_object('Emoji', r.emoji, 'Count', r.n, 'UserIDs', r.user_ids) ORDER BY r.first_at)
+		FROM (SELECT emoji, COUNT(*) AS n, array_agg(user_id ORDER BY created_at) AS user_ids, MIN(created_at) AS first_at
+		      FROM message_reactions WHERE message_id = m.id GROUP BY emoji) r
+	), '[]')`
+
+func scanChatMessages(rows pgx.Rows, chatID string) ([]ChatMessage, error) {
 	defer rows.Close()
 
 	var msgs []ChatMessage
@@ -886,41 +1572,477 @@ func GetChatHistory(chatID string, limit int) ([]ChatMessage, error) {
 		var m ChatMessage
 		var meta []byte
 		var replyID *string // Handle potential nulls
-		err := rows.Scan(&m.ID, &m.SenderID, &m.Type, &m.Content, &m.MediaURL, &m.ThumbnailURL, &meta, &replyID, &m.CreatedAt, &m.SenderName, &m.SenderThumbnail)
+		var reactions []byte
+		err := rows.Scan(&m.ID, &m.Seq, &m.ClientMessageID, &m.SenderID, &m.Type, &m.Content, &m.MediaURL, &m.ThumbnailURL, &meta, &replyID, &m.CreatedAt,
+			&m.EditedAt, &m.Deleted, &reactions, &m.SenderName, &m.SenderThumbnail)
 		if err != nil {
 			return nil, err
 		}
 		m.ChatID = chatID
 		json.Unmarshal(meta, &m.Metadata)
+		json.Unmarshal(reactions, &m.Reactions)
 		if replyID != nil {
 			m.ReplyToID = *replyID
 		}
 		msgs = append(msgs, m)
 	}
-	return msgs, nil
+	return msgs, rows.Err()
+}
+
+// MessageCursor is a message's position in its chat. Messages are ordered by
+// (CreatedAt, ID), which is total even when timestamps collide.
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// GetMessageCursor returns the position of messageID, which must belong to
+// chatID.
+func GetMessageCursor(chatID, messageID string) (MessageCursor, error) {
+	cur := MessageCursor{ID: messageID}
+	if !uuidPattern.MatchString(messageID) {
+		return cur, ErrMessageNotFound
+	}
+	err := db.QueryRow(context.Background(),
+		`SELECT created_at FROM chat_messages WHERE id = $1 AND chat_id = $2`,
+		messageID, chatID).Scan(&cur.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return cur, ErrMessageNotFound
+	}
+	return cur, err
+}
+
+// GetMessagePage returns up to limit messages of chatID, oldest first, on one
+// side of from: older ones when older is set, newer ones otherwise. With from
+// nil it starts at the newest (older) or oldest (newer) message. inclusive
+// also returns the message at from. hasMore reports whether further messages
+// lie beyond the page in the same direction.
+func GetMessagePage(chatID string, from *MessageCursor, older, inclusive bool, limit int) (msgs []ChatMessage, hasMore bool, err error) {
+	op, order := ">", "ASC"
+	if older {
+		op, order = "<", "DESC"
+	}
+	if inclusive {
+		op += "="
+	}
+	where := "m.chat_id = $1"
+	args := []interface{}{chatID, limit + 1}
+	if from != nil {
+		where += " AND (m.created_at, m.id) " + op + " ($3, $4)"
+		args = append(args, from.CreatedAt, from.ID)
+	}
+	// Fetch one extra row to learn whether there is another page
+	query := `SELECT ` + chatMessageColumns + `
+		FROM chat_messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE ` + where + `
+		ORDER BY m.created_at ` + order + `, m.id ` + order + ` LIMIT $2`
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	msgs, err = scanChatMessages(rows, chatID)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore = len(msgs) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+	if older {
+		slices.Reverse(msgs)
+	}
+	if msgs == nil {
+		msgs = []ChatMessage{}
+	}
+	return msgs, hasMore, nil
+}
+
+// GetMessagesAfter returns up to limit messages of chatID with a sequence
+// number above afterSeq, oldest first.
+func GetMessagesAfter(chatID string, afterSeq int64, limit int) ([]ChatMessage, error) {
+	query := `SELECT ` + chatMessageColumns + `
+		FROM chat_messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.chat_id = $1 AND m.seq > $2 ORDER BY m.seq ASC LIMIT $3`
+
+	rows, err := db.Query(context.Background(), query, chatID, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanChatMessages(rows, chatID)
+}
+
+// MarkDelivered records that deviceID of userID has received chatID up to
+// seq. The cursor never moves backwards.
+func MarkDelivered(userID, deviceID, chatID string, seq int64) error {
+	query := `INSERT INTO message_deliveries (user_id, device_id, chat_id, delivered_seq)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, device_id, chat_id) DO UPDATE
+		SET delivered_seq = GREATEST(message_deliveries.delivered_seq, EXCLUDED.delivered_seq), updated_at = NOW()`
+	_, err := db.Exec(context.Background(), query, userID, deviceID, chatID, seq)
+	return err
+}
+
+// GetDeliveryCursors returns the last delivered Seq per chat for one device.
+func GetDeliveryCursors(userID, deviceID string) (map[string]int64, error) {
+	rows, err := db.Query(context.Background(),
+		`SELECT chat_id, delivered_seq FROM message_deliveries WHERE user_id = $1 AND device_id = $2`,
+		userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cursors := make(map[string]int64)
+	for rows.Next() {
+		var chatID string
+		var seq int64
+		if err := rows.Scan(&chatID, &seq); err != nil {
+			return nil, err
+		}
+		cursors[chatID] = seq
+	}
+	return cursors, rows.Err()
+}
+
+// unreadCountSQL counts messages in chat (a column of the outer query) that
+// user $1 has not read, ignoring their own.
+func unreadCountSQL(chat string) string {
+	return `(SELECT COUNT(*) FROM chat_messages m
+		WHERE m.chat_id = ` + chat + ` AND m.sender_id != $1
+		  AND m.seq > COALESCE((SELECT rs.last_read_seq FROM chat_read_state rs
+		                        WHERE rs.chat_id = ` + chat + `::TEXT AND rs.user_id = $1), 0))`
+}
+
+// MarkChatRead moves userID's read marker in chatID up to seq, or to the
+// newest message when seq is 0. The marker never moves backwards or past the
+// last message. It returns the marker and whether it advanced.
+func MarkChatRead(userID, chatID string, seq int64) (int64, bool, error) {
+	query := `WITH target AS (
+			SELECT CASE WHEN $3 > 0 THEN LEAST($3, last_seq) ELSE last_seq END AS seq
+			FROM chat_sequences WHERE chat_id = $2
+		)
+		INSERT INTO chat_read_state (user_id, chat_id, last_read_seq)
+		SELECT $1, $2, seq FROM target WHERE seq > 0
+		ON CONFLICT (user_id, chat_id) DO UPDATE
+		SET last_read_seq = EXCLUDED.last_read_seq, read_at = NOW()
+		WHERE chat_read_state.last_read_seq < EXCLUDED.last_read_seq
+		RETURNING last_read_seq`
+	var marker int64
+	err := db.QueryRow(context.Background(), query, userID, chatID, seq).Scan(&marker)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return marker, true, nil
+}
+
+// MessageSearchHit is a message matching a SEARCH_MESSAGES query.
+type MessageSearchHit struct {
+	MessageID  string    `json:"MessageID"`
+	ChatID     string    `json:"ChatID"`
+	Seq        int64     `json:"Seq"`
+	SenderID   string    `json:"SenderID"`
+	SenderName string    `json:"SenderName"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	Snippet    string    `json:"Snippet"` // HTML-escaped, matches wrapped in <mark>
+}
+
+// searchHeadline highlights matches of q in an HTML-escaped copy of the
+// content, so the snippet is safe to render as HTML.
+const searchHeadline = `ts_headline('simple',
+	replace(replace(replace(m.content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), q,
+	'StartSel=<mark>, StopSel=</mark>, MaxWords=24, MinWords=8, MaxFragments=2')`
+
+// SearchMessages finds messages matching query in the chats userID belongs
+// to, or only in chatID when given, newest first. before continues after a
+// previous hit. hasMore reports whether another page follows.
+func SearchMessages(userID, query, chatID, before string, limit int) (hits []MessageSearchHit, hasMore bool, err error) {
+	if !uuidPattern.MatchString(userID) {
+		return []MessageSearchHit{}, false, nil
+	}
+	if db == nil {
+		return nil, false, fmt.Errorf("database not initialized")
+	}
+	args := []interface{}{userID, query, limit + 1}
+	filter := ""
+	if chatID != "" {
+		args = append(args, chatID)
+		filter += fmt.Sprintf(" AND m.chat_id = $%d", len(args))
+	}
+	if before != "" {
+		args = append(args, before)
+		filter += fmt.Sprintf(" AND (m.created_at, m.id) < (SELECT created_at, id FROM chat_messages WHERE id = $%d)", len(args))
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT m.id, m.chat_id::TEXT, COALESCE(m.seq, 0), m.sender_id, COALESCE(u.real_name, ''), m.created_at,
+		       `+searchHeadline+`
+		FROM chat_messages m
+		JOIN users u ON u.id = m.sender_id
+		CROSS JOIN websearch_to_tsquery('simple', $2) q
+		WHERE m.content_tsv @@ q AND m.deleted_at IS NULL
+		  AND m.chat_id IN (
+			  SELECT cr.id FROM chat_rooms cr
+			  LEFT JOIN parties p ON cr.party_id = p.id
+			  WHERE`+chatMembership+`
+		  )`+filter+`
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT $3`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	hits = []MessageSearchHit{}
+	for rows.Next() {
+		var h MessageSearchHit
+		if err := rows.Scan(&h.MessageID, &h.ChatID, &h.Seq, &h.SenderID, &h.SenderName, &h.CreatedAt, &h.Snippet); err != nil {
+			return nil, false, err
+		}
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(hits) > limit {
+		hits, hasMore = hits[:limit], true
+	}
+	return hits, hasMore, nil
+}
+
+// ReadMarker is one participant's read position in a chat.
+type ReadMarker struct {
+	UserID string    `json:"UserID"`
+	Seq    int64     `json:"Seq"`
+	ReadAt time.Time `json:"ReadAt"`
+}
+
+// GetReadMarkers lists every participant's read position in chatID.
+func GetReadMarkers(chatID string) ([]ReadMarker, error) {
+	rows, err := db.Query(context.Background(),
+		`SELECT user_id, last_read_seq, read_at FROM chat_read_state WHERE chat_id = $1 ORDER BY last_read_seq DESC`,
+		chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	markers := []ReadMarker{}
+	for rows.Next() {
+		var m ReadMarker
+		if err := rows.Scan(&m.UserID, &m.Seq, &m.ReadAt); err != nil {
+			return nil, err
+		}
+		markers = append(markers, m)
+	}
+	return markers, rows.Err()
+}
+
+// GetOrCreateDMRoom returns the DM room of from and to, creating it with
+// status on first use. created reports whether this call made it; otherwise
+// the room is returned as stored.
+func GetOrCreateDMRoom(from, to string, status DMStatus) (room ChatRoom, created bool, err error) {
+	key := generateDMChatId(from, to)
+	first, second, _ := parseDMChatId(key)
+
+	// Both users may send their first message at once; the unique dm_key
+	// index lets exactly one insert win
+	err = db.QueryRow(context.Background(), `INSERT INTO chat_rooms (host_id, is_group, participant_ids, dm_key, dm_status, dm_requested_by)
+		VALUES ($1, FALSE, $2, $3, $4, $5)
+		ON CONFLICT (dm_key) WHERE dm_key IS NOT NULL DO NOTHING
+		RETURNING id, created_at`,
+		first, []string{first, second}, key, status, from).Scan(&room.ID, &room.CreatedAt)
+	if err == nil {
+		room.HostID = first
+		room.ParticipantIDs = []string{first, second}
+		room.IsActive = true
+		room.DMKey = key
+		room.DMStatus = status
+		room.DMRequestedBy = from
+		return room, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return room, false, err
+	}
+	room, _, err = GetDMRoom(key)
+	return room, false, err
+}
+
+// GetDMRoom looks up a DM room by its generateDMChatId key. found is false if
+// the two users never messaged each other.
+func GetDMRoom(dmKey string) (room ChatRoom, found bool, err error) {
+	if db == nil {
+		return room, false, fmt.Errorf("database not initialized")
+	}
+	err = db.QueryRow(context.Background(), `
+		SELECT id, host_id, participant_ids, is_active, created_at, dm_key,
+		       COALESCE(dm_status, 'ACCEPTED'), COALESCE(dm_requested_by::TEXT, '')
+		FROM chat_rooms WHERE dm_key = $1`, dmKey).Scan(
+		&room.ID, &room.HostID, &room.ParticipantIDs, &room.IsActive, &room.CreatedAt, &room.DMKey,
+		&room.DMStatus, &room.DMRequestedBy,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return room, false, nil
+	}
+	return room, err == nil, err
+}
+
+// GetDMRoomID resolves a generateDMChatId key to its room ID, or "" if the
+// two users never messaged each other.
+func GetDMRoomID(dmKey string) (string, error) {
+	room, _, err := GetDMRoom(dmKey)
+	return room.ID, err
+}
+
+// SetDMStatus moves a DM room to status.
+func SetDMStatus(roomID string, status DMStatus) error {
+	_, err := db.Exec(context.Background(), `UPDATE chat_rooms SET dm_status = $2 WHERE id = $1 AND dm_key IS NOT NULL`, roomID, status)
+	return err
+}
+
+// ErrDMRequestNotFound is returned when there is no pending message request
+// addressed to the user.
+var ErrDMRequestNotFound = errors.New("message request not found")
+
+// RespondToDMRequest accepts or declines the pending request in roomID that
+// was sent to userID, and returns who sent it.
+func RespondToDMRequest(roomID, userID string, status DMStatus) (string, error) {
+	if !uuidPattern.MatchString(roomID) || !uuidPattern.MatchString(userID) {
+		return "", ErrDMRequestNotFound
+	}
+	var requester string
+	err := db.QueryRow(context.Background(), `UPDATE chat_rooms SET dm_status = $3
+		WHERE id = $1 AND dm_key IS NOT NULL AND dm_status = 'PENDING'
+		  AND $2 = ANY(participant_ids) AND dm_requested_by IS DISTINCT FROM $2
+		RETURNING COALESCE(dm_requested_by::TEXT, '')`,
+		roomID, userID, status).Scan(&requester)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrDMRequestNotFound
+	}
+	return requester, err
+}
+
+// GetDMRequests returns the pending message requests sent to userID, newest
+// first, with the sender and a preview of the latest message.
+func GetDMRequests(userID string) ([]map[string]interface{}, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT c.id, c.dm_key, u.id, u.real_name, COALESCE(u.thumbnail, ''), c.created_at,
+		       m.content, m.created_at,
+		       (SELECT COUNT(*) FROM chat_messages WHERE chat_id = c.id AND deleted_at IS NULL)
+		FROM chat_rooms c
+		JOIN users u ON u.id = c.dm_requested_by
+		LEFT JOIN LATERAL (
+			SELECT content, created_at FROM chat_messages
+			WHERE chat_id = c.id AND deleted_at IS NULL
+			ORDER BY created_at DESC LIMIT 1
+		) m ON TRUE
+		WHERE c.dm_key IS NOT NULL AND c.dm_status = 'PENDING'
+		  AND $1 = ANY(c.participant_ids) AND c.dm_requested_by <> $1
+		  AND NOT EXISTS (
+			  SELECT 1 FROM blocked_users bu
+			  WHERE bu.blocker_id = ANY(c.participant_ids) AND bu.blocked_id = ANY(c.participant_ids)
+		  )
+		ORDER BY COALESCE(m.created_at, c.created_at) DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []map[string]interface{}{}
+	for rows.Next() {
+		var chatID, dmKey, fromID, fromName, fromThumbnail string
+		var requestedAt time.Time
+		var lastMessage *string
+		var lastMessageAt *time.Time
+		var count int64
+		if err := rows.Scan(&chatID, &dmKey, &fromID, &fromName, &fromThumbnail, &requestedAt,
+			&lastMessage, &lastMessageAt, &count); err != nil {
+			return nil, err
+		}
+		req := map[string]interface{}{
+			"ChatID":            chatID,
+			"DMKey":             dmKey,
+			"FromUserID":        fromID,
+			"FromUserName":      fromName,
+			"FromUserThumbnail": fromThumbnail,
+			"RequestedAt":       requestedAt,
+			"LastMessage":       "",
+			"LastMessageAt":     lastMessageAt,
+			"MessageCount":      count,
+		}
+		if lastMessage != nil {
+			req["LastMessage"] = *lastMessage
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// SharesParty reports whether two users know each other from a party: one
+// hosts a party the other was accepted to, or both were accepted to the same
+// party.
+func SharesParty(userA, userB string) (bool, error) {
+	var shared bool
+	err := db.QueryRow(context.Background(), `SELECT EXISTS(
+		SELECT 1 FROM parties p
+		JOIN party_applications a ON a.party_id = p.id AND a.status = 'ACCEPTED'
+		WHERE (p.host_id = $1 AND a.user_id = $2) OR (p.host_id = $2 AND a.user_id = $1)
+	) OR EXISTS(
+		SELECT 1 FROM party_applications a
+		JOIN party_applications b ON b.party_id = a.party_id
+		WHERE a.user_id = $1 AND a.status = 'ACCEPTED' AND b.user_id = $2 AND b.status = 'ACCEPTED'
+	)`, userA, userB).Scan(&shared)
+	return shared, err
+}
+
+// GetDMPrivacy returns who may start a DM with userID.
+func GetDMPrivacy(userID string) (DMPrivacy, error) {
+	var privacy DMPrivacy
+	err := db.QueryRow(context.Background(), `SELECT COALESCE(dm_privacy, 'EVERYONE') FROM users WHERE id = $1`, userID).Scan(&privacy)
+	return privacy, err
+}
+
+// SetDMPrivacy changes who may start a DM with userID.
+func SetDMPrivacy(userID string, privacy DMPrivacy) error {
+	_, err := db.Exec(context.Background(), `UPDATE users SET dm_privacy = $2, updated_at = NOW() WHERE id = $1`, userID, privacy)
+	return err
 }
 
 // GetDMsForUser returns direct message chats for a user (pair-wise DMs)
 func GetDMsForUser(userID string) ([]map[string]interface{}, error) {
 	query := `
 		SELECT DISTINCT
+			c.id,
+			COALESCE(c.dm_key, '') as dm_key,
+			COALESCE(c.dm_status, 'ACCEPTED') as dm_status,
 			CASE WHEN c.participant_ids[1] = $1 THEN c.participant_ids[2] ELSE c.participant_ids[1] END as other_user_id,
 			u.real_name as other_user_name, COALESCE(u.thumbnail, '') as other_user_thumbnail,
-			(
+			COALESCE((
 				SELECT content FROM chat_messages 
 				WHERE chat_id = c.id 
 				ORDER BY created_at DESC LIMIT 1
-			) as last_message,
+			), '') as last_message,
 			(
 				SELECT created_at FROM chat_messages 
 				WHERE chat_id = c.id 
 				ORDER BY created_at DESC LIMIT 1
-			) as last_message_at
+			) as last_message_at,
+			` + unreadCountSQL("c.id") + ` as unread_count
 		FROM chat_rooms c
 		JOIN users u ON u.id = CASE WHEN c.participant_ids[1] = $1 THEN c.participant_ids[2] ELSE c.participant_ids[1] END
 		WHERE c.is_group = false 
 		  AND $1 = ANY(c.participant_ids)
-		ORDER BY last_message_at DESC
+		  AND (c.dm_status IS NULL OR c.dm_status = 'ACCEPTED' OR c.dm_requested_by = $1)
+		  AND NOT EXISTS (
+			  SELECT 1 FROM blocked_users bu
+			  WHERE bu.blocker_id = ANY(c.participant_ids) AND bu.blocked_id = ANY(c.participant_ids)
+		  )
+		ORDER BY last_message_at DESC NULLS LAST
 	`
 
 	rows, err := db.Query(context.Background(), query, userID)
@@ -929,48 +2051,198 @@ func GetDMsForUser(userID string) ([]map[string]interface{}, error) {
 	}
 	defer rows.Close()
 
-	var dms []map[string]interface{}
+	// Rooms exist before their first message, so LastMessage may be empty
+	dms := []map[string]interface{}{}
 	for rows.Next() {
-		var otherUserID, otherUserName, otherUserThumbnail, lastMessage string
+		var chatID, dmKey, status, otherUserID, otherUserName, otherUserThumbnail, lastMessage string
 		var lastMessageAt *time.Time
+		var unread int64
 
-		err := rows.Scan(&otherUserID, &otherUserName, &otherUserThumbnail, &lastMessage, &lastMessageAt)
+		err := rows.Scan(&chatID, &dmKey, &status, &otherUserID, &otherUserName, &otherUserThumbnail, &lastMessage, &lastMessageAt, &unread)
 		if err != nil {
 			return nil, err
 		}
 
 		dms = append(dms, map[string]interface{}{
+			"ChatID":             chatID,
+			"DMKey":              dmKey,
+			"DMStatus":           status,
 			"OtherUserID":        otherUserID,
 			"OtherUserName":      otherUserName,
 			"OtherUserThumbnail": otherUserThumbnail,
 			"LastMessage":        lastMessage,
 			"LastMessageAt":      lastMessageAt,
+			"UnreadCount":        unread,
 		})
 	}
-	return dms, nil
+	return dms, rows.Err()
 }
 
-// GetDMMessages returns messages between two users
-func GetDMMessages(userID, otherUserID string, limit int) ([]ChatMessage, error) {
-	// Generate the deterministic DM chat ID
-	u1, u2 := userID, otherUserID
-	if u1 > u2 {
-		u1, u2 = u2, u1
+// ErrMessageNotFound is returned when a message does not exist, was deleted,
+// or may not be changed by the caller.
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageRef identifies the chat and sender of a message.
+type MessageRef struct {
+	ChatID   string
+	SenderID string
+	Seq      int64
+	Deleted  bool
+}
+
+// GetMessageRef looks up where a message lives without loading it.
+func GetMessageRef(messageID string) (MessageRef, error) {
+	var ref MessageRef
+	if !uuidPattern.MatchString(messageID) {
+		return ref, ErrMessageNotFound
+	}
+	err := db.QueryRow(context.Background(),
+		`SELECT chat_id::TEXT, sender_id, COALESCE(seq, 0), deleted_at IS NOT NULL FROM chat_messages WHERE id = $1`,
+		messageID).Scan(&ref.ChatID, &ref.SenderID, &ref.Seq, &ref.Deleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ref, ErrMessageNotFound
 	}
-	dmChatID := u1 + "_" + u2
+	return ref, err
+}
 
-	return GetChatHistory(dmChatID, limit)
+// GetMessage loads one message with its sender and reactions.
+func GetMessage(messageID, chatID string) (ChatMessage, error) {
+	rows, err := db.Query(context.Background(), `SELECT `+chatMessageColumns+`
+		FROM chat_messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.id = $1`, messageID)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	msgs, err := scanChatMessages(rows, chatID)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	if len(msgs) == 0 {
+		return ChatMessage{}, ErrMessageNotFound
+	}
+	return msgs[0], nil
 }
 
-// DeleteMessage deletes a chat message
-func DeleteMessage(messageID, userID string) error {
-	// Only allow the sender to delete their own message
-	_, err := db.Exec(context.Background(),
-		"DELETE FROM chat_messages WHERE id = $1 AND sender_id = $2",
-		messageID, userID)
+// EditMessage replaces the content of userID's own message, keeping the
+// previous version in message_edits.
+func EditMessage(messageID, userID, content string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var previous *string
+	var writtenAt time.Time
+	err = tx.QueryRow(ctx,
+		`SELECT content, COALESCE(edited_at, created_at) FROM chat_messages
+		 WHERE id = $1 AND sender_id = $2 AND deleted_at IS NULL FOR UPDATE`,
+		messageID, userID).Scan(&previous, &writtenAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO message_edits (message_id, content, edited_at) VALUES ($1, $2, $3)`,
+		messageID, previous, writtenAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE chat_messages SET content = $2, edited_at = NOW() WHERE id = $1`,
+		messageID, content); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetMessageEdits lists the previous versions of a message, oldest first.
+// Each EditedAt is when that version was written.
+func GetMessageEdits(messageID string) ([]MessageEdit, error) {
+	rows, err := db.Query(context.Background(),
+		`SELECT COALESCE(content, ''), edited_at FROM message_edits WHERE message_id = $1 ORDER BY edited_at`,
+		messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.Content, &e.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// DeleteMessage turns a message into a tombstone: its content, media, edit
+// history and reactions are removed but its place (and Seq) in the chat stays.
+// The sender or a party chat's host may delete it.
+func DeleteMessage(messageID, userID string) (MessageRef, error) {
+	ctx := context.Background()
+	var ref MessageRef
+	if !uuidPattern.MatchString(messageID) {
+		return ref, ErrMessageNotFound
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return ref, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `UPDATE chat_messages m
+		SET deleted_at = NOW(), content = '', media_url = '', thumbnail_url = '', metadata = '{}'
+		WHERE m.id = $1 AND m.deleted_at IS NULL
+		  AND (m.sender_id = $2 OR EXISTS (SELECT 1 FROM chat_rooms cr WHERE cr.id = m.chat_id AND cr.host_id = $2 AND cr.dm_key IS NULL))
+		RETURNING m.chat_id::TEXT, m.sender_id, COALESCE(m.seq, 0)`,
+		messageID, userID).Scan(&ref.ChatID, &ref.SenderID, &ref.Seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ref, ErrMessageNotFound
+	}
+	if err != nil {
+		return ref, err
+	}
+	ref.Deleted = true
+	for _, q := range []string{
+		`DELETE FROM message_edits WHERE message_id = $1`,
+		`DELETE FROM message_reactions WHERE message_id = $1`,
+	} {
+		if _, err := tx.Exec(ctx, q, messageID); err != nil {
+			return ref, err
+		}
+	}
+	return ref, tx.Commit(ctx)
+}
+
+// SetReaction adds or removes userID's emoji on a message.
+func SetReaction(messageID, userID, emoji string, add bool) error {
+	query := `DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`
+	if add {
+		query = `INSERT INTO message_reactions (message_id, user_id, emoji) VALUES ($1, $2, $3)
+			ON CONFLICT (message_id, user_id, emoji) DO NOTHING`
+	}
+	_, err := db.Exec(context.Background(), query, messageID, userID, emoji)
 	return err
 }
 
+// GetReactions aggregates the reactions on a message.
+func GetReactions(messageID string) ([]Reaction, error) {
+	var raw []byte
+	err := db.QueryRow(context.Background(),
+		`SELECT `+reactionsAggregate+` FROM chat_messages m WHERE m.id = $1`, messageID).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+	reactions := []Reaction{}
+	return reactions, json.Unmarshal(raw, &reactions)
+}
+
 // ==========================================
 // NOTIFICATIONS
 // ==========================================
@@ -686,3 +686,132 @@ func TestPartyDuration(t *testing.T) {
 		}
 	})
 }
+
+// ==================== CHAT ACCESS TESTS ====================
+
+func TestCanAccessChat_RejectsOutsiders(t *testing.T) {
+	// These are decided before any query runs
+	cases := []struct{ user, chat string }{
+		{"user-3", generateDMChatId("user-1", "user-2")},
+		{"user-1", "party-chat-123"},
+		{"not-a-uuid", "2b8f3c1e-5d6a-4f7b-9c0d-1e2f3a4b5c6d"},
+	}
+	for _, tc := range cases {
+		ok, err := CanAccessChat(tc.user, tc.chat)
+		if ok || err != nil {
+			t.Errorf("CanAccessChat(%q, %q) = %v, %v; want false, nil", tc.user, tc.chat, ok, err)
+		}
+	}
+}
+
+func TestSaveMessage_ClientMessageIDPerChat(t *testing.T) {
+	useTestDB(t)
+	sender := createTestDBUser(t, "sender")
+	first, _, err := GetOrCreateDMRoom(sender, createTestDBUser(t, "peer-a"), DMAccepted)
+	if err != nil {
+		t.Fatalf("create DM: %v", err)
+	}
+	second, _, err := GetOrCreateDMRoom(sender, createTestDBUser(t, "peer-b"), DMAccepted)
+	if err != nil {
+		t.Fatalf("create DM: %v", err)
+	}
+
+	send := func(chatID string) (ChatMessage, bool) {
+		t.Helper()
+		stored, created, err := SaveMessage(ChatMessage{ChatID: chatID, SenderID: sender, Type: MsgText, Content: "hi", ClientMessageID: "same-key"})
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		return stored, created
+	}
+
+	a, created := send(first.ID)
+	if !created {
+		t.Fatal("Expected the first message to be stored")
+	}
+	// The same key in another chat is a different message
+	b, created := send(second.ID)
+	if !created || b.ID == a.ID || b.ChatID != second.ID {
+		t.Errorf("Expected a new message in the second chat, got %+v (created=%v)", b, created)
+	}
+	// A retry in the first chat returns the original with its own chat
+	retry, created := send(first.ID)
+	if created || retry.ID != a.ID || retry.ChatID != first.ID {
+		t.Errorf("Expected the retry to return %s in %s, got %+v (created=%v)", a.ID, first.ID, retry, created)
+	}
+}
+
+func TestSearchMessages_ScopingDeletedAndPaging(t *testing.T) {
+	useTestDB(t)
+	searcher, friend, stranger := createTestDBUser(t, "searcher"), createTestDBUser(t, "friend"), createTestDBUser(t, "stranger")
+	own, _, err := GetOrCreateDMRoom(searcher, friend, DMAccepted)
+	if err != nil {
+		t.Fatalf("create DM: %v", err)
+	}
+	other, _, err := GetOrCreateDMRoom(friend, stranger, DMAccepted)
+	if err != nil {
+		t.Fatalf("create DM: %v", err)
+	}
+
+	send := func(chatID, senderID, content string) ChatMessage {
+		t.Helper()
+		m, _, err := SaveMessage(ChatMessage{ChatID: chatID, SenderID: senderID, Type: MsgText, Content: content})
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		return m
+	}
+	older := send(own.ID, searcher, "the unicorn is older")
+	newer := send(own.ID, friend, "the unicorn is newer")
+	deleted := send(own.ID, searcher, "a deleted unicorn")
+	send(other.ID, stranger, "a unicorn in someone else's chat")
+	if _, err := DeleteMessage(deleted.ID, searcher); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// Only live messages from the searcher's own chats, newest first
+	hits, hasMore, err := SearchMessages(searcher, "unicorn", "", "", 10)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(hits) != 2 || hits[0].MessageID != newer.ID || hits[1].MessageID != older.ID || hasMore {
+		t.Fatalf("Expected [%s %s] without more, got %+v (hasMore=%v)", newer.ID, older.ID, hits, hasMore)
+	}
+
+	// Paging with Before continues where the previous page stopped
+	page, hasMore, err := SearchMessages(searcher, "unicorn", "", "", 1)
+	if err != nil || len(page) != 1 || page[0].MessageID != newer.ID || !hasMore {
+		t.Fatalf("Expected first page [%s] with more, got %+v (hasMore=%v, err=%v)", newer.ID, page, hasMore, err)
+	}
+	page, hasMore, err = SearchMessages(searcher, "unicorn", "", page[0].MessageID, 1)
+	if err != nil || len(page) != 1 || page[0].MessageID != older.ID || hasMore {
+		t.Fatalf("Expected second page [%s] without more, got %+v (hasMore=%v, err=%v)", older.ID, page, hasMore, err)
+	}
+
+	// A chat filter outside the searcher's chats finds nothing
+	if hits, _, err := SearchMessages(searcher, "unicorn", other.ID, "", 10); err != nil || len(hits) != 0 {
+		t.Errorf("Expected no hits in another user's chat, got %+v (err=%v)", hits, err)
+	}
+}
+
+func TestGetDMsForUser_RoomWithoutMessages(t *testing.T) {
+	useTestDB(t)
+	me, peer := createTestDBUser(t, "me"), createTestDBUser(t, "peer")
+	if dms, err := GetDMsForUser(me); err != nil || dms == nil || len(dms) != 0 {
+		t.Fatalf("Expected an empty, non-nil list, got %v (err=%v)", dms, err)
+	}
+
+	room, _, err := GetOrCreateDMRoom(me, peer, DMAccepted)
+	if err != nil {
+		t.Fatalf("create DM: %v", err)
+	}
+	for _, uid := range []string{me, peer} {
+		dms, err := GetDMsForUser(uid)
+		if err != nil {
+			t.Fatalf("Expected an empty DM room to be listed, got %v", err)
+		}
+		if len(dms) != 1 || dms[0]["ChatID"] != room.ID || dms[0]["LastMessage"] != "" {
+			t.Errorf("Expected %s with no last message, got %v", room.ID, dms)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorCode is a stable, machine-readable error category. Clients branch on
+// the code; the message is for display only and may change.
+type ErrorCode string
+
+const (
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeForbidden        ErrorCode = "FORBIDDEN"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeValidation       ErrorCode = "VALIDATION"
+	CodeConflict         ErrorCode = "CONFLICT"
+	CodeRateLimited      ErrorCode = "RATE_LIMITED"
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeUpgradeRequired  ErrorCode = "UPGRADE_REQUIRED"
+	CodeUnavailable      ErrorCode = "UNAVAILABLE"
+	CodeInternal         ErrorCode = "INTERNAL"
+)
+
+var codeStatus = map[ErrorCode]int{
+	CodeNotFound:         http.StatusNotFound,
+	CodeForbidden:        http.StatusForbidden,
+	CodeUnauthorized:     http.StatusUnauthorized,
+	CodeValidation:       http.StatusBadRequest,
+	CodeConflict:         http.StatusConflict,
+	CodeRateLimited:      http.StatusTooManyRequests,
+	CodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	CodeUpgradeRequired:  http.StatusUpgradeRequired,
+	CodeUnavailable:      http.StatusServiceUnavailable,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// FieldError describes one invalid request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is returned by WebSocket handlers and written by REST handlers.
+// It is the ERROR/NACK payload on the socket and the body of REST errors.
+// Message is always safe to show; the underlying cause is only logged.
+type APIError struct {
+	Code    ErrorCode    `json:"code"`
+	Message string       `json:"message"`
+	Event   string       `json:"event,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
+	// Errors repeats the field messages for clients that predate Fields
+	Errors     []string               `json:"errors,omitempty"`
+	RetryAfter int                    `json:"retryAfter,omitempty"` // seconds
+	Details    map[string]interface{} `json:"details,omitempty"`
+
+	cause error
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+func (e *APIError) Unwrap() error { return e.cause }
+
+// Status is the HTTP status matching the error code.
+func (e *APIError) Status() int {
+	if status, ok := codeStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func notFoundError(msg string) *APIError {
+	return &APIError{Code: CodeNotFound, Message: msg}
+}
+
+func forbiddenError(msg string) *APIError {
+	return &APIError{Code: CodeForbidden, Message: msg}
+}
+
+func unauthorizedError(msg string) *APIError {
+	return &APIError{Code: CodeUnauthorized, Message: msg}
+}
+
+func conflictError(msg string) *APIError {
+	return &APIError{Code: CodeConflict, Message: msg}
+}
+
+func methodNotAllowedError() *APIError {
+	return &APIError{Code: CodeMethodNotAllowed, Message: "Method not allowed"}
+}
+
+// upgradeRequiredError tells a client its protocol version is too old.
+func upgradeRequiredError(minVersion int) *APIError {
+	return &APIError{
+		Code:    CodeUpgradeRequired,
+		Message: "Please update the app to continue",
+		Details: map[string]interface{}{"minVersion": minVersion},
+	}
+}
+
+// validationError reports a bad request, optionally with per-field details.
+func validationError(msg string, fields ...FieldError) *APIError {
+	e := &APIError{Code: CodeValidation, Message: msg, Fields: fields}
+	for _, f := range fields {
+		e.Errors = append(e.Errors, f.Message)
+	}
+	return e
+}
+
+// requiredError reports missing required fields.
+func requiredError(fields ...string) *APIError {
+	verb := " is required"
+	if len(fields) > 1 {
+		verb = " are required"
+	}
+	details := make([]FieldError, len(fields))
+	for i, f := range fields {
+		details[i] = FieldError{f, f + " is required"}
+	}
+	return validationError(strings.Join(fields, " and ")+verb, details...)
+}
+
+// rateLimitedError asks the client to back off. A zero retryAfter means
+// waiting will not help (e.g. a new code must be requested).
+func rateLimitedError(msg string, retryAfter time.Duration) *APIError {
+	e := &APIError{Code: CodeRateLimited, Message: msg}
+	if retryAfter > 0 {
+		e.RetryAfter = int(retryAfter.Seconds()) + 1
+	}
+	return e
+}
+
+// unavailableError tells the client to retry elsewhere, e.g. while this
+// replica drains for a deploy.
+func unavailableError(msg string, retryAfter time.Duration) *APIError {
+	e := &APIError{Code: CodeUnavailable, Message: msg}
+	if retryAfter > 0 {
+		e.RetryAfter = int(retryAfter.Seconds())
+	}
+	return e
+}
+
+// internalError hides cause from the client behind msg. The cause is logged
+// when the error is written.
+func internalError(msg string, cause error) *APIError {
+	return &APIError{Code: CodeInternal, Message: msg, cause: cause}
+}
+
+// asAPIError converts any error into an APIError, treating unknown errors as
+// internal so their text never reaches the client.
+func asAPIError(err error) *APIError {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e
+	}
+	return internalError("Something went wrong", err)
+}
+
+func logAPIError(context string, e *APIError) {
+	if e.Code == CodeInternal && e.cause != nil {
+		log.Printf("%s: %s: %v", context, e.Message, e.cause)
+	}
+}
+
+// writeError writes err as a JSON REST error with the status for its code.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := asAPIError(err)
+	logAPIError(r.Method+" "+r.URL.Path, e)
+
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status())
+	json.NewEncoder(w).Encode(e)
+}
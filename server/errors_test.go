@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIError_Status(t *testing.T) {
+	tests := map[*APIError]int{
+		notFoundError("x"):       http.StatusNotFound,
+		forbiddenError("x"):      http.StatusForbidden,
+		unauthorizedError("x"):   http.StatusUnauthorized,
+		validationError("x"):     http.StatusBadRequest,
+		conflictError("x"):       http.StatusConflict,
+		rateLimitedError("x", 0): http.StatusTooManyRequests,
+		methodNotAllowedError():  http.StatusMethodNotAllowed,
+		internalError("x", nil):  http.StatusInternalServerError,
+		{Code: "SOMETHING_ELSE"}: http.StatusInternalServerError,
+	}
+	for e, want := range tests {
+		if got := e.Status(); got != want {
+			t.Errorf("%s: expected %d, got %d", e.Code, want, got)
+		}
+	}
+}
+
+func TestAsAPIError_HidesUnknownErrors(t *testing.T) {
+	e := asAPIError(errors.New(`pq: duplicate key value violates unique constraint "users_email_key"`))
+	if e.Code != CodeInternal || strings.Contains(e.Message, "duplicate") {
+		t.Errorf("Expected sanitized internal error, got %+v", e)
+	}
+
+	body, _ := json.Marshal(internalError("Failed to save", errors.New("connection refused")))
+	if strings.Contains(string(body), "refused") {
+		t.Errorf("Cause leaked into JSON: %s", body)
+	}
+}
+
+func TestRequiredError(t *testing.T) {
+	e := requiredError("PartyID", "Status")
+	if e.Code != CodeValidation || e.Message != "PartyID and Status are required" {
+		t.Errorf("Unexpected error %+v", e)
+	}
+	if len(e.Fields) != 2 || e.Fields[1].Field != "Status" || len(e.Errors) != 2 {
+		t.Errorf("Expected per-field details, got %+v", e)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, httptest.NewRequest("POST", "/login", nil), rateLimitedError("Slow down", 30*time.Second))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "31" {
+		t.Errorf("Expected Retry-After 31, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	var body APIError
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Code != CodeRateLimited || body.Message != "Slow down" || body.RetryAfter != 31 {
+		t.Errorf("Unexpected body %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,1760 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func init() {
+	// Connection
+	on("HELLO", false, handleHello)
+
+	// Rooms and messaging
+	on("JOIN_ROOM", true, handleJoinRoom)
+	on("LEAVE_ROOM", true, handleLeaveRoom)
+	on("SEND_MESSAGE", true, handleSendMessage)
+	on("SEND_DM", true, handleSendDM)
+	on("GET_CHATS", false, handleGetChats)
+	on("GET_CHAT_HISTORY", false, handleGetChatHistory)
+	on("GET_DMS", false, handleGetDMs)
+	on("GET_DM_MESSAGES", false, handleGetDMMessages)
+	on("GET_DM_REQUESTS", false, handleGetDMRequests)
+	on("ACCEPT_DM_REQUEST", true, handleAcceptDMRequest)
+	on("DECLINE_DM_REQUEST", true, handleDeclineDMRequest)
+	on("SET_DM_PRIVACY", true, handleSetDMPrivacy)
+	on("DELETE_DM_MESSAGE", true, handleDeleteMessage)
+	on("DELETE_MESSAGE", true, handleDeleteMessage)
+	on("EDIT_MESSAGE", true, handleEditMessage)
+	on("GET_MESSAGE_EDITS", false, handleGetMessageEdits)
+	on("REACT_TO_MESSAGE", true, handleReactToMessage)
+	on("SYNC", false, handleSync)
+	on("ACK_DELIVERY", true, handleAckDelivery)
+	on("TYPING_START", false, handleTypingStart)
+	on("TYPING_STOP", false, handleTypingStop)
+	on("MARK_CHAT_READ", true, handleMarkChatRead)
+	on("GET_READ_STATE", false, handleGetReadState)
+	on("SEARCH_MESSAGES", false, handleSearchMessages)
+
+	// Parties
+	on("CREATE_PARTY", true, handleCreateParty)
+	on("UPDATE_PARTY", true, handleUpdateParty)
+	on("DELETE_PARTY", true, handleDeleteParty)
+	on("UPDATE_PARTY_STATUS", true, handleUpdatePartyStatus)
+	on("GET_PARTY_DETAILS", false, handleGetPartyDetails)
+	on("GET_PARTY_ANALYTICS", false, handleGetPartyAnalytics)
+	on("GET_MY_PARTIES", false, handleGetMyParties)
+	on("GET_MATCHED_PARTIES", false, handleGetMyParties)
+	on("GET_FEED", false, handleGetFeed)
+	on("REVERSE_GEOCODE", false, handleReverseGeocode)
+
+	// Applications and matching
+	on("SWIPE", true, handleSwipe)
+	on("APPLY_TO_PARTY", true, handleApplyToParty)
+	on("REJECT_PARTY", true, handleRejectParty)
+	on("CANCEL_APPLICATION", true, handleCancelApplication)
+	on("LEAVE_PARTY", true, handleLeaveParty)
+	on("GET_APPLICANTS", false, handleGetApplicants)
+	on("GET_PARTY_APPLICANTS", false, handleGetApplicants)
+	on("UPDATE_APPLICATION", true, handleUpdateApplication)
+	on("GET_MATCHED_USERS", false, handleGetMatchedUsers)
+	on("UNMATCH_USER", true, handleUnmatchUser)
+
+	// Fundraising
+	on("ADD_CONTRIBUTION", true, handleAddContribution)
+	on("GET_FUNDRAISER_STATE", false, handleGetFundraiserState)
+
+	// Profile and safety
+	on("GET_USER", false, handleGetUser)
+	on("UPDATE_PROFILE", true, handleUpdateProfile)
+	on("DELETE_USER", true, handleDeleteUser)
+	on("SEARCH_USERS", false, handleSearchUsers)
+	on("BLOCK_USER", true, handleBlockUser)
+	on("UNBLOCK_USER", true, handleUnblockUser)
+	on("GET_BLOCKED_USERS", false, handleGetBlockedUsers)
+	on("REPORT_USER", true, handleReportUser)
+	on("REPORT_PARTY", true, handleReportParty)
+
+	// Notifications
+	on("GET_NOTIFICATIONS", false, handleGetNotifications)
+	on("MARK_NOTIFICATION_READ", true, handleMarkNotificationRead)
+	on("MARK_ALL_NOTIFICATIONS_READ", true, handleMarkAllNotificationsRead)
+}
+
+// Shared payload shapes
+
+type roomPayload struct {
+	RoomID string `json:"RoomID"`
+}
+
+type partyPayload struct {
+	PartyID string `json:"PartyID"`
+}
+
+type userPayload struct {
+	UserID string `json:"UserID"`
+}
+
+type reportPayload struct {
+	UserID  string `json:"UserID"`
+	PartyID string `json:"PartyID"`
+	Reason  string `json:"Reason"`
+	Details string `json:"Details"`
+}
+
+// ==========================================
+// ROOMS AND MESSAGING
+// ==========================================
+
+// requireChatAccess fails unless uid belongs to chatID.
+func requireChatAccess(uid, chatID string) error {
+	ok, err := CanAccessChat(uid, chatID)
+	if err != nil {
+		return internalError("Failed to check chat access", err)
+	}
+	if !ok {
+		return forbiddenError("Not a member of this chat")
+	}
+	return nil
+}
+
+// requireChat checks uid belongs to chatID and returns the chat's room ID.
+// A generateDMChatId pair key is accepted in place of a DM's room ID.
+func requireChat(uid, chatID string) (string, error) {
+	if err := requireChatAccess(uid, chatID); err != nil {
+		return "", err
+	}
+	if _, _, isDM := parseDMChatId(chatID); !isDM {
+		return chatID, nil
+	}
+	roomID, err := GetDMRoomID(chatID)
+	if err != nil {
+		return "", internalError("Failed to find conversation", err)
+	}
+	if roomID == "" {
+		return "", notFoundError("Conversation not started")
+	}
+	return roomID, nil
+}
+
+// evictFromPartyChat drops userID's connections from the party's chat room
+// after they lose access to it.
+func evictFromPartyChat(hub *Hub, partyID, userID string) {
+	if room, err := GetChatRoomByParty(partyID); err == nil {
+		hub.EvictFromRoom(room.ID, userID)
+	}
+}
+
+func handleJoinRoom(c *Client, req *wsRequest, p roomPayload) error {
+	if p.RoomID == "" {
+		return requiredError("RoomID")
+	}
+	roomID, err := requireChat(c.UID, p.RoomID)
+	if err != nil {
+		return err
+	}
+	c.hub.JoinRoom(roomID, c)
+	return nil
+}
+
+func handleLeaveRoom(c *Client, req *wsRequest, p roomPayload) error {
+	if p.RoomID == "" {
+		return requiredError("RoomID")
+	}
+	c.hub.mu.Lock()
+	if clients, ok := c.hub.rooms[p.RoomID]; ok {
+		delete(clients, c)
+	}
+	c.hub.mu.Unlock()
+	return nil
+}
+
+// maxClientMessageID bounds the client-generated idempotency key.
+const maxClientMessageID = 64
+
+func handleSendMessage(c *Client, req *wsRequest, msg ChatMessage) error {
+	if msg.ChatID == "" {
+		return requiredError("ChatID")
+	}
+	if len(msg.ClientMessageID) > maxClientMessageID {
+		return validationError("Invalid ClientMessageID", FieldError{"ClientMessageID", fmt.Sprintf("At most %d characters", maxClientMessageID)})
+	}
+	chatID, err := requireChat(c.UID, msg.ChatID)
+	if err != nil {
+		return err
+	}
+	msg.ChatID = chatID
+	msg.SenderID = c.UID
+	if msg.Type == "" {
+		msg.Type = MsgText
+	}
+	if err := prepareMediaMessage(&msg); err != nil {
+		return err
+	}
+
+	// DMs go through the message request flow, as with SEND_DM, so a pending
+	// or declined requester can't bypass it by posting to the room directly
+	room, err := GetChatRoom(chatID)
+	if err != nil {
+		return internalError("Failed to send message", err)
+	}
+	recipientID := ""
+	if a, b, isDM := parseDMChatId(room.DMKey); isDM {
+		recipientID = a
+		if a == c.UID {
+			recipientID = b
+		}
+		if room, err = openDM(c, recipientID); err != nil {
+			return err
+		}
+	}
+
+	// Fetch sender info for real-time broadcast
+	if sender, err := GetUser(c.UID); err == nil {
+		msg.SenderName = sender.RealName
+		msg.SenderThumbnail = sender.Thumbnail
+	}
+
+	// Persist before fan-out so an ACK means the message is stored, and
+	// broadcast the stored row with its server ID, Seq and timestamp
+	msg, created, err := SaveMessage(msg)
+	if err != nil {
+		return internalError("Failed to send message", err)
+	}
+	if !created {
+		// A retry of a message that was already stored and broadcast
+		c.reply(req, "NEW_MESSAGE", msg)
+		return nil
+	}
+
+	c.hub.StopTyping(msg.ChatID, c.UID)
+	c.hub.PublishToRoom(msg.ChatID, encodeEvent("NEW_MESSAGE", msg))
+	notifyDMRequest(c.hub, room, recipientID, msg)
+	return nil
+}
+
+func handleSendDM(c *Client, req *wsRequest, p struct {
+	RecipientID     string `json:"RecipientID"`
+	Content         string `json:"Content"`
+	ClientMessageID string `json:"ClientMessageID"`
+}) error {
+	if p.RecipientID == "" {
+		return requiredError("RecipientID")
+	}
+	if len(p.ClientMessageID) > maxClientMessageID {
+		return validationError("Invalid ClientMessageID", FieldError{"ClientMessageID", fmt.Sprintf("At most %d characters", maxClientMessageID)})
+	}
+	if p.RecipientID == c.UID || !uuidPattern.MatchString(p.RecipientID) {
+		return validationError("Invalid recipient", FieldError{"RecipientID", "Must be another user"})
+	}
+
+	// Check if either user has blocked the other
+	blocked1, _ := IsBlocked(c.UID, p.RecipientID)
+	blocked2, _ := IsBlocked(p.RecipientID, c.UID)
+	if blocked1 || blocked2 {
+		return forbiddenError("Cannot send message to this user")
+	}
+
+	room, err := openDM(c, p.RecipientID)
+	if err != nil {
+		return err
+	}
+
+	msg := ChatMessage{
+		ChatID:          room.ID,
+		ClientMessageID: p.ClientMessageID,
+		SenderID:        c.UID,
+		Content:         p.Content,
+		Type:            MsgText,
+	}
+
+	if sender, err := GetUser(c.UID); err == nil {
+		msg.SenderName = sender.RealName
+		msg.SenderThumbnail = sender.Thumbnail
+	}
+
+	msg, created, err := SaveMessage(msg)
+	if err != nil {
+		return internalError("Failed to send message", err)
+	}
+	if !created {
+		c.reply(req, "NEW_MESSAGE", msg)
+		return nil
+	}
+
+	c.hub.StopTyping(msg.ChatID, c.UID)
+	c.hub.PublishToRoom(msg.ChatID, encodeEvent("NEW_MESSAGE", msg))
+	notifyDMRequest(c.hub, room, p.RecipientID, msg)
+	return nil
+}
+
+// notifyDMRequest sends a message in a pending DM to its recipient, who only
+// joins the room once they accept the request.
+func notifyDMRequest(hub *Hub, room ChatRoom, recipientID string, msg ChatMessage) {
+	if room.DMStatus != DMPending {
+		return
+	}
+	hub.PublishToUser(recipientID, encodeEvent("DM_REQUEST", map[string]interface{}{
+		"ChatID":  room.ID,
+		"DMKey":   room.DMKey,
+		"Message": msg,
+	}))
+}
+
+// newDMStatus decides how a first message to a user with privacy is received:
+// straight away from someone they share a party with, as a request from a
+// stranger, or not at all.
+func newDMStatus(privacy DMPrivacy, sharesParty bool) (DMStatus, error) {
+	switch {
+	case privacy == DMPrivacyNobody, privacy == DMPrivacyParties && !sharesParty:
+		return "", forbiddenError("This user doesn't accept messages from you")
+	case sharesParty:
+		return DMAccepted, nil
+	}
+	return DMPending, nil
+}
+
+// dmStatusAfterSend is the state of an existing DM once senderID writes in
+// it. Replying to a request accepts it, and a party shared since lifts it.
+func dmStatusAfterSend(room ChatRoom, senderID string, sharesParty bool) (DMStatus, error) {
+	if sharesParty || room.DMStatus == DMAccepted || room.DMRequestedBy != senderID {
+		return DMAccepted, nil
+	}
+	if room.DMStatus == DMDeclined {
+		return "", forbiddenError("Message request declined")
+	}
+	return DMPending, nil
+}
+
+// openDM returns c's DM room with recipientID for a new message, creating it
+// or moving its request state along as needed.
+func openDM(c *Client, recipientID string) (ChatRoom, error) {
+	room, found, err := GetDMRoom(generateDMChatId(c.UID, recipientID))
+	if err != nil {
+		return room, internalError("Failed to start conversation", err)
+	}
+	if found && room.DMStatus == DMAccepted {
+		return room, nil
+	}
+	sharesParty, err := SharesParty(c.UID, recipientID)
+	if err != nil {
+		return room, internalError("Failed to start conversation", err)
+	}
+
+	if !found {
+		privacy, err := GetDMPrivacy(recipientID)
+		if err != nil {
+			return room, internalError("Failed to start conversation", err)
+		}
+		status, err := newDMStatus(privacy, sharesParty)
+		if err != nil {
+			return room, err
+		}
+		var created bool
+		room, created, err = GetOrCreateDMRoom(c.UID, recipientID, status)
+		if err != nil {
+			return room, internalError("Failed to start conversation", err)
+		}
+		if created {
+			// Online devices join the new room so it fans out like any other chat
+			members := []string{c.UID}
+			if status == DMAccepted {
+				members = append(members, recipientID)
+			}
+			c.hub.AddToRoom(room.ID, members...)
+			return room, nil
+		}
+		// The recipient opened the room at the same time; carry on from its state
+	}
+
+	status, err := dmStatusAfterSend(room, c.UID, sharesParty)
+	if err != nil {
+		return room, err
+	}
+	if status != room.DMStatus {
+		if err := SetDMStatus(room.ID, status); err != nil {
+			return room, internalError("Failed to start conversation", err)
+		}
+		room.DMStatus = status
+		acceptDM(c.hub, room.ID, c.UID, recipientID)
+	}
+	return room, nil
+}
+
+// acceptDM joins both users to a DM room whose request was just accepted and
+// tells them.
+func acceptDM(hub *Hub, roomID, acceptedBy, otherID string) {
+	hub.AddToRoom(roomID, acceptedBy, otherID)
+	hub.PublishToRoom(roomID, encodeEvent("DM_REQUEST_ACCEPTED", map[string]string{
+		"ChatID": roomID,
+		"UserID": acceptedBy,
+	}))
+}
+
+func handleGetChats(c *Client, req *wsRequest, _ noPayload) error {
+	rooms, err := GetChatRoomsForUser(c.UID)
+	if err != nil {
+		return internalError("Failed to get chats", err)
+	}
+	c.reply(req, "CHATS_LIST", rooms)
+	return nil
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// historyQuery selects a page of chat history. The cursors are message IDs;
+// at most one may be set. Without one the newest messages are returned.
+type historyQuery struct {
+	Limit  int    `json:"Limit"`
+	Before string `json:"Before"` // messages older than this one
+	After  string `json:"After"`  // messages newer than this one
+	Around string `json:"Around"` // this message and its neighbours on both sides
+}
+
+func (q *historyQuery) validate() error {
+	set := 0
+	for _, cursor := range []string{q.Before, q.After, q.Around} {
+		if cursor != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return validationError("Invalid cursor", FieldError{"Before", "Use only one of Before, After and Around"})
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultHistoryLimit
+	}
+	if q.Limit > maxHistoryLimit {
+		q.Limit = maxHistoryLimit
+	}
+	return nil
+}
+
+// historyPage is the reply to a history request from a client that
+// negotiated the "paged_history" feature.
+type historyPage struct {
+	ChatID   string        `json:"ChatID"`
+	Messages []ChatMessage `json:"Messages"` // always oldest first
+	// HasMore reports further messages in the paging direction: newer for
+	// After, older otherwise. NextCursor continues there, as After or Before.
+	HasMore    bool   `json:"HasMore"`
+	NextCursor string `json:"NextCursor,omitempty"`
+	// HasMoreAfter reports newer messages beyond an Around page.
+	HasMoreAfter bool `json:"HasMoreAfter,omitempty"`
+}
+
+// loadHistory fetches the page q selects from chatID.
+func loadHistory(chatID string, q historyQuery) (historyPage, error) {
+	page := historyPage{ChatID: chatID, Messages: []ChatMessage{}}
+	cursorID := q.Before + q.After + q.Around
+	var from *MessageCursor
+	if cursorID != "" {
+		cur, err := GetMessageCursor(chatID, cursorID)
+		if errors.Is(err, ErrMessageNotFound) {
+			return page, notFoundError("Cursor message not found")
+		}
+		if err != nil {
+			return page, internalError("Failed to get chat history", err)
+		}
+		from = &cur
+	}
+
+	var err error
+	switch {
+	case q.After != "":
+		page.Messages, page.HasMore, err = GetMessagePage(chatID, from, false, false, q.Limit)
+		if err == nil && page.HasMore {
+			page.NextCursor = page.Messages[len(page.Messages)-1].ID
+		}
+		return page, wrapHistoryError(err)
+	case q.Around != "":
+		// The cursor message counts towards the older half
+		var newer []ChatMessage
+		page.Messages, page.HasMore, err = GetMessagePage(chatID, from, true, true, q.Limit-q.Limit/2)
+		if err == nil && q.Limit/2 > 0 {
+			newer, page.HasMoreAfter, err = GetMessagePage(chatID, from, false, false, q.Limit/2)
+			page.Messages = append(page.Messages, newer...)
+		}
+	default:
+		page.Messages, page.HasMore, err = GetMessagePage(chatID, from, true, false, q.Limit)
+	}
+	if err == nil && page.HasMore {
+		page.NextCursor = page.Messages[0].ID
+	}
+	return page, wrapHistoryError(err)
+}
+
+func wrapHistoryError(err error) error {
+	if err != nil {
+		return internalError("Failed to get chat history", err)
+	}
+	return nil
+}
+
+// replyHistory sends page as a historyPage, or to clients without
+// "paged_history" as the bare message list, newest first.
+func replyHistory(c *Client, req *wsRequest, event string, page historyPage) {
+	if c.Supports("paged_history") {
+		c.reply(req, event, page)
+		return
+	}
+	slices.Reverse(page.Messages)
+	c.reply(req, event, page.Messages)
+}
+
+func handleGetChatHistory(c *Client, req *wsRequest, p struct {
+	ChatID string `json:"ChatID"`
+	historyQuery
+}) error {
+	if p.ChatID == "" {
+		return requiredError("ChatID")
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	chatID, err := requireChat(c.UID, p.ChatID)
+	if err != nil {
+		return err
+	}
+
+	page, err := loadHistory(chatID, p.historyQuery)
+	if err != nil {
+		return err
+	}
+	replyHistory(c, req, "CHAT_HISTORY", page)
+	return nil
+}
+
+const (
+	maxSyncChats     = 100
+	defaultSyncLimit = 200
+	maxSyncLimit     = 500
+)
+
+type syncPayload struct {
+	// Cursors maps ChatID to the last Seq this device received. Without it the
+	// server resumes from the cursors stored by ACK_DELIVERY.
+	Cursors map[string]int64 `json:"Cursors"`
+	Limit   int              `json:"Limit"` // per chat
+}
+
+type syncedChat struct {
+	ChatID   string        `json:"ChatID"`
+	Messages []ChatMessage `json:"Messages"`
+	HasMore  bool          `json:"HasMore"`
+}
+
+// handleSync sends a reconnecting device every message it missed, per chat,
+// after the given cursors. Chats the user no longer belongs to are skipped.
+func handleSync(c *Client, req *wsRequest, p syncPayload) error {
+	if len(p.Cursors) > maxSyncChats {
+		return validationError(fmt.Sprintf("At most %d chats per SYNC", maxSyncChats))
+	}
+	if p.Limit <= 0 {
+		p.Limit = defaultSyncLimit
+	}
+	if p.Limit > maxSyncLimit {
+		p.Limit = maxSyncLimit
+	}
+
+	cursors := p.Cursors
+	if len(cursors) == 0 {
+		stored, err := GetDeliveryCursors(c.UID, c.DeviceID)
+		if err != nil {
+			return internalError("Failed to sync", err)
+		}
+		cursors = stored
+	}
+
+	chats := []syncedChat{}
+	for key, after := range cursors {
+		chatID, err := requireChat(c.UID, key)
+		if err != nil {
+			continue
+		}
+		// Fetch one extra row to learn whether another SYNC is needed
+		msgs, err := GetMessagesAfter(chatID, after, p.Limit+1)
+		if err != nil {
+			return internalError("Failed to sync", err)
+		}
+		hasMore := len(msgs) > p.Limit
+		if hasMore {
+			msgs = msgs[:p.Limit]
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		chats = append(chats, syncedChat{ChatID: chatID, Messages: msgs, HasMore: hasMore})
+	}
+
+	c.reply(req, "SYNC_RESULT", map[string]interface{}{"Chats": chats})
+	return nil
+}
+
+// handleAckDelivery records how far this device has received a chat, so a
+// later SYNC without cursors resumes from there.
+func handleAckDelivery(c *Client, req *wsRequest, p struct {
+	ChatID string `json:"ChatID"`
+	Seq    int64  `json:"Seq"`
+}) error {
+	if p.ChatID == "" || p.Seq <= 0 {
+		return requiredError("ChatID", "Seq")
+	}
+	chatID, err := requireChat(c.UID, p.ChatID)
+	if err != nil {
+		return err
+	}
+	if err := MarkDelivered(c.UID, c.DeviceID, chatID, p.Seq); err != nil {
+		return internalError("Failed to record delivery", err)
+	}
+	return nil
+}
+
+func handleMarkChatRead(c *Client, req *wsRequest, p struct {
+	ChatID string `json:"ChatID"`
+	Seq    int64  `json:"Seq"`
+}) error {
+	if p.ChatID == "" {
+		return requiredError("ChatID")
+	}
+	if p.Seq < 0 {
+		return validationError("Invalid Seq", FieldError{"Seq", "Must not be negative"})
+	}
+	chatID, err := requireChat(c.UID, p.ChatID)
+	if err != nil {
+		return err
+	}
+	seq, advanced, err := MarkChatRead(c.UID, chatID, p.Seq)
+	if err != nil {
+		return internalError("Failed to mark chat read", err)
+	}
+	// Re-reading older messages changes nothing, so nothing is broadcast
+	if advanced {
+		c.hub.PublishToRoom(chatID, encodeEvent("MESSAGE_READ", map[string]interface{}{
+			"ChatID": chatID,
+			"UserID": c.UID,
+			"Seq":    seq,
+			"ReadAt": time.Now().UTC(),
+		}))
+	}
+	return nil
+}
+
+func handleGetReadState(c *Client, req *wsRequest, p struct {
+	ChatID string `json:"ChatID"`
+}) error {
+	if p.ChatID == "" {
+		return requiredError("ChatID")
+	}
+	chatID, err := requireChat(c.UID, p.ChatID)
+	if err != nil {
+		return err
+	}
+	markers, err := GetReadMarkers(chatID)
+	if err != nil {
+		return internalError("Failed to get read state", err)
+	}
+	c.reply(req, "READ_STATE", map[string]interface{}{"ChatID": chatID, "Readers": markers})
+	return nil
+}
+
+const (
+	maxSearchQueryLength = 200
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 50
+)
+
+// handleSearchMessages runs a full-text search over the chats the caller
+// belongs to. Hits carry ChatID and MessageID so the client can open the
+// chat with GET_CHAT_HISTORY Around the hit.
+func handleSearchMessages(c *Client, req *wsRequest, p struct {
+	Query  string `json:"Query"`
+	ChatID string `json:"ChatID"` // optional: search one chat
+	Before string `json:"Before"` // optional: MessageID of the last hit of the previous page
+	Limit  int    `json:"Limit"`
+}) error {
+	p.Query = strings.TrimSpace(p.Query)
+	if p.Query == "" {
+		return requiredError("Query")
+	}
+	if len(p.Query) > maxSearchQueryLength {
+		return validationError("Invalid Query", FieldError{"Query", fmt.Sprintf("At most %d characters", maxSearchQueryLength)})
+	}
+	if p.Before != "" && !uuidPattern.MatchString(p.Before) {
+		return validationError("Invalid cursor", FieldError{"Before", "Must be a MessageID"})
+	}
+	if p.Limit <= 0 {
+		p.Limit = defaultSearchLimit
+	}
+	if p.Limit > maxSearchLimit {
+		p.Limit = maxSearchLimit
+	}
+	if p.ChatID != "" {
+		chatID, err := requireChat(c.UID, p.ChatID)
+		if err != nil {
+			return err
+		}
+		p.ChatID = chatID
+	}
+
+	hits, hasMore, err := SearchMessages(c.UID, p.Query, p.ChatID, p.Before, p.Limit)
+	if err != nil {
+		return internalError("Failed to search messages", err)
+	}
+	result := map[string]interface{}{"Query": p.Query, "Results": hits, "HasMore": hasMore}
+	if hasMore {
+		result["NextCursor"] = hits[len(hits)-1].MessageID
+	}
+	c.reply(req, "MESSAGE_SEARCH_RESULTS", result)
+	return nil
+}
+
+type typingPayload struct {
+	ChatID string `json:"ChatID"`
+}
+
+// requireTypingAccess allows typing in a chat the client has joined and
+// returns its room ID. Joined rooms were membership-checked on join, so
+// frequent typing events skip the database unless a DM pair key needs
+// resolving.
+func requireTypingAccess(c *Client, chatID string) (string, error) {
+	if chatID == "" {
+		return "", requiredError("ChatID")
+	}
+	if _, _, isDM := parseDMChatId(chatID); isDM {
+		roomID, err := requireChat(c.UID, chatID)
+		if err != nil {
+			return "", err
+		}
+		chatID = roomID
+	}
+	if !c.hub.InRoom(chatID, c) {
+		return "", forbiddenError("Join the chat first")
+	}
+	return chatID, nil
+}
+
+func handleTypingStart(c *Client, req *wsRequest, p typingPayload) error {
+	chatID, err := requireTypingAccess(c, p.ChatID)
+	if err != nil {
+		return err
+	}
+	c.hub.StartTyping(chatID, c.UID)
+	return nil
+}
+
+func handleTypingStop(c *Client, req *wsRequest, p typingPayload) error {
+	chatID, err := requireTypingAccess(c, p.ChatID)
+	if err != nil {
+		return err
+	}
+	c.hub.StopTyping(chatID, c.UID)
+	return nil
+}
+
+func handleGetDMs(c *Client, req *wsRequest, _ noPayload) error {
+	dms, err := GetDMsForUser(c.UID)
+	if err != nil {
+		return internalError("Failed to get DMs", err)
+	}
+	c.reply(req, "DMS_LIST", dms)
+	return nil
+}
+
+func handleGetDMMessages(c *Client, req *wsRequest, p struct {
+	OtherUserID string `json:"OtherUserID"`
+	historyQuery
+}) error {
+	if p.OtherUserID == "" {
+		return requiredError("OtherUserID")
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	roomID, err := requireChat(c.UID, generateDMChatId(c.UID, p.OtherUserID))
+	if err != nil {
+		if asAPIError(err).Code != CodeNotFound {
+			return err
+		}
+		// Nothing was sent yet
+		replyHistory(c, req, "DM_MESSAGES", historyPage{Messages: []ChatMessage{}})
+		return nil
+	}
+	page, err := loadHistory(roomID, p.historyQuery)
+	if err != nil {
+		return err
+	}
+	replyHistory(c, req, "DM_MESSAGES", page)
+	return nil
+}
+
+func handleGetDMRequests(c *Client, req *wsRequest, _ noPayload) error {
+	requests, err := GetDMRequests(c.UID)
+	if err != nil {
+		return internalError("Failed to get message requests", err)
+	}
+	c.reply(req, "DM_REQUESTS", requests)
+	return nil
+}
+
+type dmRequestPayload struct {
+	ChatID string `json:"ChatID"` // room ID or DM pair key
+}
+
+func handleAcceptDMRequest(c *Client, req *wsRequest, p dmRequestPayload) error {
+	roomID, requester, err := respondToDMRequest(c, p.ChatID, DMAccepted)
+	if err != nil {
+		return err
+	}
+	acceptDM(c.hub, roomID, c.UID, requester)
+	return nil
+}
+
+// handleDeclineDMRequest hides a request from the recipient. The sender isn't
+// told until they try to write again.
+func handleDeclineDMRequest(c *Client, req *wsRequest, p dmRequestPayload) error {
+	_, _, err := respondToDMRequest(c, p.ChatID, DMDeclined)
+	return err
+}
+
+// respondToDMRequest resolves chatID and settles the request c received in
+// it, returning the room and the requester.
+func respondToDMRequest(c *Client, chatID string, status DMStatus) (string, string, error) {
+	if chatID == "" {
+		return "", "", requiredError("ChatID")
+	}
+	if _, _, isDM := parseDMChatId(chatID); isDM {
+		room, found, err := GetDMRoom(chatID)
+		if err != nil {
+			return "", "", internalError("Failed to find message request", err)
+		}
+		if !found {
+			return "", "", notFoundError("Message request not found")
+		}
+		chatID = room.ID
+	}
+	requester, err := RespondToDMRequest(chatID, c.UID, status)
+	if errors.Is(err, ErrDMRequestNotFound) {
+		return "", "", notFoundError("Message request not found")
+	}
+	if err != nil {
+		return "", "", internalError("Failed to answer message request", err)
+	}
+	return chatID, requester, nil
+}
+
+// maxReactionLength bounds an emoji, including modifiers and ZWJ sequences.
+const maxReactionLength = 32
+
+type messagePayload struct {
+	MessageID string `json:"MessageID"`
+}
+
+// requireMessageAccess locates a message and checks the caller can still see
+// its chat.
+func requireMessageAccess(c *Client, messageID string) (MessageRef, error) {
+	if messageID == "" {
+		return MessageRef{}, requiredError("MessageID")
+	}
+	ref, err := GetMessageRef(messageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return ref, notFoundError("Message not found")
+	}
+	if err != nil {
+		return ref, internalError("Failed to load message", err)
+	}
+	return ref, requireChatAccess(c.UID, ref.ChatID)
+}
+
+func handleEditMessage(c *Client, req *wsRequest, p struct {
+	MessageID string `json:"MessageID"`
+	Content   string `json:"Content"`
+}) error {
+	if strings.TrimSpace(p.Content) == "" {
+		return requiredError("Content")
+	}
+	ref, err := requireMessageAccess(c, p.MessageID)
+	if err != nil {
+		return err
+	}
+	if ref.SenderID != c.UID {
+		return forbiddenError("Only the sender can edit a message")
+	}
+	if ref.Deleted {
+		return conflictError("Message was deleted")
+	}
+
+	if err := EditMessage(p.MessageID, c.UID, p.Content); errors.Is(err, ErrMessageNotFound) {
+		return conflictError("Message was deleted")
+	} else if err != nil {
+		return internalError("Failed to edit message", err)
+	}
+	msg, err := GetMessage(p.MessageID, ref.ChatID)
+	if err != nil {
+		return internalError("Failed to edit message", err)
+	}
+	c.hub.PublishToRoom(ref.ChatID, encodeEvent("MESSAGE_EDITED", msg))
+	return nil
+}
+
+func handleGetMessageEdits(c *Client, req *wsRequest, p messagePayload) error {
+	if _, err := requireMessageAccess(c, p.MessageID); err != nil {
+		return err
+	}
+	edits, err := GetMessageEdits(p.MessageID)
+	if err != nil {
+		return internalError("Failed to get edit history", err)
+	}
+	c.reply(req, "MESSAGE_EDITS", map[string]interface{}{"MessageID": p.MessageID, "Edits": edits})
+	return nil
+}
+
+// handleDeleteMessage leaves a tombstone in party chats and DMs alike.
+// DELETE_DM_MESSAGE is the older name for the same event.
+func handleDeleteMessage(c *Client, req *wsRequest, p messagePayload) error {
+	ref, err := requireMessageAccess(c, p.MessageID)
+	if err != nil {
+		return err
+	}
+	if ref.Deleted {
+		return nil
+	}
+
+	ref, err = DeleteMessage(p.MessageID, c.UID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return forbiddenError("Not allowed to delete this message")
+	}
+	if err != nil {
+		return internalError("Failed to delete message", err)
+	}
+	c.hub.PublishToRoom(ref.ChatID, encodeEvent("MESSAGE_DELETED", map[string]interface{}{
+		"MessageID": p.MessageID,
+		"ChatID":    ref.ChatID,
+		"Seq":       ref.Seq,
+	}))
+	return nil
+}
+
+func handleReactToMessage(c *Client, req *wsRequest, p struct {
+	MessageID string `json:"MessageID"`
+	Emoji     string `json:"Emoji"`
+	Remove    bool   `json:"Remove"`
+}) error {
+	if p.Emoji == "" || len(p.Emoji) > maxReactionLength || strings.IndexFunc(p.Emoji, unicode.IsSpace) >= 0 {
+		return validationError("Invalid Emoji", FieldError{"Emoji", fmt.Sprintf("A single emoji of at most %d bytes", maxReactionLength)})
+	}
+	ref, err := requireMessageAccess(c, p.MessageID)
+	if err != nil {
+		return err
+	}
+	if ref.Deleted {
+		return conflictError("Message was deleted")
+	}
+
+	if err := SetReaction(p.MessageID, c.UID, p.Emoji, !p.Remove); err != nil {
+		return internalError("Failed to react", err)
+	}
+	reactions, err := GetReactions(p.MessageID)
+	if err != nil {
+		return internalError("Failed to react", err)
+	}
+	c.hub.PublishToRoom(ref.ChatID, encodeEvent("REACTION_UPDATED", map[string]interface{}{
+		"MessageID": p.MessageID,
+		"ChatID":    ref.ChatID,
+		"Reactions": reactions,
+	}))
+	return nil
+}
+
+// ==========================================
+// PARTIES
+// ==========================================
+
+// createPartyPayload is what clients send for CREATE_PARTY. StartTime is a
+// string because clients send several timestamp formats.
+type createPartyPayload struct {
+	ID                 string   `json:"ID"`
+	Title              string   `json:"Title"`
+	Description        string   `json:"Description"`
+	StartTime          string   `json:"StartTime"`
+	DurationHours      *float64 `json:"DurationHours"`
+	Status             string   `json:"Status"`
+	Address            string   `json:"Address"`
+	City               string   `json:"City"`
+	PartyPhotos        []string `json:"PartyPhotos"`
+	VibeTags           []string `json:"VibeTags"`
+	Rules              []string `json:"Rules"`
+	ChatRoomID         string   `json:"ChatRoomID"`
+	Thumbnail          string   `json:"Thumbnail"`
+	GeoLat             float64  `json:"GeoLat"`
+	GeoLon             float64  `json:"GeoLon"`
+	MaxCapacity        float64  `json:"MaxCapacity"`
+	AutoLockOnFull     bool     `json:"AutoLockOnFull"`
+	IsLocationRevealed bool     `json:"IsLocationRevealed"`
+}
+
+var partyTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05.000Z",
+	"2006-01-02T15:04:05Z",
+	"2006-01-02 15:04:05",
+}
+
+func parsePartyTime(s string) time.Time {
+	for _, layout := range partyTimeFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (cp createPartyPayload) toParty() Party {
+	p := Party{
+		ID:                 cp.ID,
+		Title:              cp.Title,
+		Description:        cp.Description,
+		Status:             PartyStatus(cp.Status),
+		Address:            cp.Address,
+		City:               cp.City,
+		PartyPhotos:        cp.PartyPhotos,
+		VibeTags:           cp.VibeTags,
+		Rules:              cp.Rules,
+		ChatRoomID:         cp.ChatRoomID,
+		Thumbnail:          cp.Thumbnail,
+		GeoLat:             cp.GeoLat,
+		GeoLon:             cp.GeoLon,
+		MaxCapacity:        int(cp.MaxCapacity),
+		AutoLockOnFull:     cp.AutoLockOnFull,
+		IsLocationRevealed: cp.IsLocationRevealed,
+	}
+	if cp.StartTime != "" {
+		p.StartTime = parsePartyTime(cp.StartTime)
+	}
+	// Duration only applies once there is a start time; default 2 hours
+	if !p.StartTime.IsZero() {
+		p.DurationHours = 2
+		if cp.DurationHours != nil {
+			p.DurationHours = int(*cp.DurationHours)
+		}
+	}
+	return p
+}
+
+func validateNewParty(p Party) []FieldError {
+	var errs []FieldError
+	if p.Title == "" {
+		errs = append(errs, FieldError{"Title", "Title is required"})
+	}
+	if p.StartTime.IsZero() {
+		errs = append(errs, FieldError{"StartTime", "Start time is required"})
+	}
+	if p.ChatRoomID == "" {
+		errs = append(errs, FieldError{"ChatRoomID", "Chat room ID is required"})
+	}
+	if len(p.PartyPhotos) == 0 {
+		errs = append(errs, FieldError{"PartyPhotos", "At least one photo is required"})
+	}
+	if p.Address == "" {
+		errs = append(errs, FieldError{"Address", "Address is required"})
+	}
+	if p.City == "" {
+		errs = append(errs, FieldError{"City", "City is required"})
+	}
+	if p.MaxCapacity <= 0 {
+		errs = append(errs, FieldError{"MaxCapacity", "Max capacity must be greater than 0"})
+	}
+	return errs
+}
+
+func handleCreateParty(c *Client, req *wsRequest, cp createPartyPayload) error {
+	p := cp.toParty()
+	log.Printf("CREATE_PARTY received - Title: %q, StartTime: %q, ChatRoomID: %q, MaxCapacity: %v",
+		p.Title, p.StartTime, p.ChatRoomID, p.MaxCapacity)
+
+	if errs := validateNewParty(p); len(errs) > 0 {
+		return validationError("Validation failed", errs...)
+	}
+
+	p.HostID = c.UID
+	now := time.Now()
+	p.CreatedAt = &now
+	p.UpdatedAt = &now
+
+	// Auto-extrapolate address/city from coordinates if using "My Location"
+	if p.GeoLat != 0 && p.GeoLon != 0 && (p.Address == "MY CURRENT LOCATION" || p.City == "DETECTED ON PUBLISH") {
+		if addr, city, err := ReverseGeocode(p.GeoLat, p.GeoLon); err == nil {
+			if p.Address == "MY CURRENT LOCATION" {
+				p.Address = addr
+			}
+			if p.City == "DETECTED ON PUBLISH" {
+				p.City = city
+			}
+		}
+	}
+
+	id, err := CreateParty(p)
+	if err != nil {
+		return internalError("Failed to create party", err)
+	}
+	p.ID = id
+
+	c.reply(req, "PARTY_CREATED", p)
+
+	// Also send the new ChatRoom to the creator immediately
+	if newRoom, err := GetChatRoom(p.ChatRoomID); err == nil {
+		c.reply(req, "NEW_CHAT_ROOM", newRoom)
+	}
+
+	c.hub.broadcastGlobal(encodeEvent("NEW_PARTY", p))
+	return nil
+}
+
+func handleUpdateParty(c *Client, req *wsRequest, p Party) error {
+	existing, err := GetParty(p.ID)
+	if err != nil || existing.HostID != c.UID {
+		return forbiddenError("Not authorized to edit this party")
+	}
+
+	// Preserve host ID and created time
+	p.HostID = existing.HostID
+	p.CreatedAt = existing.CreatedAt
+	now := time.Now()
+	p.UpdatedAt = &now
+
+	if err := UpdateParty(p); err != nil {
+		return internalError("Failed to update party", err)
+	}
+
+	updated, _ := GetParty(p.ID)
+	c.reply(req, "PARTY_UPDATED", updated)
+	return nil
+}
+
+func handleDeleteParty(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	p, err := GetParty(pp.PartyID)
+	if err != nil {
+		log.Printf("DELETE_PARTY: Failed to get party: %v", err)
+		return notFoundError("Party not found")
+	}
+	if p.HostID != c.UID {
+		log.Printf("DELETE_PARTY: Permission denied - user %s is not host %s", c.UID, p.HostID)
+		return forbiddenError("Not authorized to delete this party")
+	}
+
+	if err := DeleteParty(pp.PartyID); err != nil {
+		return internalError("Failed to delete party", err)
+	}
+
+	// Kick people out of the room, remove the party from feeds, and confirm to the host
+	payload := map[string]string{
+		"PartyID":    pp.PartyID,
+		"ChatRoomID": p.ChatRoomID,
+	}
+	deletion := encodeEvent("PARTY_DELETED", payload)
+	c.hub.PublishToRoom(p.ChatRoomID, deletion)
+	c.hub.broadcastGlobal(deletion)
+	c.reply(req, "PARTY_DELETED", payload)
+	return nil
+}
+
+func handleUpdatePartyStatus(c *Client, req *wsRequest, p struct {
+	PartyID string `json:"PartyID"`
+	Status  string `json:"Status"`
+}) error {
+	if p.PartyID == "" || p.Status == "" {
+		return requiredError("PartyID", "Status")
+	}
+
+	party, err := GetParty(p.PartyID)
+	if err != nil || party.HostID != c.UID {
+		return forbiddenError("Not authorized to update status")
+	}
+
+	if err := UpdatePartyStatus(p.PartyID, PartyStatus(p.Status)); err != nil {
+		return internalError("Failed to update status", err)
+	}
+
+	updated, _ := GetParty(p.PartyID)
+	c.reply(req, "PARTY_STATUS_UPDATED", updated)
+
+	// Broadcast status change to party room
+	if updated.ChatRoomID != "" {
+		c.hub.PublishToRoom(updated.ChatRoomID, encodeEvent("PARTY_STATUS_UPDATED", updated))
+	}
+	return nil
+}
+
+func handleGetPartyDetails(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	p, err := GetParty(pp.PartyID)
+	if err != nil {
+		return notFoundError("Party not found")
+	}
+	c.reply(req, "PARTY_DETAILS", p)
+	return nil
+}
+
+func handleGetPartyAnalytics(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	p, err := GetParty(pp.PartyID)
+	if err != nil || p.HostID != c.UID {
+		return forbiddenError("Not authorized to view analytics")
+	}
+
+	analytics, err := GetPartyAnalytics(pp.PartyID)
+	if err != nil {
+		return internalError("Failed to get analytics", err)
+	}
+	c.reply(req, "PARTY_ANALYTICS", analytics)
+	return nil
+}
+
+func handleGetMyParties(c *Client, req *wsRequest, _ noPayload) error {
+	parties, err := GetMyParties(c.UID)
+	if err != nil {
+		return internalError("Failed to get your parties", err)
+	}
+	c.reply(req, "MY_PARTIES", parties)
+	return nil
+}
+
+func handleGetFeed(c *Client, req *wsRequest, loc struct {
+	Lat      float64 `json:"Lat"`
+	Lon      float64 `json:"Lon"`
+	RadiusKm float64 `json:"RadiusKm"`
+}) error {
+	if loc.RadiusKm <= 0 {
+		loc.RadiusKm = 50.0
+	}
+
+	// Simple bounding box: 1 degree lat ~= 111km, lon roughly estimated for mid-latitudes
+	latDelta := loc.RadiusKm / 111.0
+	lonDelta := loc.RadiusKm / (111.0 * 0.7)
+
+	query := `
+		SELECT id, host_id, title, description, party_photos, start_time, duration_hours, status,
+		       is_location_revealed, address, city, geo_lat, geo_lon, max_capacity,
+		       current_guest_count, auto_lock_on_full, vibe_tags, rules, chat_room_id,
+		       created_at, updated_at, thumbnail
+		FROM parties
+		WHERE status = 'OPEN'
+		  AND host_id != $1
+		  AND id NOT IN (SELECT party_id FROM party_applications WHERE user_id = $1)
+		  AND host_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = $1)
+		  AND host_id NOT IN (SELECT blocker_id FROM blocked_users WHERE blocked_id = $1)
+	`
+
+	var rows pgx.Rows
+	var err error
+	if loc.Lat != 0 || loc.Lon != 0 {
+		query += ` AND geo_lat BETWEEN $2 AND $3 AND geo_lon BETWEEN $4 AND $5 ORDER BY created_at DESC LIMIT 50`
+		rows, err = db.Query(context.Background(), query,
+			c.UID,
+			loc.Lat-latDelta, loc.Lat+latDelta,
+			loc.Lon-lonDelta, loc.Lon+lonDelta)
+	} else {
+		query += ` ORDER BY created_at DESC LIMIT 50`
+		rows, err = db.Query(context.Background(), query, c.UID)
+	}
+	if err != nil {
+		return internalError("Failed to get feed", err)
+	}
+	defer rows.Close()
+
+	var parties []Party
+	for rows.Next() {
+		var p Party
+		err := rows.Scan(
+			&p.ID, &p.HostID, &p.Title, &p.Description, &p.PartyPhotos, &p.StartTime, &p.DurationHours,
+			&p.Status, &p.IsLocationRevealed, &p.Address, &p.City, &p.GeoLat, &p.GeoLon,
+			&p.MaxCapacity, &p.CurrentGuestCount, &p.AutoLockOnFull, &p.VibeTags,
+			&p.Rules, &p.ChatRoomID, &p.CreatedAt, &p.UpdatedAt, &p.Thumbnail,
+		)
+		if err != nil {
+			log.Printf("Feed Scan Error: %v", err)
+			continue
+		}
+		parties = append(parties, p)
+	}
+
+	c.reply(req, "FEED_UPDATE", parties)
+	return nil
+}
+
+func handleReverseGeocode(c *Client, req *wsRequest, coords struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}) error {
+	if coords.Lat == 0 && coords.Lon == 0 {
+		return validationError("Invalid coordinates: latitude and longitude cannot be zero")
+	}
+
+	address, city, err := ReverseGeocode(coords.Lat, coords.Lon)
+	if err != nil {
+		return internalError("Failed to reverse geocode", err)
+	}
+
+	c.reply(req, "GEOCODE_RESULT", map[string]string{
+		"address": address,
+		"city":    city,
+		"lat":     fmt.Sprintf("%f", coords.Lat),
+		"lon":     fmt.Sprintf("%f", coords.Lon),
+	})
+	return nil
+}
+
+// ==========================================
+// APPLICATIONS AND MATCHING
+// ==========================================
+
+func handleSwipe(c *Client, req *wsRequest, p struct {
+	PartyID   string `json:"PartyID"`
+	Direction string `json:"Direction"`
+}) error {
+	if p.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	status := "PENDING"
+	if p.Direction == "left" {
+		status = "DECLINED"
+	}
+
+	query := `INSERT INTO party_applications (party_id, user_id, status)
+			  VALUES ($1, $2, $3) ON CONFLICT (party_id, user_id)
+			  DO UPDATE SET status = $3`
+	if _, err := db.Exec(context.Background(), query, p.PartyID, c.UID, status); err != nil {
+		return internalError("Failed to swipe", err)
+	}
+	return nil
+}
+
+func handleApplyToParty(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	p, err := GetParty(pp.PartyID)
+	if err != nil {
+		return notFoundError("Party not found")
+	}
+	if p.Status != "OPEN" {
+		return conflictError("Party is not accepting applications")
+	}
+
+	query := `INSERT INTO party_applications (party_id, user_id, status)
+		  VALUES ($1, $2, 'PENDING') ON CONFLICT (party_id, user_id)
+		  DO UPDATE SET status = 'PENDING', applied_at = NOW()`
+	if _, err := db.Exec(context.Background(), query, pp.PartyID, c.UID); err != nil {
+		return internalError("Failed to apply to party", err)
+	}
+
+	c.reply(req, "APPLICATION_SUBMITTED", map[string]string{
+		"PartyID": pp.PartyID,
+		"Status":  "PENDING",
+	})
+	return nil
+}
+
+func handleRejectParty(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	query := `INSERT INTO party_applications (party_id, user_id, status)
+		  VALUES ($1, $2, 'DECLINED') ON CONFLICT (party_id, user_id)
+		  DO UPDATE SET status = 'DECLINED', applied_at = NOW()`
+	if _, err := db.Exec(context.Background(), query, pp.PartyID, c.UID); err != nil {
+		return internalError("Failed to reject party", err)
+	}
+
+	c.reply(req, "APPLICATION_REJECTED", map[string]string{
+		"PartyID": pp.PartyID,
+		"Status":  "DECLINED",
+	})
+	return nil
+}
+
+func handleCancelApplication(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	if err := UpdateApplicationStatus(pp.PartyID, c.UID, "DECLINED"); err != nil {
+		return internalError("Failed to cancel application", err)
+	}
+	evictFromPartyChat(c.hub, pp.PartyID, c.UID)
+
+	c.reply(req, "APPLICATION_REJECTED", map[string]string{
+		"PartyID": pp.PartyID,
+		"Status":  "DECLINED",
+	})
+	return nil
+}
+
+func handleLeaveParty(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	p, err := GetParty(pp.PartyID)
+	if err != nil {
+		return notFoundError("Party not found")
+	}
+	// The host can't leave - they can only delete
+	if p.HostID == c.UID {
+		return conflictError("Host cannot leave party, please delete instead")
+	}
+
+	if err := UpdateApplicationStatus(pp.PartyID, c.UID, "DECLINED"); err != nil {
+		return internalError("Failed to leave party", err)
+	}
+	evictFromPartyChat(c.hub, pp.PartyID, c.UID)
+
+	c.reply(req, "PARTY_LEFT", map[string]string{"PartyID": pp.PartyID})
+	return nil
+}
+
+func handleGetApplicants(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	apps, err := GetApplicantsForParty(pp.PartyID)
+	if err != nil {
+		return internalError("Failed to get applicants", err)
+	}
+
+	c.reply(req, "APPLICANTS_LIST", map[string]interface{}{
+		"PartyID":    pp.PartyID,
+		"Applicants": apps,
+	})
+	return nil
+}
+
+type applicationUpdate struct {
+	PartyID string `json:"PartyID"`
+	UserID  string `json:"UserID"`
+	Status  string `json:"Status"`
+}
+
+func handleUpdateApplication(c *Client, req *wsRequest, p applicationUpdate) error {
+	if p.PartyID == "" || p.UserID == "" {
+		return requiredError("PartyID", "UserID")
+	}
+	// Accepting a guest grants chat access, so only the host may decide
+	party, err := GetParty(p.PartyID)
+	if err != nil || party.HostID != c.UID {
+		return forbiddenError("Not authorized to update applications")
+	}
+
+	if err := UpdateApplicationStatus(p.PartyID, p.UserID, p.Status); err != nil {
+		return internalError("Failed to update application", err)
+	}
+	if p.Status != "ACCEPTED" {
+		evictFromPartyChat(c.hub, p.PartyID, p.UserID)
+	}
+
+	c.reply(req, "APPLICATION_UPDATED", p)
+
+	// Tell an accepted guest right away, with the chat room so it shows up in their list
+	if p.Status == "ACCEPTED" {
+		c.hub.PublishToUser(p.UserID, encodeEvent("APPLICATION_UPDATED", p))
+		if room, err := GetChatRoomByParty(p.PartyID); err == nil {
+			c.hub.AddToRoom(room.ID, p.UserID)
+			c.hub.PublishToUser(p.UserID, encodeEvent("NEW_CHAT_ROOM", room))
+		}
+	}
+	return nil
+}
+
+func handleGetMatchedUsers(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	p, err := GetParty(pp.PartyID)
+	if err != nil || p.HostID != c.UID {
+		return forbiddenError("Not authorized to view matched users")
+	}
+
+	apps, err := GetAcceptedApplicants(pp.PartyID)
+	if err != nil {
+		return internalError("Failed to get matched users", err)
+	}
+	c.reply(req, "MATCHED_USERS", apps)
+	return nil
+}
+
+func handleUnmatchUser(c *Client, req *wsRequest, p struct {
+	PartyID string `json:"PartyID"`
+	UserID  string `json:"UserID"`
+}) error {
+	if p.PartyID == "" || p.UserID == "" {
+		return requiredError("PartyID", "UserID")
+	}
+
+	party, err := GetParty(p.PartyID)
+	if err != nil || party.HostID != c.UID {
+		return forbiddenError("Not authorized to unmatch users")
+	}
+
+	if err := UpdateApplicationStatus(p.PartyID, p.UserID, "DECLINED"); err != nil {
+		return internalError("Failed to unmatch user", err)
+	}
+	evictFromPartyChat(c.hub, p.PartyID, p.UserID)
+
+	c.reply(req, "USER_UNMATCHED", map[string]string{
+		"PartyID": p.PartyID,
+		"UserID":  p.UserID,
+	})
+	return nil
+}
+
+// ==========================================
+// FUNDRAISING
+// ==========================================
+
+func handleAddContribution(c *Client, req *wsRequest, p struct {
+	PartyID string  `json:"PartyID"`
+	Amount  float64 `json:"Amount"`
+}) error {
+	if p.PartyID == "" || p.Amount <= 0 {
+		return validationError("Invalid contribution amount")
+	}
+
+	contrib := Contribution{
+		UserID: c.UID,
+		Amount: p.Amount,
+		PaidAt: time.Now(),
+	}
+	if err := AddContribution(p.PartyID, contrib); err != nil {
+		return internalError("Failed to add contribution", err)
+	}
+
+	// Send the updated pool to the contributor and the party room
+	if pool, err := GetRotationPool(p.PartyID); err == nil {
+		c.reply(req, "FUNDRAISER_UPDATED", pool)
+		if party, _ := GetParty(p.PartyID); party.ChatRoomID != "" {
+			c.hub.PublishToRoom(party.ChatRoomID, encodeEvent("FUNDRAISER_UPDATED", pool))
+		}
+	}
+	return nil
+}
+
+func handleGetFundraiserState(c *Client, req *wsRequest, pp partyPayload) error {
+	if pp.PartyID == "" {
+		return requiredError("PartyID")
+	}
+
+	pool, err := GetRotationPool(pp.PartyID)
+	if err != nil {
+		// Return empty pool if not found
+		pool = Crowdfunding{
+			PartyID:  pp.PartyID,
+			Currency: "USD",
+			IsFunded: false,
+		}
+	}
+	c.reply(req, "FUNDRAISER_STATE", pool)
+	return nil
+}
+
+// ==========================================
+// PROFILE AND SAFETY
+// ==========================================
+
+func handleGetUser(c *Client, req *wsRequest, _ noPayload) error {
+	u, err := GetUser(c.UID)
+	if err != nil {
+		return internalError("Failed to get profile", err)
+	}
+	c.reply(req, "PROFILE_UPDATED", u)
+	return nil
+}
+
+func handleUpdateProfile(c *Client, req *wsRequest, u User) error {
+	// Users may only update their own profile, and never server-owned fields
+	u.ID = c.UID
+	clearServerOwnedFields(&u)
+
+	if err := UpdateUser(u); err != nil {
+		return internalError("Failed to update profile", err)
+	}
+
+	// Echo the stored row so clients see server-owned values, not their own payload
+	if stored, err := GetUser(c.UID); err == nil {
+		u = stored
+	}
+	c.reply(req, "PROFILE_UPDATED", u)
+	return nil
+}
+
+func handleDeleteUser(c *Client, req *wsRequest, p userPayload) error {
+	// Only allow users to delete their own account
+	if p.UserID != c.UID {
+		return forbiddenError("Not authorized to delete this user")
+	}
+
+	if err := DeleteUser(p.UserID); err != nil {
+		return internalError("Failed to delete user", err)
+	}
+	c.reply(req, "USER_DELETED", map[string]string{"UserID": p.UserID})
+	return nil
+}
+
+func handleSearchUsers(c *Client, req *wsRequest, p struct {
+	Query string `json:"Query"`
+	Limit int    `json:"Limit"`
+}) error {
+	if p.Query == "" {
+		return requiredError("Query")
+	}
+
+	users, err := SearchUsers(p.Query, p.Limit)
+	if err != nil {
+		return internalError("Failed to search users", err)
+	}
+	c.reply(req, "USERS_SEARCH_RESULTS", users)
+	return nil
+}
+
+func handleBlockUser(c *Client, req *wsRequest, p userPayload) error {
+	if p.UserID == "" || p.UserID == c.UID {
+		return validationError("Invalid user", FieldError{"UserID", "Cannot block yourself or an empty user"})
+	}
+
+	if err := BlockUser(c.UID, p.UserID); err != nil {
+		return internalError("Failed to block user", err)
+	}
+	if roomID, err := GetDMRoomID(generateDMChatId(c.UID, p.UserID)); err == nil && roomID != "" {
+		c.hub.EvictFromRoom(roomID, c.UID, p.UserID)
+	}
+	c.reply(req, "USER_BLOCKED", map[string]string{"UserID": p.UserID})
+	return nil
+}
+
+func handleUnblockUser(c *Client, req *wsRequest, p userPayload) error {
+	if p.UserID == "" {
+		return requiredError("UserID")
+	}
+
+	if err := UnblockUser(c.UID, p.UserID); err != nil {
+		return internalError("Failed to unblock user", err)
+	}
+	// Rejoin the DM room unless the other side still blocks this user
+	if roomID, err := GetDMRoomID(generateDMChatId(c.UID, p.UserID)); err == nil && roomID != "" {
+		if ok, _ := CanAccessChat(c.UID, roomID); ok {
+			c.hub.AddToRoom(roomID, c.UID, p.UserID)
+		}
+	}
+	c.reply(req, "USER_UNBLOCKED", map[string]string{"UserID": p.UserID})
+	return nil
+}
+
+func handleSetDMPrivacy(c *Client, req *wsRequest, p struct {
+	DMPrivacy DMPrivacy `json:"DMPrivacy"`
+}) error {
+	switch p.DMPrivacy {
+	case DMPrivacyEveryone, DMPrivacyParties, DMPrivacyNobody:
+	case "":
+		return requiredError("DMPrivacy")
+	default:
+		return validationError("Invalid DMPrivacy", FieldError{"DMPrivacy", "One of EVERYONE, PARTIES, NOBODY"})
+	}
+	if err := SetDMPrivacy(c.UID, p.DMPrivacy); err != nil {
+		return internalError("Failed to update DM privacy", err)
+	}
+	c.reply(req, "DM_PRIVACY_UPDATED", map[string]DMPrivacy{"DMPrivacy": p.DMPrivacy})
+	return nil
+}
+
+func handleGetBlockedUsers(c *Client, req *wsRequest, _ noPayload) error {
+	blockedIDs, err := GetBlockedUsers(c.UID)
+	if err != nil {
+		return internalError("Failed to get blocked users", err)
+	}
+	c.reply(req, "BLOCKED_USERS_LIST", blockedIDs)
+	return nil
+}
+
+func handleReportUser(c *Client, req *wsRequest, p reportPayload) error {
+	if p.UserID == "" || p.Reason == "" {
+		return requiredError("UserID", "Reason")
+	}
+
+	if err := ReportUser(c.UID, p.UserID, p.Reason, p.Details); err != nil {
+		return internalError("Failed to submit report", err)
+	}
+	c.reply(req, "USER_REPORTED", map[string]string{"UserID": p.UserID})
+	return nil
+}
+
+func handleReportParty(c *Client, req *wsRequest, p reportPayload) error {
+	if p.PartyID == "" || p.Reason == "" {
+		return requiredError("PartyID", "Reason")
+	}
+
+	if err := ReportParty(c.UID, p.PartyID, p.Reason, p.Details); err != nil {
+		return internalError("Failed to submit report", err)
+	}
+	c.reply(req, "PARTY_REPORTED", map[string]string{"PartyID": p.PartyID})
+	return nil
+}
+
+// ==========================================
+// NOTIFICATIONS
+// ==========================================
+
+func handleGetNotifications(c *Client, req *wsRequest, _ noPayload) error {
+	notifs, err := GetNotifications(c.UID, 20)
+	if err != nil {
+		return internalError("Failed to get notifications", err)
+	}
+	c.reply(req, "NOTIFICATIONS_LIST", notifs)
+	return nil
+}
+
+func handleMarkNotificationRead(c *Client, req *wsRequest, p struct {
+	NotificationID string `json:"NotificationID"`
+}) error {
+	if p.NotificationID == "" {
+		return requiredError("NotificationID")
+	}
+
+	if err := MarkNotificationRead(p.NotificationID, c.UID); err != nil {
+		return internalError("Failed to mark notification read", err)
+	}
+	c.reply(req, "NOTIFICATION_MARKED_READ", map[string]string{"NotificationID": p.NotificationID})
+	return nil
+}
+
+func handleMarkAllNotificationsRead(c *Client, req *wsRequest, _ noPayload) error {
+	if err := MarkAllNotificationsRead(c.UID); err != nil {
+		return internalError("Failed to mark notifications read", err)
+	}
+	c.reply(req, "ALL_NOTIFICATIONS_MARKED_READ", map[string]string{"status": "success"})
+	return nil
+}
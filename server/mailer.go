@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers transactional email such as password resets and
+// verification links.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// mailer is the process-wide sender, configured in main via NewMailerFromEnv.
+var mailer Mailer = &LogMailer{}
+
+// NewMailerFromEnv returns an SMTPMailer when SMTP_HOST is set, otherwise a
+// LogMailer that writes to MAIL_LOG_FILE (or the server log).
+func NewMailerFromEnv() Mailer {
+	if host := getEnv("SMTP_HOST", ""); host != "" {
+		return &SMTPMailer{
+			Host:     host,
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("MAIL_FROM", "no-reply@waterparty.app"),
+		}
+	}
+	return &LogMailer{Path: getEnv("MAIL_LOG_FILE", "")}
+}
+
+// SMTPMailer sends mail through an SMTP relay, using STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	msg := buildMessage(m.From, to, subject, body)
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer appends messages to a file, or logs them when Path is empty.
+// It is meant for local development and tests.
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	msg := buildMessage("no-reply@waterparty.app", to, subject, body)
+	if m.Path == "" {
+		log.Printf("📧 Mail to %s:\n%s", to, msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(msg + "\n\n")
+	return err
+}
+
+func buildMessage(from, to, subject, body string) string {
+	// Strip CR/LF so user-controlled values cannot inject headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	return fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		clean.Replace(from), clean.Replace(to), clean.Replace(subject), time.Now().Format(time.RFC1123Z), body)
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -30,35 +34,57 @@ func main() {
 	InitDB(connStr)
 	log.Println("✅ Database connection pool established")
 
+	mailer = NewMailerFromEnv()
+	if err := LoadOIDCProviders(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := LoadTrustedProxies(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
 	// 3. Initialize and start the WebSocket Hub
-	hub := NewHub()
+	backplane, err := NewBackplaneFromEnv()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	hub := NewHubWithBackplane(backplane)
 	go hub.Run()
 	log.Println("✅ WebSocket Hub started (Room-based routing enabled)")
 
 	// 4. Wrap handlers with CORS middleware
 	http.HandleFunc("/register", corsMiddleware(handleRegister))
 	http.HandleFunc("/login", corsMiddleware(handleLogin))
-	http.HandleFunc("/upload", corsMiddleware(handleUpload))
-	http.HandleFunc("/profile", corsMiddleware(handleProfile))
+	http.HandleFunc("/login/oidc", corsMiddleware(handleOIDCLogin(hub)))
+	http.HandleFunc("/token/refresh", corsMiddleware(handleRefreshToken(hub)))
+	http.HandleFunc("/logout", corsMiddleware(authMiddleware(handleLogout(hub))))
+	http.HandleFunc("/sessions", corsMiddleware(authMiddleware(handleSessions(hub))))
+	http.HandleFunc("/password/forgot", corsMiddleware(handleForgotPassword))
+	http.HandleFunc("/password/reset", corsMiddleware(handleResetPassword(hub)))
+	http.HandleFunc("/email/verify", corsMiddleware(handleVerifyEmail))
+	http.HandleFunc("/phone/otp/request", corsMiddleware(authMiddleware(handlePhoneOTPRequest)))
+	http.HandleFunc("/phone/otp/verify", corsMiddleware(authMiddleware(handlePhoneOTPVerify)))
+	http.HandleFunc("/admin/login-attempts", corsMiddleware(authMiddleware(requireAdmin(handleLoginAttempts))))
+	http.HandleFunc("/upload", corsMiddleware(authMiddleware(handleUpload)))
+	http.HandleFunc("/profile", corsMiddleware(authMiddleware(handleProfile)))
 
 	// 5. Image/Asset Handler
 	http.HandleFunc("/assets/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		// Only allow GET requests for assets
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, r, methodNotAllowedError())
 			return
 		}
 
 		hash := strings.TrimPrefix(r.URL.Path, "/assets/")
 		if hash == "" {
-			http.Error(w, "Asset hash required", http.StatusBadRequest)
+			writeError(w, r, validationError("Asset hash required"))
 			return
 		}
 
 		// Fetch binary data directly from Postgres (database.go)
 		data, mime, err := GetAsset(hash)
 		if err != nil {
-			http.Error(w, "Asset not found", http.StatusNotFound)
+			writeError(w, r, notFoundError("Asset not found"))
 			return
 		}
 
@@ -77,10 +103,19 @@ func main() {
 
 	// 7. Health Check (Useful for Load Balancers/K8s)
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		// Fail the check while draining so the load balancer stops routing here
+		if hub.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("DRAINING"))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
+	// Hub queue depths and drop counters (Prometheus text format)
+	http.HandleFunc("/metrics", handleMetrics(hub))
+
 	// 8. Start Server with optimized timeouts
 	server := &http.Server{
 		Addr:         ":" + port,
@@ -89,10 +124,37 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	fmt.Printf("🚀 Party Ecosystem Server running on port %s\n", port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Critical server error: %v", err)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Critical server error: %v", err)
+		}
+	}()
+
+	// 9. Graceful shutdown: drain sockets and in-flight writes, then close the pool
+	<-ctx.Done()
+	stop()
+	log.Println("🛑 Shutdown signal received, draining connections")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️  WebSocket drain incomplete: %v", err)
 	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️  HTTP shutdown incomplete: %v", err)
+	}
+	if err := waitContext(shutdownCtx, backgroundWork.Wait); err != nil {
+		log.Printf("⚠️  Background work abandoned: %v", err)
+	}
+	if err := backplane.Close(); err != nil {
+		log.Printf("Backplane close error: %v", err)
+	}
+	CloseDB()
+	log.Println("✅ Shutdown complete")
 }
 
 // Helper to handle environment variables
@@ -103,27 +165,53 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// decodeRegistration reads a /register body: {"user": {...}, "password": ...}
+// with the email either top-level or inside the user. User.Email is hidden
+// from JSON, so the nested one is read separately.
+func decodeRegistration(body io.Reader) (User, string, error) {
+	var req struct {
+		User     json.RawMessage `json:"user"`
+		Email    string          `json:"email"`
+		Password string          `json:"password"`
+	}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return User{}, "", err
+	}
+
+	var u User
+	var nested struct {
+		Email string `json:"Email"`
+	}
+	if len(req.User) > 0 {
+		if err := json.Unmarshal(req.User, &u); err != nil {
+			return User{}, "", err
+		}
+		json.Unmarshal(req.User, &nested)
+	}
+	email := req.Email
+	if email == "" {
+		email = nested.Email
+	}
+	u.Email = strings.ToLower(strings.TrimSpace(email))
+	return u, req.Password, nil
+}
+
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowedError())
 		return
 	}
 
-	var req struct {
-		User     User   `json:"user"`
-		Password string `json:"password"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Registration JSON decode error: %v", err)
-		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+	u, password, err := decodeRegistration(r.Body)
+	if err != nil {
+		writeError(w, r, validationError("Invalid request"))
 		return
 	}
 
-	hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 
-	u := req.User
-	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+	clearServerOwnedFields(&u)
+	u.Role = RoleUser
 
 	// Extrapolate Age and CreatedAt
 	now := time.Now()
@@ -139,46 +227,55 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 
 	walletJSON, _ := json.Marshal(u.WalletData)
 
+	// Server-owned columns (is_verified, scores, counters) keep their defaults
 	query := `INSERT INTO users (
 		real_name, phone_number, email, password_hash, profile_photos, age, date_of_birth,
 		height_cm, gender, drinking_pref, smoking_pref,
-		top_artists, job_title, company, school, degree,
+		job_title, company, school, degree,
 		instagram_handle, linkedin_handle, x_handle, tiktok_handle,
-		is_verified, trust_score, elo_score, parties_hosted, flake_count,
-		wallet_data, location_lat, location_lon, bio, last_active_at, created_at
+		wallet_data, location_lat, location_lon, bio, created_at
 	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, 
-		$14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30) 
-	RETURNING id, last_active_at`
+		$14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24) 
+	RETURNING id`
 
-	var lastActiveAt time.Time
-	err := db.QueryRow(context.Background(), query,
+	err = db.QueryRow(context.Background(), query,
 		u.RealName, u.PhoneNumber, u.Email, string(hash), u.ProfilePhotos, u.Age, u.DateOfBirth,
 		u.HeightCm, u.Gender, u.DrinkingPref, u.SmokingPref, u.JobTitle, u.Company, u.School, u.Degree,
 		u.InstagramHandle, u.LinkedinHandle, u.XHandle, u.TikTokHandle,
-		u.IsVerified, u.TrustScore, u.EloScore, u.PartiesHosted, u.FlakeCount,
-		walletJSON, u.LocationLat, u.LocationLon, u.Bio, now, now,
-	).Scan(&u.ID, &lastActiveAt)
+		walletJSON, u.LocationLat, u.LocationLon, u.Bio, now,
+	).Scan(&u.ID)
 
 	if err != nil {
 		// Friendly message for duplicate keys
 		if strings.Contains(err.Error(), "unique constraint") || strings.Contains(err.Error(), "duplicate key") {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "User already registered"})
+			writeError(w, r, conflictError("User already registered"))
 			return
 		}
-		log.Printf("Registration error: %v", err)
-		http.Error(w, "Failed to register user", http.StatusInternalServerError)
+		writeError(w, r, internalError("Failed to register user", err))
+		return
+	}
+
+	resp, err := IssueTokens(u, r)
+	if err != nil {
+		writeError(w, r, internalError("Failed to issue session", err))
 		return
 	}
 
+	if u.Email != "" {
+		goBackground(func() {
+			if err := sendAuthTokenEmail(u, PurposeEmailVerification); err != nil {
+				log.Printf("Verification email error for %s: %v", u.ID, err)
+			}
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(u)
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowedError())
 		return
 	}
 
@@ -188,38 +285,81 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Login JSON decode error: %v", err)
-		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		writeError(w, r, validationError("Invalid request"))
 		return
 	}
 
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	ip := clientIP(r)
+	accountKey, ipKey := "acct:"+req.Email, "ip:"+ip
+
+	attempt := LoginAttempt{Email: req.Email, IPAddress: ip, UserAgent: r.UserAgent()}
+	rejectLogin := func(reason string) {
+		attempt.Reason = reason
+		if err := RecordLoginAttempt(attempt); err != nil {
+			log.Printf("Login audit error: %v", err)
+		}
+	}
+
+	// Refuse early while either the account or the address is backing off.
+	// Reserving counts this attempt as failed up front, so parallel guesses
+	// can't all slip past the check during the bcrypt comparison.
+	accountWait := loginAccountLimiter.Reserve(accountKey)
+	ipWait := loginIPLimiter.Reserve(ipKey)
+	if accountWait > 0 || ipWait > 0 {
+		if accountWait == 0 {
+			loginAccountLimiter.Refund(accountKey)
+		}
+		if ipWait == 0 {
+			loginIPLimiter.Refund(ipKey)
+		}
+		rejectLogin("rate_limited")
+		writeError(w, r, rateLimitedError("Too many login attempts, try again later", max(accountWait, ipWait)))
+		return
+	}
 
 	user, hash, err := GetUserByEmail(req.Email)
 	if err != nil {
-		log.Printf("Login lookup error for %s: %v", req.Email, err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-		return
+		// Unknown email: still pay for a bcrypt comparison so timing matches
+		hash = dummyPasswordHash()
+		if !strings.Contains(err.Error(), "no rows") {
+			log.Printf("Login lookup error: %v", err)
+		}
 	}
+	attempt.UserID = user.ID
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil || user.ID == "" {
+		if user.ID == "" {
+			rejectLogin("unknown_email")
+		} else {
+			rejectLogin("bad_password")
+		}
+		writeError(w, r, unauthorizedError("Invalid credentials"))
 		return
 	}
+	loginAccountLimiter.Reset(accountKey)
+	loginIPLimiter.Refund(ipKey)
 
 	user.PasswordHash = "" // Clear hash before sending
+
+	resp, err := IssueTokens(user, r)
+	if err != nil {
+		writeError(w, r, internalError("Failed to issue session", err))
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleProfile(w http.ResponseWriter, r *http.Request) {
+	callerID := UserIDFromContext(r.Context())
 	id := r.URL.Query().Get("id")
 	if id == "" {
-		http.Error(w, "User ID required", http.StatusBadRequest)
+		id = callerID
+	}
+	if id == "" {
+		writeError(w, r, validationError("User ID required"))
 		return
 	}
 
@@ -227,23 +367,28 @@ func handleProfile(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		user, err := GetUser(id)
 		if err != nil {
-			http.Error(w, "User not found", http.StatusNotFound)
+			writeError(w, r, notFoundError("User not found"))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(user)
 
 	case http.MethodDelete:
+		// Only the account owner or an admin may delete a profile
+		if id != callerID && UserRoleFromContext(r.Context()) != RoleAdmin {
+			writeError(w, r, forbiddenError("Forbidden"))
+			return
+		}
 		err := DeleteUser(id)
 		if err != nil {
-			http.Error(w, "Failed to delete user: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, r, internalError("Failed to delete user", err))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowedError())
 	}
 }
 
@@ -264,7 +409,7 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowedError())
 		return
 	}
 
@@ -273,18 +418,26 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Invalid file", http.StatusBadRequest)
+		writeError(w, r, validationError("Invalid file"))
 		return
 	}
 	defer file.Close()
 
-	data := make([]byte, header.Size)
-	file.Read(data)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, r, validationError("Invalid file"))
+		return
+	}
 
 	// Save original to Postgres (database.go)
-	originalHash, err := SaveAsset(data, header.Header.Get("Content-Type"))
+	uid := UserIDFromContext(r.Context())
+	originalHash, err := SaveAsset(data, sniffMIME(data, header.Header.Get("Content-Type")))
+	if err == nil {
+		// Chat messages may only reference media their sender uploaded
+		err = RecordAssetUpload(originalHash, uid)
+	}
 	if err != nil {
-		http.Error(w, "Upload failed: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError("Upload failed", err))
 		return
 	}
 
@@ -294,12 +447,8 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	// If thumbnail requested
 	if r.URL.Query().Get("thumbnail") == "true" {
-		thumbData, err := CreateThumbnail(data)
-		if err == nil {
-			thumbHash, err := SaveAsset(thumbData, "image/jpeg")
-			if err == nil {
-				response["thumbnailHash"] = thumbHash
-			}
+		if thumbHash, err := saveThumbnail(data, uid); err == nil {
+			response["thumbnailHash"] = thumbHash
 		}
 	}
 
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var assetHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// assetHash extracts the asset hash from a media URL, which clients send as a
+// bare hash, an /assets/<hash> path or a full URL. It returns "" if the last
+// path segment isn't a hash.
+func assetHash(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	hash := url[strings.LastIndex(url, "/")+1:]
+	if !assetHashPattern.MatchString(hash) {
+		return ""
+	}
+	return hash
+}
+
+// isMediaMessage reports whether a message type carries an uploaded asset.
+func isMediaMessage(t MessageType) bool {
+	return t == MsgImage || t == MsgVideo || t == MsgAudio
+}
+
+// sniffMIME prefers the content type detected from data over the one the
+// uploader declared.
+func sniffMIME(data []byte, declared string) string {
+	if sniffed := http.DetectContentType(data); sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	return declared
+}
+
+// mediaMatchesType reports whether an asset with mime and probed metadata may
+// be sent as a message of type t. Audio-only MP4 (M4A) is often detected as
+// video/mp4, so an MP4 without picture dimensions counts as audio.
+func mediaMatchesType(t MessageType, mime string, meta map[string]interface{}) bool {
+	switch t {
+	case MsgImage:
+		return strings.HasPrefix(mime, "image/")
+	case MsgVideo:
+		return strings.HasPrefix(mime, "video/")
+	case MsgAudio:
+		_, hasPicture := meta["Width"]
+		return strings.HasPrefix(mime, "audio/") || mime == "video/mp4" && !hasPicture
+	}
+	return false
+}
+
+// probeMedia reads what it can about an asset without external tools: size
+// and type always, dimensions of images and MP4 video, and the duration of MP4
+// and WAV files.
+func probeMedia(data []byte, mime string) map[string]interface{} {
+	meta := map[string]interface{}{"Size": len(data), "MimeType": mime}
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			meta["Width"], meta["Height"] = cfg.Width, cfg.Height
+		}
+	case isWAV(data):
+		if ms, ok := wavDuration(data); ok {
+			meta["DurationMs"] = ms
+		}
+	default:
+		info, ok := probeMP4(data)
+		if !ok {
+			break
+		}
+		if info.durationMs > 0 {
+			meta["DurationMs"] = info.durationMs
+		}
+		if info.width > 0 && info.height > 0 {
+			meta["Width"], meta["Height"] = info.width, info.height
+		}
+	}
+	return meta
+}
+
+type mp4Info struct {
+	durationMs    int64
+	width, height int
+}
+
+// probeMP4 walks the ISO base media boxes for the movie header (duration)
+// and the first track header with picture dimensions.
+func probeMP4(data []byte) (mp4Info, bool) {
+	var info mp4Info
+	found := false
+	var walk func(b []byte)
+	walk = func(b []byte) {
+		for len(b) >= 8 {
+			size := uint64(binary.BigEndian.Uint32(b))
+			kind := string(b[4:8])
+			header := uint64(8)
+			switch size {
+			case 0:
+				size = uint64(len(b))
+			case 1:
+				if len(b) < 16 {
+					return
+				}
+				size, header = binary.BigEndian.Uint64(b[8:]), 16
+			}
+			if size < header || size > uint64(len(b)) {
+				return
+			}
+			body := b[header:size]
+			switch kind {
+			case "moov", "trak", "mdia":
+				walk(body)
+			case "mvhd":
+				if ms, ok := mvhdDuration(body); ok {
+					info.durationMs, found = ms, true
+				}
+			case "tkhd":
+				if w, h, ok := tkhdDimensions(body); ok && info.width == 0 {
+					info.width, info.height = w, h
+				}
+			}
+			b = b[size:]
+		}
+	}
+	walk(data)
+	return info, found
+}
+
+func mvhdDuration(b []byte) (int64, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+	var timescale, duration uint64
+	switch b[0] {
+	case 0:
+		if len(b) < 20 {
+			return 0, false
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[12:]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+	case 1:
+		if len(b) < 32 {
+			return 0, false
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[20:]))
+		duration = binary.BigEndian.Uint64(b[24:])
+	default:
+		return 0, false
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return int64(duration * 1000 / timescale), true
+}
+
+// tkhdDimensions returns a track's presentation size, stored as 16.16 fixed
+// point after the matrix. Audio tracks report 0x0.
+func tkhdDimensions(b []byte) (int, int, bool) {
+	offset := 76
+	if len(b) > 0 && b[0] == 1 {
+		offset = 88
+	}
+	if len(b) < offset+8 {
+		return 0, 0, false
+	}
+	w := int(binary.BigEndian.Uint32(b[offset:]) >> 16)
+	h := int(binary.BigEndian.Uint32(b[offset+4:]) >> 16)
+	return w, h, w > 0 && h > 0
+}
+
+func isWAV(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE"
+}
+
+// wavDuration divides the data chunk's size by the byte rate from the fmt
+// chunk.
+func wavDuration(data []byte) (int64, bool) {
+	var byteRate uint32
+	b := data[12:]
+	for len(b) >= 8 {
+		kind := string(b[0:4])
+		size := binary.LittleEndian.Uint32(b[4:8])
+		body := b[8:]
+		switch kind {
+		case "fmt ":
+			if len(body) < 12 {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(body[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			return int64(size) * 1000 / int64(byteRate), true
+		}
+		// Chunks are padded to an even size
+		next := uint64(size) + uint64(size&1)
+		if next > uint64(len(body)) {
+			return 0, false
+		}
+		b = body[next:]
+	}
+	return 0, false
+}
+
+// prepareMediaMessage checks that a media message references an asset its
+// sender uploaded, of a matching type, and fills in the thumbnail and
+// server-probed metadata. Other messages may not carry media.
+func prepareMediaMessage(msg *ChatMessage) error {
+	if !isMediaMessage(msg.Type) {
+		if msg.MediaURL != "" || msg.ThumbnailURL != "" {
+			return validationError("Invalid media", FieldError{"MediaURL", fmt.Sprintf("Not allowed on %s messages", msg.Type)})
+		}
+		return nil
+	}
+	if msg.MediaURL == "" {
+		return requiredError("MediaURL")
+	}
+	hash := assetHash(msg.MediaURL)
+	media, err := loadOwnedMedia(hash, msg.SenderID)
+	if err != nil {
+		return mediaError("MediaURL", err)
+	}
+	if !mediaMatchesType(msg.Type, media.MIME, media.Meta) {
+		return validationError("Invalid media", FieldError{"MediaURL", fmt.Sprintf("%s is not a valid %s file", media.MIME, strings.ToLower(string(msg.Type)))})
+	}
+
+	// Thumbnails are always generated by the server: from the image itself,
+	// or for video and audio from a poster frame or cover art the client
+	// uploaded, which must be a decodable image
+	thumbURL, thumbHash := msg.MediaURL, hash
+	if msg.Type != MsgImage {
+		thumbURL, thumbHash = msg.ThumbnailURL, ""
+		if thumbURL != "" {
+			thumbHash = assetHash(thumbURL)
+			poster, err := loadOwnedMedia(thumbHash, msg.SenderID)
+			if err != nil {
+				return mediaError("ThumbnailURL", err)
+			}
+			if !isDecodedImage(poster) {
+				return validationError("Invalid media", FieldError{"ThumbnailURL", "Must be an image"})
+			}
+			media.Thumbnail = poster.Thumbnail
+		}
+	}
+	switch {
+	case thumbURL == "":
+		msg.ThumbnailURL = ""
+	case media.Thumbnail != "":
+		msg.ThumbnailURL = strings.Replace(thumbURL, thumbHash, media.Thumbnail, 1)
+	default:
+		// A failed thumbnail falls back to the original rather than failing the send
+		msg.ThumbnailURL = thumbURL
+	}
+
+	// Probed values replace anything the client claimed
+	if msg.Metadata == nil {
+		msg.Metadata = map[string]interface{}{}
+	}
+	for _, k := range []string{"Size", "MimeType", "Width", "Height", "DurationMs"} {
+		delete(msg.Metadata, k)
+	}
+	for k, v := range media.Meta {
+		msg.Metadata[k] = v
+	}
+	return nil
+}
+
+// assetMedia is what the server derived from an asset's content: its probed
+// metadata (including the sniffed MimeType) and a JPEG thumbnail for images.
+type assetMedia struct {
+	MIME      string
+	Meta      map[string]interface{}
+	Thumbnail string // hash of the thumbnail asset, "" if none could be made
+}
+
+// isDecodedImage reports whether an asset is an image the server could read.
+func isDecodedImage(m assetMedia) bool {
+	_, hasSize := m.Meta["Width"]
+	return strings.HasPrefix(m.MIME, "image/") && hasSize
+}
+
+// describeMedia probes an asset and, for images, stores a thumbnail.
+func describeMedia(hash string, data []byte, declared string) assetMedia {
+	mime := sniffMIME(data, declared)
+	m := assetMedia{MIME: mime, Meta: probeMedia(data, mime)}
+	if isDecodedImage(m) {
+		thumb, err := deriveThumbnail(data)
+		if err != nil {
+			log.Printf("Failed to create thumbnail for %s: %v", hash, err)
+		}
+		m.Thumbnail = thumb
+	}
+	return m
+}
+
+// errAssetNotOwned is returned for assets that don't exist or that the user
+// didn't upload; the two aren't told apart.
+var errAssetNotOwned = errors.New("asset not uploaded by sender")
+
+// loadOwnedMedia describes an asset if userID uploaded it. Assets are
+// content-addressed, so the description is cached per hash and the blob is
+// only read the first time an asset is sent.
+func loadOwnedMedia(hash, userID string) (assetMedia, error) {
+	if hash == "" {
+		return assetMedia{}, errAssetNotOwned
+	}
+	owned, err := IsAssetUploadedBy(hash, userID)
+	if err != nil {
+		return assetMedia{}, err
+	}
+	if !owned {
+		return assetMedia{}, errAssetNotOwned
+	}
+
+	meta, thumbnail, found, err := GetAssetMedia(hash)
+	if err != nil {
+		return assetMedia{}, err
+	}
+	if found {
+		mime, _ := meta["MimeType"].(string)
+		return assetMedia{MIME: mime, Meta: meta, Thumbnail: thumbnail}, nil
+	}
+
+	data, declared, err := GetAsset(hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return assetMedia{}, errAssetNotOwned
+	}
+	if err != nil {
+		return assetMedia{}, err
+	}
+	m := describeMedia(hash, data, declared)
+	if err := SaveAssetMedia(hash, m.Meta, m.Thumbnail); err != nil {
+		log.Printf("Failed to cache media info for %s: %v", hash, err)
+	}
+	return m, nil
+}
+
+func mediaError(field string, err error) error {
+	if errors.Is(err, errAssetNotOwned) {
+		return validationError("Invalid media", FieldError{field, "Upload the file first"})
+	}
+	return internalError("Failed to load media", err)
+}
+
+// deriveThumbnail stores a JPEG thumbnail of an image and returns its hash.
+func deriveThumbnail(data []byte) (string, error) {
+	thumbData, err := CreateThumbnail(data)
+	if err != nil {
+		return "", err
+	}
+	return SaveAsset(thumbData, "image/jpeg")
+}
+
+// saveThumbnail stores a thumbnail of an image and records userID as its
+// uploader, so it can be referenced like any other upload.
+func saveThumbnail(data []byte, userID string) (string, error) {
+	hash, err := deriveThumbnail(data)
+	if err != nil {
+		return "", err
+	}
+	return hash, RecordAssetUpload(hash, userID)
+}
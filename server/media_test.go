@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mp4Box(kind string, body ...[]byte) []byte {
+	payload := bytes.Join(body, nil)
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], kind)
+	return append(b, payload...)
+}
+
+// testMP4 builds a minimal movie: a 2.5s mvhd and one track of width x height.
+func testMP4(width, height int) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000) // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 2500) // duration
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], uint32(height)<<16)
+	return append(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isommp41")),
+		mp4Box("moov", mp4Box("mvhd", mvhd), mp4Box("trak", mp4Box("tkhd", tkhd)))...)
+}
+
+func TestAssetHash(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	for url, want := range map[string]string{
+		hash:              hash,
+		"/assets/" + hash: hash,
+		"https://cdn.example.com/assets/" + hash + "?v=2": hash,
+		"/assets/not-a-hash":                              "",
+		"https://evil.example.com/cat.jpg":                "",
+		"":                                                "",
+	} {
+		if got := assetHash(url); got != want {
+			t.Errorf("assetHash(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestProbeMedia_Image(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 48)))
+
+	meta := probeMedia(buf.Bytes(), sniffMIME(buf.Bytes(), "application/octet-stream"))
+	if meta["MimeType"] != "image/png" || meta["Width"] != 64 || meta["Height"] != 48 || meta["Size"] != buf.Len() {
+		t.Errorf("Unexpected image metadata: %v", meta)
+	}
+}
+
+func TestProbeMedia_MP4(t *testing.T) {
+	video := testMP4(1280, 720)
+	meta := probeMedia(video, "video/mp4")
+	if meta["DurationMs"] != int64(2500) || meta["Width"] != 1280 || meta["Height"] != 720 {
+		t.Errorf("Unexpected video metadata: %v", meta)
+	}
+	if !mediaMatchesType(MsgVideo, "video/mp4", meta) || mediaMatchesType(MsgAudio, "video/mp4", meta) {
+		t.Error("An MP4 with a picture is video, not audio")
+	}
+
+	audio := probeMedia(testMP4(0, 0), "video/mp4")
+	if _, ok := audio["Width"]; ok || audio["DurationMs"] != int64(2500) {
+		t.Errorf("Unexpected audio metadata: %v", audio)
+	}
+	if !mediaMatchesType(MsgAudio, "video/mp4", audio) {
+		t.Error("An MP4 without a picture should be accepted as audio")
+	}
+}
+
+func TestProbeMedia_WAV(t *testing.T) {
+	// 16kHz mono 16-bit: 32000 bytes per second, 1.5s of samples
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	fmtChunk := make([]byte, 20)
+	binary.LittleEndian.PutUint32(fmtChunk[0:], 16)
+	binary.LittleEndian.PutUint32(fmtChunk[12:], 32000)
+	wav = append(wav, fmtChunk...)
+	wav = append(wav, "data"...)
+	wav = binary.LittleEndian.AppendUint32(wav, 48000)
+	wav = append(wav, make([]byte, 48000)...)
+
+	meta := probeMedia(wav, sniffMIME(wav, ""))
+	if meta["MimeType"] != "audio/wave" || meta["DurationMs"] != int64(1500) {
+		t.Errorf("Unexpected WAV metadata: %v", meta)
+	}
+}
+
+func TestPrepareMediaMessage_Validation(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  ChatMessage
+	}{
+		{"text with media", ChatMessage{Type: MsgText, MediaURL: "/assets/" + strings.Repeat("ab", 32)}},
+		{"image without media", ChatMessage{Type: MsgImage}},
+		{"foreign URL", ChatMessage{Type: MsgImage, MediaURL: "https://evil.example.com/cat.jpg"}},
+	}
+	for _, tt := range tests {
+		msg := tt.msg
+		msg.SenderID = "media-sender"
+		if e := asAPIError(prepareMediaMessage(&msg)); e.Code != CodeValidation {
+			t.Errorf("%s: expected VALIDATION, got %v", tt.name, e)
+		}
+	}
+
+	text := ChatMessage{Type: MsgText, Content: "hi"}
+	if err := prepareMediaMessage(&text); err != nil {
+		t.Errorf("Plain text should pass, got %v", err)
+	}
+}
+
+func TestPrepareMediaMessage_ServerThumbnails(t *testing.T) {
+	useTestDB(t)
+	sender := createTestDBUser(t, "media-sender")
+	upload := func(data []byte, mime string) string {
+		t.Helper()
+		hash, err := SaveAsset(data, mime)
+		if err == nil {
+			err = RecordAssetUpload(hash, sender)
+		}
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		return hash
+	}
+	var poster bytes.Buffer
+	png.Encode(&poster, image.NewRGBA(image.Rect(0, 0, 640, 360)))
+	posterHash := upload(poster.Bytes(), "image/png")
+	// A unique size keeps the video's hash, and so its cache entry, per run
+	video := testMP4(1280, 720+int(time.Now().UnixNano()%1000))
+	videoHash := upload(video, "video/mp4")
+
+	send := func() (ChatMessage, error) {
+		msg := ChatMessage{Type: MsgVideo, SenderID: sender, MediaURL: "/assets/" + videoHash, ThumbnailURL: "/assets/" + posterHash}
+		return msg, prepareMediaMessage(&msg)
+	}
+	first, err := send()
+	if err != nil {
+		t.Fatalf("Expected video with poster to pass, got %v", err)
+	}
+	thumb := assetHash(first.ThumbnailURL)
+	if thumb == "" || thumb == posterHash {
+		t.Errorf("Expected a server-generated thumbnail, got %q", first.ThumbnailURL)
+	}
+	if _, _, found, err := GetAssetMedia(videoHash); !found || err != nil {
+		t.Errorf("Expected the video's media info to be cached, got found=%v err=%v", found, err)
+	}
+
+	// The cached description gives the same result
+	second, err := send()
+	if err != nil || second.ThumbnailURL != first.ThumbnailURL || second.Metadata["DurationMs"] == nil {
+		t.Errorf("Expected cached send to match, got %+v (err=%v)", second, err)
+	}
+
+	// A poster must be an image the server can decode
+	msg := ChatMessage{Type: MsgVideo, SenderID: sender, MediaURL: "/assets/" + videoHash, ThumbnailURL: "/assets/" + videoHash}
+	if e := asAPIError(prepareMediaMessage(&msg)); e.Code != CodeValidation {
+		t.Errorf("Expected VALIDATION for a non-image poster, got %v", e)
+	}
+}
@@ -564,6 +564,526 @@ func registerMigrations() {
 			return err
 		},
 	})
+
+	// Migration 5: Server-side refresh tokens
+	registry.Register(Migration{
+		Version:     5,
+		Description: "Create refresh_tokens table",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS refresh_tokens (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				revoked_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON refresh_tokens(user_id);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DROP TABLE IF EXISTS refresh_tokens")
+			return err
+		},
+	})
+
+	// Migration 6: User roles for authorization
+	registry.Register(Migration{
+		Version:     6,
+		Description: "Add role column to users",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			sql := `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+			DO $$
+			BEGIN
+				IF NOT EXISTS (
+					SELECT 1 FROM pg_constraint
+					WHERE conname = 'chk_users_role'
+				) THEN
+					ALTER TABLE users
+					ADD CONSTRAINT chk_users_role
+					CHECK (role IN ('user', 'admin'));
+				END IF;
+			END $$`
+			_, err := tx.Exec(ctx, sql)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			sql := `
+			ALTER TABLE users DROP CONSTRAINT IF EXISTS chk_users_role;
+			ALTER TABLE users DROP COLUMN IF EXISTS role`
+			_, err := tx.Exec(ctx, sql)
+			return err
+		},
+	})
+
+	// Migration 7: Device sessions and refresh token rotation
+	registry.Register(Migration{
+		Version:     7,
+		Description: "Create sessions table and link refresh tokens",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS sessions (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				user_agent TEXT DEFAULT '',
+				ip_address TEXT DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				last_used_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				revoked_at TIMESTAMP WITH TIME ZONE
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+			-- Tokens issued before sessions existed cannot be rotated; force a fresh sign-in
+			UPDATE refresh_tokens SET revoked_at = NOW() WHERE revoked_at IS NULL;
+
+			ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id UUID REFERENCES sessions(id) ON DELETE CASCADE;
+			ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMP WITH TIME ZONE;
+
+			CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			sql := `
+			DROP INDEX IF EXISTS idx_refresh_tokens_session;
+			ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS used_at;
+			ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS session_id;
+			DROP TABLE IF EXISTS sessions`
+			_, err := tx.Exec(ctx, sql)
+			return err
+		},
+	})
+
+	// Migration 8: Password reset and email verification
+	registry.Register(Migration{
+		Version:     8,
+		Description: "Create auth_tokens table and add email_verified to users",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN DEFAULT FALSE;
+
+			CREATE TABLE IF NOT EXISTS auth_tokens (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				purpose TEXT NOT NULL CHECK (purpose IN ('password_reset', 'email_verification')),
+				email TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				used_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_auth_tokens_user ON auth_tokens(user_id, purpose);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			sql := `
+			DROP TABLE IF EXISTS auth_tokens;
+			ALTER TABLE users DROP COLUMN IF EXISTS email_verified`
+			_, err := tx.Exec(ctx, sql)
+			return err
+		},
+	})
+
+	// Migration 9: Phone number OTP challenges
+	registry.Register(Migration{
+		Version:     9,
+		Description: "Create phone_verifications table",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS phone_verifications (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				phone_number TEXT NOT NULL,
+				code_hash TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				consumed_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_phone_verifications_user ON phone_verifications(user_id, created_at DESC);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DROP TABLE IF EXISTS phone_verifications")
+			return err
+		},
+	})
+
+	// Migration 10: Audit log of failed logins
+	registry.Register(Migration{
+		Version:     10,
+		Description: "Create login_attempts table",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS login_attempts (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				email TEXT NOT NULL,
+				user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+				ip_address TEXT NOT NULL DEFAULT '',
+				user_agent TEXT DEFAULT '',
+				reason TEXT NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts(email, created_at DESC);
+			CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts(ip_address, created_at DESC);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DROP TABLE IF EXISTS login_attempts")
+			return err
+		},
+	})
+
+	// Migration 11: External identity providers (OIDC)
+	registry.Register(Migration{
+		Version:     11,
+		Description: "Create user_identities table",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS user_identities (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				provider TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				email TEXT DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				last_login_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				UNIQUE (provider, subject)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(user_id);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DROP TABLE IF EXISTS user_identities")
+			return err
+		},
+	})
+
+	// Migration 12: Hub backplane payloads too large for NOTIFY
+	registry.Register(Migration{
+		Version:     12,
+		Description: "Create backplane_payloads table",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS backplane_payloads (
+				id BIGSERIAL PRIMARY KEY,
+				payload BYTEA NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_backplane_payloads_created ON backplane_payloads(created_at);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DROP TABLE IF EXISTS backplane_payloads")
+			return err
+		},
+	})
+
+	// Migration 13: Per-chat message sequence numbers and delivery cursors
+	registry.Register(Migration{
+		Version:     13,
+		Description: "Add chat message sequences and delivery tracking",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS seq BIGINT;
+
+			-- Number existing messages in the order they were sent
+			UPDATE chat_messages m SET seq = numbered.rn
+			FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY chat_id ORDER BY created_at, id) AS rn
+				FROM chat_messages
+			) numbered
+			WHERE m.id = numbered.id AND m.seq IS NULL;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_messages_chat_seq ON chat_messages(chat_id, seq);
+
+			CREATE TABLE IF NOT EXISTS chat_sequences (
+				chat_id TEXT PRIMARY KEY,
+				last_seq BIGINT NOT NULL DEFAULT 0
+			);
+
+			INSERT INTO chat_sequences (chat_id, last_seq)
+			SELECT chat_id::TEXT, MAX(seq) FROM chat_messages GROUP BY chat_id
+			ON CONFLICT (chat_id) DO NOTHING;
+
+			CREATE TABLE IF NOT EXISTS message_deliveries (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				device_id TEXT NOT NULL,
+				chat_id TEXT NOT NULL,
+				delivered_seq BIGINT NOT NULL DEFAULT 0,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				PRIMARY KEY (user_id, device_id, chat_id)
+			);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			DROP TABLE IF EXISTS message_deliveries;
+			DROP TABLE IF EXISTS chat_sequences;
+			DROP INDEX IF EXISTS idx_chat_messages_chat_seq;
+			ALTER TABLE chat_messages DROP COLUMN IF EXISTS seq;`)
+			return err
+		},
+	})
+
+	// Migration 14: Client-generated idempotency keys for chat messages
+	registry.Register(Migration{
+		Version:     14,
+		Description: "Add client_message_id to chat_messages",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS client_message_id TEXT;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_messages_client_id
+				ON chat_messages(chat_id, sender_id, client_message_id) WHERE client_message_id IS NOT NULL;`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			DROP INDEX IF EXISTS idx_chat_messages_client_id;
+			ALTER TABLE chat_messages DROP COLUMN IF EXISTS client_message_id;`)
+			return err
+		},
+	})
+
+	// Migration 15: Presence last-seen, written by CreateUser and read by
+	// GetApplicantsForParty but never created
+	registry.Register(Migration{
+		Version:     15,
+		Description: "Add last_active_at to users",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS last_active_at TIMESTAMP WITH TIME ZONE DEFAULT NOW();`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `ALTER TABLE users DROP COLUMN IF EXISTS last_active_at;`)
+			return err
+		},
+	})
+
+	// Migration 16: Read receipts
+	registry.Register(Migration{
+		Version:     16,
+		Description: "Create chat_read_state",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS chat_read_state (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				chat_id TEXT NOT NULL,
+				last_read_seq BIGINT NOT NULL DEFAULT 0,
+				read_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				PRIMARY KEY (user_id, chat_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_chat_read_state_chat ON chat_read_state(chat_id);`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `DROP TABLE IF EXISTS chat_read_state;`)
+			return err
+		},
+	})
+
+	// Migration 17: Message edits, reactions and soft-delete
+	registry.Register(Migration{
+		Version:     17,
+		Description: "Add message edits, reactions and tombstones",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP WITH TIME ZONE;
+			ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+
+			CREATE TABLE IF NOT EXISTS message_edits (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				message_id UUID NOT NULL REFERENCES chat_messages(id) ON DELETE CASCADE,
+				content TEXT,
+				edited_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS idx_message_edits_message ON message_edits(message_id, edited_at);
+
+			CREATE TABLE IF NOT EXISTS message_reactions (
+				message_id UUID NOT NULL REFERENCES chat_messages(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				emoji TEXT NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				PRIMARY KEY (message_id, user_id, emoji)
+			);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			DROP TABLE IF EXISTS message_reactions;
+			DROP TABLE IF EXISTS message_edits;
+			ALTER TABLE chat_messages DROP COLUMN IF EXISTS deleted_at;
+			ALTER TABLE chat_messages DROP COLUMN IF EXISTS edited_at;`)
+			return err
+		},
+	})
+
+	// Migration 18: One chat_rooms row per DM pair, found by its pair key
+	registry.Register(Migration{
+		Version:     18,
+		Description: "Add dm_key to chat_rooms",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			ALTER TABLE chat_rooms ADD COLUMN IF NOT EXISTS dm_key TEXT;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_rooms_dm_key
+				ON chat_rooms(dm_key) WHERE dm_key IS NOT NULL;`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			DROP INDEX IF EXISTS idx_chat_rooms_dm_key;
+			ALTER TABLE chat_rooms DROP COLUMN IF EXISTS dm_key;`)
+			return err
+		},
+	})
+
+	// Migration 19: Message requests between strangers and who may DM a user
+	registry.Register(Migration{
+		Version:     19,
+		Description: "Add DM request state and dm_privacy",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			ALTER TABLE chat_rooms ADD COLUMN IF NOT EXISTS dm_status TEXT
+				CHECK (dm_status IN ('ACCEPTED', 'PENDING', 'DECLINED'));
+			ALTER TABLE chat_rooms ADD COLUMN IF NOT EXISTS dm_requested_by UUID
+				REFERENCES users(id) ON DELETE SET NULL;
+			UPDATE chat_rooms SET dm_status = 'ACCEPTED' WHERE dm_key IS NOT NULL AND dm_status IS NULL;
+
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS dm_privacy TEXT NOT NULL DEFAULT 'EVERYONE'
+				CHECK (dm_privacy IN ('EVERYONE', 'PARTIES', 'NOBODY'));`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			ALTER TABLE users DROP COLUMN IF EXISTS dm_privacy;
+			ALTER TABLE chat_rooms DROP COLUMN IF EXISTS dm_requested_by;
+			ALTER TABLE chat_rooms DROP COLUMN IF EXISTS dm_status;`)
+			return err
+		},
+	})
+
+	// Migration 20: Track who uploaded each asset, and allow every MessageType
+	registry.Register(Migration{
+		Version:     20,
+		Description: "Add asset_uploads, cached asset media info and widen chk_chat_messages_type",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			-- Assets are content-addressed, so one asset may have several uploaders
+			CREATE TABLE IF NOT EXISTS asset_uploads (
+				hash TEXT NOT NULL REFERENCES assets(hash) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				PRIMARY KEY (hash, user_id)
+			);
+
+			-- What the server derived from an asset the first time it was sent
+			ALTER TABLE assets ADD COLUMN IF NOT EXISTS media_metadata JSONB;
+			ALTER TABLE assets ADD COLUMN IF NOT EXISTS thumbnail_hash TEXT;
+
+			ALTER TABLE chat_messages DROP CONSTRAINT IF EXISTS chk_chat_messages_type;
+			ALTER TABLE chat_messages ADD CONSTRAINT chk_chat_messages_type
+				CHECK (type IN ('TEXT', 'IMAGE', 'VIDEO', 'AUDIO', 'SYSTEM', 'AI', 'PAYMENT', 'DM'));`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			ALTER TABLE chat_messages DROP CONSTRAINT IF EXISTS chk_chat_messages_type;
+			ALTER TABLE chat_messages ADD CONSTRAINT chk_chat_messages_type
+				CHECK (type IN ('TEXT', 'IMAGE', 'VIDEO', 'SYSTEM', 'DM')) NOT VALID;
+			ALTER TABLE assets DROP COLUMN IF EXISTS thumbnail_hash;
+			ALTER TABLE assets DROP COLUMN IF EXISTS media_metadata;
+			DROP TABLE IF EXISTS asset_uploads;`)
+			return err
+		},
+	})
+
+	// Migration 21: Keyset index for paging chat history by (created_at, id)
+	registry.Register(Migration{
+		Version:     21,
+		Description: "Index chat_messages by (chat_id, created_at, id)",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			CREATE INDEX IF NOT EXISTS idx_chat_messages_chat_keyset
+				ON chat_messages(chat_id, created_at DESC, id DESC);
+			DROP INDEX IF EXISTS idx_chat_messages_chat_id_created;`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			CREATE INDEX IF NOT EXISTS idx_chat_messages_chat_id_created ON chat_messages(chat_id, created_at DESC);
+			DROP INDEX IF EXISTS idx_chat_messages_chat_keyset;`)
+			return err
+		},
+	})
+
+	// Migration 22: Full-text search over message content
+	registry.Register(Migration{
+		Version:     22,
+		Description: "Add chat_messages.content_tsv with a GIN index",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			// 'simple' doesn't stem or drop stop words, so it works for any
+			// language and for addresses, names and numbers
+			_, err := tx.Exec(ctx, `
+			ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS content_tsv TSVECTOR
+				GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(content, ''))) STORED;
+
+			CREATE INDEX IF NOT EXISTS idx_chat_messages_content_tsv
+				ON chat_messages USING GIN (content_tsv);`)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+			DROP INDEX IF EXISTS idx_chat_messages_content_tsv;
+			ALTER TABLE chat_messages DROP COLUMN IF EXISTS content_tsv;`)
+			return err
+		},
+	})
+
+	// Migration 23: Which replicas each user is connected to
+	registry.Register(Migration{
+		Version:     23,
+		Description: "Create user_presence table",
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			schema := `
+			CREATE TABLE IF NOT EXISTS user_presence (
+				user_id TEXT NOT NULL,
+				replica_id TEXT NOT NULL,
+				heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+				PRIMARY KEY (user_id, replica_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_user_presence_heartbeat ON user_presence(heartbeat_at);`
+			_, err := tx.Exec(ctx, schema)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DROP TABLE IF EXISTS user_presence")
+			return err
+		},
+	})
 }
 
 // Migrate runs all pending migrations
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"sync"
+	"testing"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -135,6 +138,47 @@ func SetMockDB(mockPool *MockPool) {
 	_ = pgxpool.NewWithConfig
 }
 
+// useTestDB points the global pool at the Postgres database in
+// TEST_DATABASE_URL, migrated to the current schema, for tests that need real
+// SQL. Without it the test is skipped. Tests share the database, so they must
+// create their own rows with unique keys.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	prev := db
+	db = pool
+	t.Cleanup(func() {
+		db = prev
+		pool.Close()
+	})
+	if err := Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+}
+
+// createTestDBUser inserts a minimal user into the test database.
+func createTestDBUser(t *testing.T, name string) string {
+	t.Helper()
+	id, err := CreateUserWithIdentity(User{RealName: name, Role: RoleUser}, "test", uniqueTestKey(name))
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return id
+}
+
+// uniqueTestKey returns a string no earlier test run has used, for emails
+// and provider subjects in the shared test database.
+func uniqueTestKey(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+}
+
 // Helper functions for creating test data
 func CreateTestUser(id string) User {
 	return User{
@@ -238,6 +282,34 @@ func CreateTestNotification(id, userID string) Notification {
 	}
 }
 
+// testAccessToken issues a signed access token for WebSocket and REST tests
+func testAccessToken(uid string) string {
+	token, _, _ := IssueAccessToken(uid, RoleUser, "")
+	return token
+}
+
 func timePtr(t time.Time) *time.Time {
 	return &t
 }
+
+// recordingBackplane records published messages without delivering them,
+// and fails every publish when err is set.
+type recordingBackplane struct {
+	mu        sync.Mutex
+	published []BackplaneMessage
+	err       error
+}
+
+func (b *recordingBackplane) Publish(msg BackplaneMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.published = append(b.published, msg)
+	return nil
+}
+
+func (b *recordingBackplane) Subscribe(func(BackplaneMessage)) error { return nil }
+
+func (b *recordingBackplane) Close() error { return nil }
@@ -11,6 +11,10 @@ import (
 type PartyStatus string
 type ApplicantStatus string
 type MessageType string
+type UserRole string
+type AuthTokenPurpose string
+type DMStatus string
+type DMPrivacy string
 
 const (
 	PartyStatusOpen      PartyStatus = "OPEN"
@@ -31,6 +35,20 @@ const (
 	MsgSystem  MessageType = "SYSTEM"
 	MsgWingman MessageType = "AI"
 	MsgPayment MessageType = "PAYMENT"
+
+	RoleUser  UserRole = "user"
+	RoleAdmin UserRole = "admin"
+
+	PurposePasswordReset     AuthTokenPurpose = "password_reset"
+	PurposeEmailVerification AuthTokenPurpose = "email_verification"
+
+	DMAccepted DMStatus = "ACCEPTED"
+	DMPending  DMStatus = "PENDING" // a message request awaiting the recipient
+	DMDeclined DMStatus = "DECLINED"
+
+	DMPrivacyEveryone DMPrivacy = "EVERYONE" // strangers may send message requests
+	DMPrivacyParties  DMPrivacy = "PARTIES"  // only users sharing a party
+	DMPrivacyNobody   DMPrivacy = "NOBODY"
 )
 
 // ==========================================
@@ -41,6 +59,9 @@ type WSMessage struct {
 	Event   string      `json:"Event" db:"event"`
 	Payload interface{} `json:"Payload" db:"payload"`
 	Token   string      `json:"Token,omitempty" db:"token"`
+
+	// RequestID is optional on requests and echoed on every response to them
+	RequestID string `json:"RequestID,omitempty" db:"-"`
 }
 
 // ==========================================
@@ -85,6 +106,9 @@ type User struct {
 	CreatedAt       *time.Time `json:"CreatedAt,omitempty" db:"created_at"`
 	Bio             string     `json:"Bio" db:"bio"`
 	Thumbnail       string     `json:"Thumbnail" db:"thumbnail"`
+	Role            UserRole   `json:"Role" db:"role"`
+	EmailVerified   bool       `json:"EmailVerified" db:"email_verified"`
+	DMPrivacy       DMPrivacy  `json:"DMPrivacy" db:"dm_privacy"`
 }
 
 type Party struct {
@@ -124,11 +148,16 @@ type ChatRoom struct {
 	IsActive       bool       `json:"IsActive" db:"is_active"`
 	CreatedAt      time.Time  `json:"CreatedAt" db:"created_at"`
 	PartyStartTime *time.Time `json:"PartyStartTime,omitempty"`
+	DMKey          string     `json:"DMKey,omitempty" db:"dm_key"` // generateDMChatId of the pair, DMs only
+	DMStatus       DMStatus   `json:"DMStatus,omitempty" db:"dm_status"`
+	DMRequestedBy  string     `json:"DMRequestedBy,omitempty" db:"dm_requested_by"`
 }
 
 type ChatMessage struct {
 	ID              string                 `json:"ID" db:"id"`
 	ChatID          string                 `json:"ChatID" db:"chat_id"`
+	Seq             int64                  `json:"Seq" db:"seq"` // Per-chat order, assigned on save
+	ClientMessageID string                 `json:"ClientMessageID,omitempty" db:"client_message_id"` // Sender's idempotency key
 	SenderID        string                 `json:"SenderID" db:"sender_id"`
 	Type            MessageType            `json:"Type" db:"type"`
 	Content         string                 `json:"Content" db:"content"`
@@ -137,10 +166,26 @@ type ChatMessage struct {
 	Metadata        map[string]interface{} `json:"Metadata" db:"metadata"` // Use JSONB in DB
 	ReplyToID       string                 `json:"ReplyToID" db:"reply_to_id"`
 	CreatedAt       time.Time              `json:"CreatedAt" db:"created_at"`
+	EditedAt        *time.Time             `json:"EditedAt,omitempty" db:"edited_at"`
+	Deleted         bool                   `json:"Deleted,omitempty" db:"deleted_at"` // Tombstone: content is cleared
+	Reactions       []Reaction             `json:"Reactions,omitempty"`
 	SenderName      string                 `json:"SenderName" db:"sender_name"`
 	SenderThumbnail string                 `json:"SenderThumbnail" db:"sender_thumbnail"`
 }
 
+// Reaction aggregates one emoji on a message.
+type Reaction struct {
+	Emoji   string   `json:"Emoji"`
+	Count   int      `json:"Count"`
+	UserIDs []string `json:"UserIDs"`
+}
+
+// MessageEdit is a previous version of an edited message.
+type MessageEdit struct {
+	Content  string    `json:"Content"`
+	EditedAt time.Time `json:"EditedAt"`
+}
+
 type Crowdfunding struct {
 	ID            string         `json:"ID" db:"id"`
 	PartyID       string         `json:"PartyID" db:"party_id"`
@@ -179,3 +224,46 @@ type PartyAnalytics struct {
 	DeclinedCount     int    `json:"DeclinedCount"`
 	CurrentGuestCount int    `json:"CurrentGuestCount"`
 }
+
+// Session is a signed-in device. Each session owns a chain of rotated refresh tokens.
+type Session struct {
+	ID         string    `json:"ID" db:"id"`
+	UserID     string    `json:"UserID" db:"user_id"`
+	UserAgent  string    `json:"UserAgent" db:"user_agent"`
+	IPAddress  string    `json:"IPAddress" db:"ip_address"`
+	CreatedAt  time.Time `json:"CreatedAt" db:"created_at"`
+	LastUsedAt time.Time `json:"LastUsedAt" db:"last_used_at"`
+	Current    bool      `json:"Current"`
+	Online     bool      `json:"Online"` // has a live WebSocket on this server
+}
+
+// PhoneChallenge is a pending one-time code sent to a phone number.
+type PhoneChallenge struct {
+	ID          string    `json:"-" db:"id"`
+	UserID      string    `json:"-" db:"user_id"`
+	PhoneNumber string    `json:"-" db:"phone_number"`
+	CodeHash    string    `json:"-" db:"code_hash"`
+	Attempts    int       `json:"-" db:"attempts"`
+	ExpiresAt   time.Time `json:"-" db:"expires_at"`
+}
+
+// LoginAttempt is an audit record of a rejected login.
+type LoginAttempt struct {
+	ID        string    `json:"ID" db:"id"`
+	Email     string    `json:"Email" db:"email"`
+	UserID    string    `json:"UserID,omitempty" db:"user_id"`
+	IPAddress string    `json:"IPAddress" db:"ip_address"`
+	UserAgent string    `json:"UserAgent" db:"user_agent"`
+	Reason    string    `json:"Reason" db:"reason"`
+	CreatedAt time.Time `json:"CreatedAt" db:"created_at"`
+}
+
+// RefreshToken is the server-side record of an issued refresh token.
+type RefreshToken struct {
+	ID        string     `json:"-" db:"id"`
+	UserID    string     `json:"-" db:"user_id"`
+	SessionID string     `json:"-" db:"session_id"`
+	ExpiresAt time.Time  `json:"-" db:"expires_at"`
+	UsedAt    *time.Time `json:"-" db:"used_at"`
+	RevokedAt *time.Time `json:"-" db:"revoked_at"`
+}
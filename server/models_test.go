@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
@@ -380,6 +381,26 @@ func TestChatMessageSerialization(t *testing.T) {
 	}
 }
 
+func TestChatMessageTombstoneSerialization(t *testing.T) {
+	plain, _ := json.Marshal(ChatMessage{ID: "msg-1", Content: "hi"})
+	for _, field := range []string{"EditedAt", "Deleted", "Reactions"} {
+		if strings.Contains(string(plain), field) {
+			t.Errorf("Expected %s omitted from an unchanged message: %s", field, plain)
+		}
+	}
+
+	edited := time.Now()
+	data, _ := json.Marshal(ChatMessage{ID: "msg-2", EditedAt: &edited, Deleted: true,
+		Reactions: []Reaction{{Emoji: "🎉", Count: 2, UserIDs: []string{"a", "b"}}}})
+	var got ChatMessage
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to unmarshal ChatMessage: %v", err)
+	}
+	if got.EditedAt == nil || !got.Deleted || len(got.Reactions) != 1 || got.Reactions[0].Count != 2 {
+		t.Errorf("Unexpected round trip: %+v", got)
+	}
+}
+
 func TestChatMessageTypes(t *testing.T) {
 	msgTypes := []MessageType{MsgText, MsgImage, MsgVideo, MsgAudio, MsgSystem, MsgWingman, MsgPayment}
 
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	jwksCacheTTL     = time.Hour
+	jwksMinRefetch   = time.Minute // throttle refetches triggered by unknown key IDs
+	oidcClockSkew    = time.Minute
+	jwksFetchTimeout = 5 * time.Second
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrUnknownKey      = errors.New("unknown signing key")
+)
+
+// OIDCProvider is an OpenID Connect issuer whose ID tokens we accept.
+// Keys come from JWKSURL, or from JWKSFile for tests and offline setups.
+type OIDCProvider struct {
+	Name      string   `json:"name"`
+	Issuer    string   `json:"issuer"`
+	Audiences []string `json:"audiences"` // our client IDs registered with the provider
+	JWKSURL   string   `json:"jwksUrl"`
+	JWKSFile  string   `json:"jwksFile"`
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// IDTokenClaims are the ID token claims we rely on.
+type IDTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"` // string or array
+	ExpiresAt     int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified json.RawMessage `json:"email_verified"` // bool, or "true" (Apple)
+	Name          string          `json:"name"`
+}
+
+// IsEmailVerified accepts both JSON booleans and Apple's string form.
+func (c IDTokenClaims) IsEmailVerified() bool {
+	v := strings.Trim(string(c.EmailVerified), `"`)
+	return v == "true"
+}
+
+func (c IDTokenClaims) hasAudience(allowed []string) bool {
+	var auds []string
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		auds = []string{single}
+	} else if err := json.Unmarshal(c.Audience, &auds); err != nil {
+		return false
+	}
+	for _, a := range auds {
+		for _, ok := range allowed {
+			if a == ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	oidcProviders   = map[string]*OIDCProvider{}
+	oidcProvidersMu sync.RWMutex
+)
+
+// LoadOIDCProviders reads the provider list from OIDC_PROVIDERS (JSON) or
+// the file named by OIDC_CONFIG_FILE. Without either, OIDC login is disabled.
+func LoadOIDCProviders() error {
+	raw := []byte(getEnv("OIDC_PROVIDERS", ""))
+	if path := getEnv("OIDC_CONFIG_FILE", ""); len(raw) == 0 && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		raw = data
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var providers []*OIDCProvider
+	if err := json.Unmarshal(raw, &providers); err != nil {
+		return fmt.Errorf("invalid OIDC provider config: %w", err)
+	}
+	for _, p := range providers {
+		if p.Name == "" || p.Issuer == "" || len(p.Audiences) == 0 || (p.JWKSURL == "" && p.JWKSFile == "") {
+			return fmt.Errorf("OIDC provider %q needs name, issuer, audiences and a JWKS source", p.Name)
+		}
+		RegisterOIDCProvider(p)
+	}
+	return nil
+}
+
+// RegisterOIDCProvider makes a provider available to /login/oidc.
+func RegisterOIDCProvider(p *OIDCProvider) {
+	oidcProvidersMu.Lock()
+	oidcProviders[p.Name] = p
+	oidcProvidersMu.Unlock()
+}
+
+func getOIDCProvider(name string) (*OIDCProvider, error) {
+	oidcProvidersMu.RLock()
+	defer oidcProvidersMu.RUnlock()
+	p, ok := oidcProviders[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// VerifyIDToken checks the token's signature against the provider's JWKS and
+// validates issuer, audience, expiry and (if given) nonce.
+func (p *OIDCProvider) VerifyIDToken(token, nonce string) (IDTokenClaims, error) {
+	var claims IDTokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return claims, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+
+	key, err := p.keyFor(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], sig) {
+		return claims, ErrInvalidToken
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(body, &claims) != nil {
+		return claims, ErrInvalidToken
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, fmt.Errorf("%w: issuer mismatch", ErrInvalidToken)
+	case !claims.hasAudience(p.Audiences):
+		return claims, fmt.Errorf("%w: audience mismatch", ErrInvalidToken)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	case now.Add(-oidcClockSkew).Unix() >= claims.ExpiresAt:
+		return claims, ErrExpiredToken
+	case claims.IssuedAt > now.Add(oidcClockSkew).Unix():
+		return claims, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case nonce != "" && claims.Nonce != nonce:
+		return claims, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// verifySignature supports the algorithms used by Google (RS256) and
+// Apple/others (ES256). Anything else, including "none", is rejected.
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	default:
+		return false
+	}
+}
+
+// keyFor returns the signing key with the given ID, reloading the JWKS when
+// the cache is stale or the key is unknown (providers rotate keys).
+func (p *OIDCProvider) keyFor(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fresh := time.Since(p.fetchedAt) < jwksCacheTTL
+	if key, ok := p.keys[kid]; ok && fresh {
+		return key, nil
+	}
+	if fresh && time.Since(p.fetchedAt) < jwksMinRefetch {
+		return nil, ErrUnknownKey
+	}
+
+	keys, err := p.loadJWKS()
+	if err != nil {
+		log.Printf("JWKS load error for %s: %v", p.Name, err)
+		if key, ok := p.keys[kid]; ok {
+			return key, nil // keep serving the cached key through provider outages
+		}
+		return nil, err
+	}
+	p.keys = keys
+	p.fetchedAt = time.Now()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (p *OIDCProvider) loadJWKS() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if p.JWKSFile != "" {
+		data, err = os.ReadFile(p.JWKSFile)
+	} else {
+		client := &http.Client{Timeout: jwksFetchTimeout}
+		var resp *http.Response
+		resp, err = client.Get(p.JWKSURL)
+		if err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("JWKS fetch returned %d", resp.StatusCode)
+			}
+			data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS decodes RSA and P-256 EC keys from a JSON Web Key Set.
+// Keys of other types are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				continue
+			}
+			keys[k.Kid] = pub
+		}
+	}
+	return keys, nil
+}
+
+// handleOIDCLogin signs a user in with an ID token from a configured
+// provider. Existing identities sign in directly; otherwise the identity is
+// linked to the account with the same verified email, or a new account is created.
+func handleOIDCLogin(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, methodNotAllowedError())
+			return
+		}
+
+		var req struct {
+			Provider string `json:"provider"`
+			IDToken  string `json:"idToken"`
+			Nonce    string `json:"nonce"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IDToken == "" {
+			writeError(w, r, validationError("Invalid request"))
+			return
+		}
+
+		provider, err := getOIDCProvider(req.Provider)
+		if err != nil {
+			writeError(w, r, validationError("Unknown provider"))
+			return
+		}
+
+		claims, err := provider.VerifyIDToken(req.IDToken, req.Nonce)
+		if err != nil {
+			log.Printf("OIDC token rejected for %s: %v", provider.Name, err)
+			writeError(w, r, unauthorizedError("Invalid ID token"))
+			return
+		}
+
+		user, err := resolveOIDCUser(hub, provider.Name, claims)
+		if err != nil {
+			if errors.Is(err, errEmailNotVerified) {
+				writeError(w, r, conflictError("An account with this email exists; sign in with your password to link this provider"))
+				return
+			}
+			writeError(w, r, internalError("Failed to sign in", err))
+			return
+		}
+
+		resp, err := IssueTokens(user, r)
+		if err != nil {
+			writeError(w, r, internalError("Failed to issue session", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+var errEmailNotVerified = errors.New("provider email not verified")
+
+func resolveOIDCUser(hub *Hub, provider string, claims IDTokenClaims) (User, error) {
+	userID, err := GetUserIDByIdentity(provider, claims.Subject)
+	if err == nil {
+		return GetUser(userID)
+	}
+	// Only a missing link may fall through to linking or creating an account
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return User{}, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if email != "" {
+		existing, _, err := GetUserByEmail(email)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return User{}, err
+		}
+		if err == nil {
+			// Only a provider-verified email may claim an existing account
+			if !claims.IsEmailVerified() {
+				return User{}, errEmailNotVerified
+			}
+			// If the account never proved ownership of the email, whoever
+			// registered it may not be the owner: drop its password and sessions
+			secure := !existing.EmailVerified
+			if err := LinkIdentity(existing.ID, provider, claims.Subject, email, secure); err != nil {
+				return User{}, err
+			}
+			if secure {
+				sessions, err := RevokeAllSessions(existing.ID)
+				if err != nil {
+					log.Printf("Session revoke on OIDC link failed: %v", err)
+				}
+				hub.DisconnectSessions(sessions...)
+			}
+			return GetUser(existing.ID)
+		}
+	}
+
+	u := User{RealName: claims.Name, Role: RoleUser}
+	if claims.IsEmailVerified() {
+		u.Email = email
+		u.EmailVerified = true
+	}
+	id, err := CreateUserWithIdentity(u, provider, claims.Subject)
+	if err != nil {
+		return User{}, err
+	}
+	return GetUser(id)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	provider *OIDCProvider
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+}
+
+// newTestIssuer writes a JWKS with one RSA and one EC key to a temp file and
+// returns a provider reading from it.
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kid": "rsa-1", "kty": "RSA", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec-1", "kty": "EC", "use": "sig", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		},
+	})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	return &testIssuer{
+		provider: &OIDCProvider{
+			Name:      "test",
+			Issuer:    "https://issuer.example.com",
+			Audiences: []string{"waterparty-client"},
+			JWKSFile:  path,
+		},
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+	}
+}
+
+func (ti *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, ti.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, ti.ecKey, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            "https://issuer.example.com",
+		"sub":            "provider-user-1",
+		"aud":            "waterparty-client",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"email":          "jane@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestVerifyIDToken_RS256AndES256(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	for _, tc := range []struct{ alg, kid string }{{"RS256", "rsa-1"}, {"ES256", "ec-1"}} {
+		claims, err := ti.provider.VerifyIDToken(ti.sign(t, tc.alg, tc.kid, validClaims()), "")
+		if err != nil {
+			t.Fatalf("%s: expected valid token, got %v", tc.alg, err)
+		}
+		if claims.Subject != "provider-user-1" || !claims.IsEmailVerified() {
+			t.Errorf("%s: unexpected claims %+v", tc.alg, claims)
+		}
+	}
+}
+
+func TestVerifyIDToken_Rejections(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	tests := []struct {
+		name   string
+		mutate func(map[string]interface{})
+		nonce  string
+	}{
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, ""},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, ""},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, ""},
+		{"future iat", func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }, ""},
+		{"missing subject", func(c map[string]interface{}) { delete(c, "sub") }, ""},
+		{"nonce mismatch", func(c map[string]interface{}) { c["nonce"] = "a" }, "b"},
+	}
+	for _, tt := range tests {
+		claims := validClaims()
+		tt.mutate(claims)
+		if _, err := ti.provider.VerifyIDToken(ti.sign(t, "RS256", "rsa-1", claims), tt.nonce); err == nil {
+			t.Errorf("%s: expected rejection", tt.name)
+		}
+	}
+}
+
+func TestVerifyIDToken_AudienceArray(t *testing.T) {
+	ti := newTestIssuer(t)
+	claims := validClaims()
+	claims["aud"] = []string{"other", "waterparty-client"}
+
+	if _, err := ti.provider.VerifyIDToken(ti.sign(t, "RS256", "rsa-1", claims), ""); err != nil {
+		t.Errorf("Expected audience array to be accepted, got %v", err)
+	}
+}
+
+func TestVerifyIDToken_BadSignatureAndAlg(t *testing.T) {
+	ti := newTestIssuer(t)
+	token := ti.sign(t, "RS256", "rsa-1", validClaims())
+
+	// Swap the payload for a forged one while keeping the signature
+	parts := strings.Split(token, ".")
+	forged := validClaims()
+	forged["sub"] = "attacker"
+	body, _ := json.Marshal(forged)
+	parts[1] = base64.RawURLEncoding.EncodeToString(body)
+	if _, err := ti.provider.VerifyIDToken(strings.Join(parts, "."), ""); err == nil {
+		t.Error("Expected forged payload to be rejected")
+	}
+
+	// alg=none must never verify
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa-1"})
+	none := base64.RawURLEncoding.EncodeToString(header) + "." + parts[1] + "."
+	if _, err := ti.provider.VerifyIDToken(none, ""); err == nil {
+		t.Error("Expected alg=none to be rejected")
+	}
+
+	// A valid RSA signature presented under the EC key ID must fail
+	if _, err := ti.provider.VerifyIDToken(ti.sign(t, "RS256", "ec-1", validClaims()), ""); err == nil {
+		t.Error("Expected key/alg mismatch to be rejected")
+	}
+}
+
+func TestVerifyIDToken_UnknownKid(t *testing.T) {
+	ti := newTestIssuer(t)
+	if _, err := ti.provider.VerifyIDToken(ti.sign(t, "RS256", "missing", validClaims()), ""); err != ErrUnknownKey {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestIDTokenClaims_AppleStringEmailVerified(t *testing.T) {
+	var claims IDTokenClaims
+	json.Unmarshal([]byte(`{"email_verified":"true"}`), &claims)
+	if !claims.IsEmailVerified() {
+		t.Error(`Expected "true" string to count as verified`)
+	}
+	json.Unmarshal([]byte(`{"email_verified":"false"}`), &claims)
+	if claims.IsEmailVerified() {
+		t.Error(`Expected "false" string to count as unverified`)
+	}
+}
+
+func TestResolveOIDCUser_CreatesReadableUser(t *testing.T) {
+	useTestDB(t)
+	subject := uniqueTestKey("oidc-sub")
+	claims := IDTokenClaims{
+		Subject:       subject,
+		Email:         subject + "@example.com",
+		EmailVerified: json.RawMessage("true"),
+		Name:          "OIDC User",
+	}
+
+	user, err := resolveOIDCUser(NewHub(), "google", claims)
+	if err != nil {
+		t.Fatalf("Expected new user to be created and read back, got %v", err)
+	}
+	if user.RealName != "OIDC User" || user.Email != claims.Email || !user.EmailVerified {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+	if user.Age != 0 || user.HeightCm != 0 || user.LocationLat != 0 || user.LocationLon != 0 {
+		t.Errorf("Expected zero profile fields, got %+v", user)
+	}
+
+	// The second sign-in finds the linked identity instead of creating again
+	again, err := resolveOIDCUser(NewHub(), "google", claims)
+	if err != nil {
+		t.Fatalf("Expected linked user, got %v", err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("Expected same user %s, got %s", user.ID, again.ID)
+	}
+}
+
+func TestResolveOIDCUser_LookupErrorIsNotNewUser(t *testing.T) {
+	// Any lookup failure other than "not linked" must not create an account
+	prev := db
+	db = nil
+	defer func() { db = prev }()
+
+	_, err := resolveOIDCUser(NewHub(), "google", IDTokenClaims{Subject: "sub"})
+	if err == nil {
+		t.Fatal("Expected lookup error to be returned")
+	}
+}
+
+func TestLoadOIDCProviders(t *testing.T) {
+	os.Setenv("OIDC_PROVIDERS", `[{"name":"google","issuer":"https://accounts.google.com","audiences":["client"],"jwksUrl":"https://www.googleapis.com/oauth2/v3/certs"}]`)
+	defer os.Unsetenv("OIDC_PROVIDERS")
+
+	if err := LoadOIDCProviders(); err != nil {
+		t.Fatalf("Failed to load providers: %v", err)
+	}
+	if p, err := getOIDCProvider("google"); err != nil || p.Issuer != "https://accounts.google.com" {
+		t.Errorf("Expected google provider, got %v %v", p, err)
+	}
+
+	os.Setenv("OIDC_PROVIDERS", `[{"name":"broken"}]`)
+	if err := LoadOIDCProviders(); err == nil {
+		t.Error("Expected incomplete provider config to fail")
+	}
+}
+
+func TestHandleOIDCLogin_UnknownProvider(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/login/oidc", strings.NewReader(`{"provider":"nope","idToken":"x.y.z"}`))
+	handleOIDCLogin(NewHub())(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandleOIDCLogin_InvalidToken(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.provider.Name = "test-invalid"
+	RegisterOIDCProvider(ti.provider)
+
+	claims := validClaims()
+	claims["aud"] = "someone-else"
+	body, _ := json.Marshal(map[string]string{"provider": "test-invalid", "idToken": ti.sign(t, "RS256", "rsa-1", claims)})
+
+	rec := httptest.NewRecorder()
+	handleOIDCLogin(NewHub())(rec, httptest.NewRequest("POST", "/login/oidc", strings.NewReader(string(body))))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	otpLength         = 6
+	otpTTL            = 10 * time.Minute
+	otpResendCooldown = 60 * time.Second
+	otpMaxPerHour     = 5
+	otpMaxAttempts    = 5
+)
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// SMSSender delivers text messages to a phone number in E.164 format.
+type SMSSender interface {
+	SendSMS(to, body string) error
+}
+
+// smsSender is the process-wide sender. No production provider is wired up
+// yet, so codes are logged by the fake.
+var smsSender SMSSender = &FakeSMSSender{}
+
+// SentSMS is a message recorded by FakeSMSSender.
+type SentSMS struct {
+	To   string
+	Body string
+}
+
+// FakeSMSSender logs messages instead of sending them and keeps them in
+// memory so tests and local builds can read the code back.
+type FakeSMSSender struct {
+	mu   sync.Mutex
+	Sent []SentSMS
+}
+
+func (f *FakeSMSSender) SendSMS(to, body string) error {
+	f.mu.Lock()
+	f.Sent = append(f.Sent, SentSMS{To: to, Body: body})
+	f.mu.Unlock()
+	log.Printf("📱 SMS to %s: %s", to, body)
+	return nil
+}
+
+// Last returns the most recent message, if any.
+func (f *FakeSMSSender) Last() (SentSMS, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.Sent) == 0 {
+		return SentSMS{}, false
+	}
+	return f.Sent[len(f.Sent)-1], true
+}
+
+// normalizePhoneNumber strips formatting characters and validates E.164.
+func normalizePhoneNumber(phone string) (string, bool) {
+	cleaned := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(strings.TrimSpace(phone))
+	return cleaned, e164Pattern.MatchString(cleaned)
+}
+
+func newOTPCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < otpLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", otpLength, n.Int64()), nil
+}
+
+// hashOTP binds a code to the user and number with the server secret, so a
+// leaked table cannot be brute-forced offline.
+func hashOTP(userID, phone, code string) string {
+	return signToken("otp:" + userID + ":" + phone + ":" + code)
+}
+
+// handlePhoneOTPRequest sends a one-time code to the caller's phone number,
+// or to a new number given in the body.
+func handlePhoneOTPRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, methodNotAllowedError())
+		return
+	}
+	uid := UserIDFromContext(r.Context())
+
+	var req struct {
+		PhoneNumber string `json:"phoneNumber"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, validationError("Invalid request"))
+			return
+		}
+	}
+
+	phone := req.PhoneNumber
+	if phone == "" {
+		u, err := GetUser(uid)
+		if err != nil {
+			writeError(w, r, notFoundError("User not found"))
+			return
+		}
+		phone = u.PhoneNumber
+	}
+	phone, ok := normalizePhoneNumber(phone)
+	if !ok {
+		writeError(w, r, validationError("Phone number must be in E.164 format", FieldError{"phoneNumber", "Phone number must be in E.164 format"}))
+		return
+	}
+
+	count, last, err := GetPhoneChallengeStats(uid, time.Now().Add(-time.Hour))
+	if err != nil {
+		writeError(w, r, internalError("Failed to send code", err))
+		return
+	}
+	if last != nil && time.Since(*last) < otpResendCooldown {
+		retry := otpResendCooldown - time.Since(*last)
+		writeError(w, r, rateLimitedError("Please wait before requesting another code", retry))
+		return
+	}
+	if count >= otpMaxPerHour {
+		writeError(w, r, rateLimitedError("Too many codes requested", time.Hour))
+		return
+	}
+
+	code, err := newOTPCode()
+	if err != nil {
+		writeError(w, r, internalError("Failed to send code", err))
+		return
+	}
+	expiresAt := time.Now().Add(otpTTL)
+	if err := CreatePhoneChallenge(uid, phone, hashOTP(uid, phone, code), expiresAt); err != nil {
+		writeError(w, r, internalError("Failed to send code", err))
+		return
+	}
+	if err := smsSender.SendSMS(phone, fmt.Sprintf("Your WaterParty code is %s", code)); err != nil {
+		writeError(w, r, internalError("Failed to send code", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "sent", "expiresAt": expiresAt})
+}
+
+// handlePhoneOTPVerify checks a code against the caller's pending challenge
+// and, on success, stores the number and sets IsVerified.
+func handlePhoneOTPVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, methodNotAllowedError())
+		return
+	}
+	uid := UserIDFromContext(r.Context())
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeError(w, r, validationError("Invalid request"))
+		return
+	}
+
+	challenge, err := GetActivePhoneChallenge(uid)
+	if err != nil {
+		writeError(w, r, validationError("No pending code, request a new one"))
+		return
+	}
+
+	attempts, err := ClaimPhoneChallengeAttempt(challenge.ID, otpMaxAttempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, rateLimitedError("Too many attempts, request a new code", 0))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify code", err))
+		return
+	}
+
+	expected := hashOTP(uid, challenge.PhoneNumber, strings.TrimSpace(req.Code))
+	if !hmac.Equal([]byte(expected), []byte(challenge.CodeHash)) {
+		e := validationError("Invalid code")
+		e.Details = map[string]interface{}{"attemptsRemaining": otpMaxAttempts - attempts}
+		writeError(w, r, e)
+		return
+	}
+
+	if err := CompletePhoneVerification(challenge); err != nil {
+		writeError(w, r, internalError("Failed to verify code", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "verified", "phoneNumber": challenge.PhoneNumber})
+}
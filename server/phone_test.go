@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  string
+		valid bool
+	}{
+		{"+1 (415) 555-0100", "+14155550100", true},
+		{"+447700900123", "+447700900123", true},
+		{"4155550100", "4155550100", false},
+		{"+0123456789", "+0123456789", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizePhoneNumber(tt.in)
+		if got != tt.want || ok != tt.valid {
+			t.Errorf("normalizePhoneNumber(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestNewOTPCode(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		code, err := newOTPCode()
+		if err != nil {
+			t.Fatalf("Failed to generate code: %v", err)
+		}
+		if len(code) != otpLength || strings.Trim(code, "0123456789") != "" {
+			t.Errorf("Expected %d digits, got %q", otpLength, code)
+		}
+	}
+}
+
+func TestHashOTP_BoundToUserAndNumber(t *testing.T) {
+	base := hashOTP("user-1", "+14155550100", "123456")
+	if base != hashOTP("user-1", "+14155550100", "123456") {
+		t.Error("Hash should be deterministic")
+	}
+	if base == hashOTP("user-2", "+14155550100", "123456") {
+		t.Error("Hash must differ per user")
+	}
+	if base == hashOTP("user-1", "+14155550199", "123456") {
+		t.Error("Hash must differ per phone number")
+	}
+}
+
+func TestFakeSMSSender(t *testing.T) {
+	f := &FakeSMSSender{}
+	if _, ok := f.Last(); ok {
+		t.Error("Expected no messages yet")
+	}
+	f.SendSMS("+14155550100", "Your WaterParty code is 123456")
+	msg, ok := f.Last()
+	if !ok || msg.To != "+14155550100" || !strings.Contains(msg.Body, "123456") {
+		t.Errorf("Unexpected last message %+v", msg)
+	}
+}
+
+func TestHandlePhoneOTPRequest_InvalidNumber(t *testing.T) {
+	handler := authMiddleware(handlePhoneOTPRequest)
+
+	req := httptest.NewRequest("POST", "/phone/otp/request", strings.NewReader(`{"phoneNumber":"555-0100"}`))
+	req.Header.Set("Authorization", "Bearer "+testAccessToken("user-1"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandlePhoneOTPVerify_NoPendingChallenge(t *testing.T) {
+	handler := authMiddleware(handlePhoneOTPVerify)
+
+	req := httptest.NewRequest("POST", "/phone/otp/verify", strings.NewReader(`{"code":"123456"}`))
+	req.Header.Set("Authorization", "Bearer "+testAccessToken("user-1"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestClearServerOwnedFields(t *testing.T) {
+	u := User{
+		RealName:      "Jane",
+		IsVerified:    true,
+		TrustScore:    99,
+		EloScore:      3000,
+		PartiesHosted: 50,
+		FlakeCount:    -1,
+		EmailVerified: true,
+		Role:          RoleAdmin,
+	}
+	clearServerOwnedFields(&u)
+
+	if u.IsVerified || u.TrustScore != 0 || u.EloScore != 0 || u.PartiesHosted != 0 || u.FlakeCount != 0 || u.EmailVerified || u.Role != "" {
+		t.Errorf("Server-owned fields were not cleared: %+v", u)
+	}
+	if u.RealName != "Jane" {
+		t.Error("Client-owned fields must be kept")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// activityTouchInterval throttles last_active_at writes per connection.
+const activityTouchInterval = time.Minute
+
+// presenceHeartbeatInterval is how often a hub refreshes its users with a
+// PresenceTracker; it must be well under presenceTTL.
+const presenceHeartbeatInterval = 30 * time.Second
+
+// typingTTL is how long a TYPING_START lasts unless the client refreshes it.
+var typingTTL = 6 * time.Second
+
+// PresenceUpdate is the PRESENCE payload sent to a user's chat rooms.
+type PresenceUpdate struct {
+	UserID     string     `json:"UserID"`
+	Online     bool       `json:"Online"`
+	LastSeenAt *time.Time `json:"LastSeenAt,omitempty"`
+}
+
+type typingKey struct {
+	chatID string
+	userID string
+}
+
+// typingState expires typing indicators server-side, so a client that
+// disconnects or goes quiet without TYPING_STOP doesn't type forever.
+type typingState struct {
+	mu     sync.Mutex
+	timers map[typingKey]*time.Timer
+}
+
+// StartTyping announces that userID is typing in chatID and (re)arms the
+// indicator's expiry.
+func (h *Hub) StartTyping(chatID, userID string) {
+	k := typingKey{chatID, userID}
+	h.typing.mu.Lock()
+	if h.typing.timers == nil {
+		h.typing.timers = make(map[typingKey]*time.Timer)
+	}
+	if t := h.typing.timers[k]; t != nil {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(typingTTL, func() {
+		h.typing.mu.Lock()
+		current := h.typing.timers[k] == t
+		if current {
+			delete(h.typing.timers, k)
+		}
+		h.typing.mu.Unlock()
+		// A newer TYPING_START replaced this timer; it owns the indicator now
+		if current {
+			h.publishTyping("TYPING_STOP", k)
+		}
+	})
+	h.typing.timers[k] = t
+	h.typing.mu.Unlock()
+
+	h.publishTyping("TYPING_START", k)
+}
+
+// StopTyping clears userID's indicator in chatID, if any.
+func (h *Hub) StopTyping(chatID, userID string) {
+	k := typingKey{chatID, userID}
+	h.typing.mu.Lock()
+	t := h.typing.timers[k]
+	if t != nil {
+		t.Stop()
+		delete(h.typing.timers, k)
+	}
+	h.typing.mu.Unlock()
+	if t != nil {
+		h.publishTyping("TYPING_STOP", k)
+	}
+}
+
+// stopAllTyping clears every indicator of a user who went offline.
+func (h *Hub) stopAllTyping(userID string) {
+	h.typing.mu.Lock()
+	var chats []string
+	for k := range h.typing.timers {
+		if k.userID == userID {
+			chats = append(chats, k.chatID)
+		}
+	}
+	h.typing.mu.Unlock()
+	for _, chatID := range chats {
+		h.StopTyping(chatID, userID)
+	}
+}
+
+// publishTyping sends a typing event to everyone in the chat.
+func (h *Hub) publishTyping(event string, k typingKey) {
+	payload := map[string]interface{}{"ChatID": k.chatID, "UserID": k.userID}
+	if event == "TYPING_START" {
+		payload["ExpiresInMs"] = typingTTL.Milliseconds()
+	}
+	h.PublishToRoom(k.chatID, encodeEvent(event, payload))
+}
+
+// InRoom reports whether c has joined roomID on this replica.
+func (h *Hub) InRoom(roomID string, c *Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[roomID][c]
+}
+
+// connectionCount is the number of this user's sockets on this replica.
+func (h *Hub) connectionCount(userID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[userID])
+}
+
+// announcePresence sends PRESENCE to rooms. Offline updates carry the
+// last-seen time.
+func (h *Hub) announcePresence(userID string, online bool, rooms []string) {
+	update := PresenceUpdate{UserID: userID, Online: online}
+	if !online {
+		now := time.Now().UTC()
+		update.LastSeenAt = &now
+	}
+	msg := encodeEvent("PRESENCE", update)
+	for _, roomID := range rooms {
+		h.PublishToRoom(roomID, msg)
+	}
+}
+
+// userOnline runs when a user's device has joined its chat rooms. Only the
+// user's first device anywhere is announced. Run may not have added this one
+// yet, so a concurrent second device can announce again, which is harmless.
+func (h *Hub) userOnline(userID string, rooms []string) {
+	if tracker, ok := h.backplane.(PresenceTracker); ok {
+		elsewhere, err := tracker.Connected(userID, h.replicaID)
+		if err != nil {
+			log.Printf("Failed to record presence for %s: %v", userID, err)
+		}
+		if elsewhere {
+			return
+		}
+	}
+	if h.connectionCount(userID) <= 1 {
+		h.announcePresence(userID, true, rooms)
+	}
+}
+
+// userOffline runs once a user's last socket on this replica is gone. The
+// user is announced offline only if no other replica still has them; without
+// a PresenceTracker this replica's view is all there is.
+func (h *Hub) userOffline(userID string, rooms []string) {
+	if err := TouchLastActive(userID); err != nil {
+		log.Printf("Failed to record last activity for %s: %v", userID, err)
+	}
+	h.stopAllTyping(userID)
+	// A device that reconnected here in the meantime keeps the user online
+	if h.connectionCount(userID) > 0 {
+		return
+	}
+	if tracker, ok := h.backplane.(PresenceTracker); ok {
+		elsewhere, err := tracker.Disconnected(userID, h.replicaID)
+		if err != nil {
+			log.Printf("Failed to clear presence for %s: %v", userID, err)
+		}
+		if elsewhere {
+			return
+		}
+	}
+	h.announcePresence(userID, false, rooms)
+}
+
+// runPresenceHeartbeat keeps this replica's presence records fresh until stop.
+func (h *Hub) runPresenceHeartbeat(tracker PresenceTracker, stop <-chan struct{}) {
+	ticker := time.NewTicker(presenceHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.presenceHeartbeat(tracker)
+		}
+	}
+}
+
+// presenceHeartbeat refreshes this replica's users and announces offline the
+// users of replicas that stopped heart-beating, e.g. after a crash.
+func (h *Hub) presenceHeartbeat(tracker PresenceTracker) {
+	gone, err := tracker.Heartbeat(h.replicaID, h.localUsers())
+	if err != nil {
+		log.Printf("Presence heartbeat error: %v", err)
+		return
+	}
+	for _, userID := range gone {
+		rooms, err := GetChatRoomIDsForUser(userID)
+		if err != nil {
+			log.Printf("Failed to announce %s offline: %v", userID, err)
+			continue
+		}
+		h.announcePresence(userID, false, rooms)
+	}
+}
+
+// localUsers lists the signed-in users connected to this replica.
+func (h *Hub) localUsers() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	users := make([]string, 0, len(h.clients))
+	for userID, devices := range h.clients {
+		for client := range devices {
+			if !client.IsGuest {
+				users = append(users, userID)
+				break
+			}
+		}
+	}
+	return users
+}
+
+// touchActivity records activity in last_active_at at most once per
+// activityTouchInterval per connection.
+func (c *Client) touchActivity() {
+	now := time.Now().UnixNano()
+	last := c.lastActive.Load()
+	if now-last < int64(activityTouchInterval) || !c.lastActive.CompareAndSwap(last, now) {
+		return
+	}
+	goBackground(func() {
+		if err := TouchLastActive(c.UID); err != nil {
+			log.Printf("Failed to record last activity for %s: %v", c.UID, err)
+		}
+	})
+}
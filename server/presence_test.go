@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, c *Client, event string) map[string]interface{} {
+	t.Helper()
+	select {
+	case raw := <-c.send:
+		var msg WSMessage
+		json.Unmarshal(raw, &msg)
+		if msg.Event != event {
+			t.Fatalf("Expected %s on %s, got %s", event, c.UID, raw)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		return payload
+	case <-time.After(200 * time.Millisecond):
+		t.Fatalf("Timeout waiting for %s on %s", event, c.UID)
+	}
+	return nil
+}
+
+func TestTyping_FansOutToRoomAndExpires(t *testing.T) {
+	old := typingTTL
+	typingTTL = 30 * time.Millisecond
+	defer func() { typingTTL = old }()
+
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+	typist, reader := connectClient(hub, "typing-a"), connectClient(hub, "typing-b")
+	hub.JoinRoom("room-typing", typist)
+	hub.JoinRoom("room-typing", reader)
+
+	typist.handleIncomingMessage([]byte(`{"Event":"TYPING_START","Payload":{"ChatID":"room-typing"}}`))
+	payload := expectEvent(t, reader, "TYPING_START")
+	if payload["UserID"] != "typing-a" || payload["ChatID"] != "room-typing" {
+		t.Errorf("Unexpected typing payload: %v", payload)
+	}
+
+	// Without a refresh the indicator lapses server-side
+	expectEvent(t, reader, "TYPING_STOP")
+	hub.typing.mu.Lock()
+	left := len(hub.typing.timers)
+	hub.typing.mu.Unlock()
+	if left != 0 {
+		t.Errorf("Expected expired indicator to be forgotten, %d left", left)
+	}
+}
+
+func TestTyping_StopOnlyWhenTyping(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+	c := connectClient(hub, "typing-stop")
+	hub.JoinRoom("room-stop", c)
+
+	hub.StopTyping("room-stop", c.UID)
+	hub.StartTyping("room-stop", c.UID)
+	expectEvent(t, c, "TYPING_START")
+	hub.StopTyping("room-stop", c.UID)
+	expectEvent(t, c, "TYPING_STOP")
+	time.Sleep(20 * time.Millisecond)
+	if len(c.send) != 0 {
+		t.Errorf("Expected no further frames, got %d", len(c.send))
+	}
+}
+
+func TestTyping_RequiresJoinedRoom(t *testing.T) {
+	c := newProtocolTestClient("typing-outsider")
+	c.handleIncomingMessage([]byte(`{"Event":"TYPING_START","Payload":{"ChatID":"room-private"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "ERROR" || payload["code"] != string(CodeForbidden) {
+		t.Errorf("Expected FORBIDDEN, got %s %v", msg.Event, payload)
+	}
+}
+
+func TestPresence_OfflineAfterLastDevice(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+	watcher := connectClient(hub, "presence-watcher")
+	phone, laptop := connectClient(hub, "presence-user"), connectClient(hub, "presence-user")
+	for _, c := range []*Client{watcher, phone, laptop} {
+		hub.JoinRoom("room-presence", c)
+	}
+
+	hub.unregister <- phone
+	time.Sleep(20 * time.Millisecond)
+	if len(watcher.send) != 0 {
+		t.Fatal("User with another device connected must stay online")
+	}
+
+	hub.unregister <- laptop
+	payload := expectEvent(t, watcher, "PRESENCE")
+	if payload["UserID"] != "presence-user" || payload["Online"] != false || payload["LastSeenAt"] == nil {
+		t.Errorf("Unexpected presence payload: %v", payload)
+	}
+}
+
+func TestPresence_AcrossReplicas(t *testing.T) {
+	a, b := newReplicas(t)
+	watcher := connectClient(a, "presence-watcher")
+	onA, onB := connectClient(a, "presence-roamer"), connectClient(b, "presence-roamer")
+	a.JoinRoom("room-roamer", watcher)
+	a.JoinRoom("room-roamer", onA)
+	b.JoinRoom("room-roamer", onB)
+
+	a.userOnline("presence-roamer", []string{"room-roamer"})
+	if payload := expectEvent(t, watcher, "PRESENCE"); payload["Online"] != true {
+		t.Errorf("Expected online presence, got %v", payload)
+	}
+	b.userOnline("presence-roamer", []string{"room-roamer"})
+	time.Sleep(20 * time.Millisecond)
+	if len(watcher.send) != 0 {
+		t.Fatal("A second replica must not announce a user who is already online")
+	}
+
+	a.unregister <- onA
+	time.Sleep(20 * time.Millisecond)
+	if len(watcher.send) != 0 {
+		t.Fatal("User still connected to another replica must stay online")
+	}
+
+	b.unregister <- onB
+	if payload := expectEvent(t, watcher, "PRESENCE"); payload["Online"] != false {
+		t.Errorf("Expected offline presence, got %v", payload)
+	}
+}
+
+func TestTouchActivity_Throttled(t *testing.T) {
+	c := newProtocolTestClient("activity-user")
+	c.touchActivity()
+	first := c.lastActive.Load()
+	c.touchActivity()
+	if first == 0 || c.lastActive.Load() != first {
+		t.Error("Expected a single last_active_at write per interval")
+	}
+}
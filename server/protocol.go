@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// protocolVersion is the WebSocket protocol this server speaks. Bump it
+	// when a change needs clients to opt in, and gate the new behaviour on it.
+	protocolVersion = 2
+
+	// legacyProtocolVersion is assumed for clients that never send HELLO.
+	legacyProtocolVersion = 1
+)
+
+// serverFeatures are optional capabilities a client may ask for in HELLO.
+var serverFeatures = []string{"request_ids", "acks", "structured_errors", "sync", "paged_history"}
+
+// minProtocolVersion is the oldest client protocol still served
+// (MIN_PROTOCOL_VERSION). Older clients get UPGRADE_REQUIRED for every event.
+func minProtocolVersion() int {
+	if v, err := strconv.Atoi(getEnv("MIN_PROTOCOL_VERSION", "")); err == nil && v > 0 {
+		return v
+	}
+	return legacyProtocolVersion
+}
+
+// wsRequest is an inbound frame. Payload stays raw until the registered
+// handler decodes it into its own payload type.
+type wsRequest struct {
+	Event     string          `json:"Event"`
+	RequestID string          `json:"RequestID,omitempty"`
+	Payload   json.RawMessage `json:"Payload"`
+}
+
+var errInvalidPayload = validationError("Invalid payload")
+
+// wsHandler is a registered event handler. Mutations are acknowledged with
+// ACK or NACK when the request carries a RequestID.
+type wsHandler struct {
+	mutation bool
+	handle   func(c *Client, req *wsRequest) error
+}
+
+var wsHandlers = map[string]wsHandler{}
+
+// on registers fn for event, decoding the payload into a T first. A payload
+// that isn't an object is rejected before fn runs.
+func on[T any](event string, mutation bool, fn func(c *Client, req *wsRequest, p T) error) {
+	wsHandlers[event] = wsHandler{
+		mutation: mutation,
+		handle: func(c *Client, req *wsRequest) error {
+			var p T
+			if len(req.Payload) > 0 && string(req.Payload) != "null" {
+				if err := decodePayload(req.Payload, &p); err != nil {
+					return errInvalidPayload
+				}
+			}
+			return fn(c, req, p)
+		},
+	}
+}
+
+// decodePayload unmarshals an event payload as leniently as the handlers
+// always have: a field of the wrong type (e.g. a numeric ID sent as a number)
+// is left at its zero value and the rest still decode, so the handler's own
+// validation decides. Only a payload of the wrong shape is an error.
+func decodePayload(raw json.RawMessage, v interface{}) error {
+	err := json.Unmarshal(raw, v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return nil
+	}
+	return err
+}
+
+// noPayload is the payload type of events that take no arguments.
+type noPayload struct{}
+
+func (c *Client) handleIncomingMessage(raw []byte) {
+	var req wsRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return
+	}
+
+	// Shutdown waits for this read lock, so a handler that has started
+	// finishes its writes before the pool closes
+	c.hub.work.RLock()
+	defer c.hub.work.RUnlock()
+	h, ok := wsHandlers[req.Event]
+	if c.hub.draining.Load() {
+		c.fail(&req, h.mutation, unavailableError("Server is shutting down", reconnectDelay()))
+		return
+	}
+	if req.Event != "HELLO" {
+		if minVersion := minProtocolVersion(); c.ProtocolVersion() < minVersion {
+			c.fail(&req, h.mutation, upgradeRequiredError(minVersion))
+			return
+		}
+	}
+	if c.IsGuest && !guestEvents[req.Event] {
+		c.fail(&req, h.mutation, unauthorizedError("Sign in required"))
+		return
+	}
+	if !c.IsGuest {
+		c.touchActivity()
+	}
+	if !ok {
+		c.fail(&req, false, notFoundError("Unknown event"))
+		return
+	}
+
+	if err := h.handle(c, &req); err != nil {
+		c.fail(&req, h.mutation, err)
+		return
+	}
+	if h.mutation && req.RequestID != "" {
+		c.reply(&req, "ACK", map[string]string{"event": req.Event})
+	}
+}
+
+// fail reports a handler error as an APIError tagged with the request's
+// event. Mutations sent with a RequestID get a NACK; everything else gets ERROR.
+func (c *Client) fail(req *wsRequest, mutation bool, err error) {
+	e := *asAPIError(err) // copy: shared error values must not be mutated
+	e.Event = req.Event
+	logAPIError(req.Event+" from "+c.UID, &e)
+
+	event := "ERROR"
+	if mutation && req.RequestID != "" {
+		event = "NACK"
+	}
+	c.reply(req, event, &e)
+}
+
+// encodeEvent builds an outbound frame for fan-out to other clients.
+func encodeEvent(event string, payload interface{}) []byte {
+	msg, _ := json.Marshal(WSMessage{Event: event, Payload: payload})
+	return msg
+}
+
+// reply sends an event to this client, echoing the request's RequestID.
+func (c *Client) reply(req *wsRequest, event string, payload interface{}) {
+	msg, _ := json.Marshal(WSMessage{Event: event, Payload: payload, RequestID: req.RequestID})
+	c.enqueue(msg)
+}
+
+// enqueue queues an encoded frame for writePump without blocking. When the
+// queue is full the hub's SlowClientPolicy decides what gives way. Frames for
+// a client that has been unregistered are discarded.
+func (c *Client) enqueue(msg []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return c.hub.overflow(c, msg)
+	}
+}
+
+// closeSend closes the send queue, telling writePump to close the socket.
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
+	}
+}
+
+// ProtocolVersion is the version negotiated by HELLO.
+func (c *Client) ProtocolVersion() int {
+	c.protoMu.RLock()
+	defer c.protoMu.RUnlock()
+	if c.protocol == 0 {
+		return legacyProtocolVersion
+	}
+	return c.protocol
+}
+
+// Supports reports whether feature was negotiated for this connection.
+// Handlers use it to branch between old and new behaviour.
+func (c *Client) Supports(feature string) bool {
+	c.protoMu.RLock()
+	defer c.protoMu.RUnlock()
+	return c.features[feature]
+}
+
+// requireProtocol rejects the request if the client is older than version.
+func (c *Client) requireProtocol(version int) error {
+	if c.ProtocolVersion() < version {
+		return upgradeRequiredError(version)
+	}
+	return nil
+}
+
+type helloPayload struct {
+	Version  int      `json:"Version"`
+	Features []string `json:"Features"`
+	Client   string   `json:"Client"` // app name/version, for logs
+}
+
+// handleHello negotiates the protocol version and the features both sides
+// support, and replies with WELCOME. It may be sent again to renegotiate.
+func handleHello(c *Client, req *wsRequest, p helloPayload) error {
+	if p.Version <= 0 {
+		return requiredError("Version")
+	}
+	if minVersion := minProtocolVersion(); p.Version < minVersion {
+		return upgradeRequiredError(minVersion)
+	}
+
+	version := p.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	requested := make(map[string]bool, len(p.Features))
+	for _, f := range p.Features {
+		requested[f] = true
+	}
+	enabled := make(map[string]bool)
+	features := []string{}
+	for _, f := range serverFeatures {
+		if requested[f] {
+			enabled[f] = true
+			features = append(features, f)
+		}
+	}
+
+	c.protoMu.Lock()
+	c.protocol = version
+	c.features = enabled
+	c.protoMu.Unlock()
+
+	c.reply(req, "WELCOME", map[string]interface{}{
+		"Version":       version,
+		"ServerVersion": protocolVersion,
+		"MinVersion":    minProtocolVersion(),
+		"Features":      features,
+		"ServerTime":    time.Now().UTC(),
+	})
+	return nil
+}
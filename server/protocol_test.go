@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newProtocolTestClient(uid string) *Client {
+	return &Client{UID: uid, send: make(chan []byte, 10), hub: NewHub()}
+}
+
+func readReply(t *testing.T, c *Client) (WSMessage, map[string]interface{}) {
+	t.Helper()
+	select {
+	case raw := <-c.send:
+		var msg WSMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			t.Fatalf("Failed to unmarshal reply: %v", err)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		return msg, payload
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Timeout waiting for reply")
+	}
+	return WSMessage{}, nil
+}
+
+func TestProtocol_AckEchoesRequestID(t *testing.T) {
+	c := newProtocolTestClient("user-ack")
+	c.handleIncomingMessage([]byte(`{"Event":"LEAVE_ROOM","RequestID":"r-1","Payload":{"RoomID":"room-1"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "ACK" || msg.RequestID != "r-1" {
+		t.Errorf("Expected ACK for r-1, got %s %q", msg.Event, msg.RequestID)
+	}
+	if payload["event"] != "LEAVE_ROOM" {
+		t.Errorf("Expected ACK to name the acknowledged event, got %v", payload["event"])
+	}
+}
+
+func TestProtocol_NoAckWithoutRequestID(t *testing.T) {
+	c := newProtocolTestClient("user-noack")
+	c.handleIncomingMessage([]byte(`{"Event":"LEAVE_ROOM","Payload":{"RoomID":"room-1"}}`))
+
+	if len(c.send) != 0 {
+		t.Errorf("Expected no reply without a RequestID, got %d", len(c.send))
+	}
+}
+
+func TestProtocol_MutationFailureIsNack(t *testing.T) {
+	c := newProtocolTestClient("actual-user")
+	c.handleIncomingMessage([]byte(`{"Event":"DELETE_USER","RequestID":"r-2","Payload":{"UserID":"someone-else"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "NACK" || msg.RequestID != "r-2" {
+		t.Fatalf("Expected NACK for r-2, got %s %q", msg.Event, msg.RequestID)
+	}
+	if payload["message"] != "Not authorized to delete this user" || payload["event"] != "DELETE_USER" || payload["code"] != "FORBIDDEN" {
+		t.Errorf("Unexpected NACK payload: %v", payload)
+	}
+}
+
+func TestProtocol_QueryFailureIsErrorWithRequestID(t *testing.T) {
+	c := newProtocolTestClient("user-query")
+	c.handleIncomingMessage([]byte(`{"Event":"REVERSE_GEOCODE","RequestID":"r-3","Payload":{"lat":0,"lon":0}}`))
+
+	msg, _ := readReply(t, c)
+	if msg.Event != "ERROR" || msg.RequestID != "r-3" {
+		t.Errorf("Expected ERROR for r-3, got %s %q", msg.Event, msg.RequestID)
+	}
+}
+
+func TestProtocol_MistypedFieldIsLenient(t *testing.T) {
+	type lenient struct {
+		ChatID string
+		Limit  int
+	}
+	var got lenient
+	on("TEST_LENIENT", true, func(c *Client, req *wsRequest, p lenient) error {
+		got = p
+		return nil
+	})
+	defer delete(wsHandlers, "TEST_LENIENT")
+
+	c := newProtocolTestClient("user-lenient")
+	c.handleIncomingMessage([]byte(`{"Event":"TEST_LENIENT","RequestID":"r-3","Payload":{"ChatID":42,"Limit":5}}`))
+
+	// As before typed payloads, the mistyped ID is left empty for the handler to validate
+	if msg, _ := readReply(t, c); msg.Event != "ACK" {
+		t.Errorf("Expected ACK, got %s", msg.Event)
+	}
+	if got.ChatID != "" || got.Limit != 5 {
+		t.Errorf("Expected the well-typed fields to decode, got %+v", got)
+	}
+}
+
+func TestProtocol_UndecodablePayload(t *testing.T) {
+	c := newProtocolTestClient("user-decode")
+	c.handleIncomingMessage([]byte(`{"Event":"LEAVE_ROOM","RequestID":"r-4","Payload":"room-1"}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "NACK" || payload["message"] != "Invalid payload" {
+		t.Errorf("Expected invalid payload NACK, got %s %v", msg.Event, payload)
+	}
+}
+
+func TestProtocol_UnknownEvent(t *testing.T) {
+	c := newProtocolTestClient("user-unknown")
+	c.handleIncomingMessage([]byte(`{"Event":"NOPE","RequestID":"r-5"}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "ERROR" || msg.RequestID != "r-5" || payload["message"] != "Unknown event" {
+		t.Errorf("Expected unknown event error, got %s %q %v", msg.Event, msg.RequestID, payload)
+	}
+}
+
+func TestProtocol_GuestMutationIsNack(t *testing.T) {
+	c := newProtocolTestClient("guest-1")
+	c.IsGuest = true
+	c.handleIncomingMessage([]byte(`{"Event":"SWIPE","RequestID":"r-6","Payload":{"PartyID":"p"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "NACK" || payload["message"] != "Sign in required" {
+		t.Errorf("Expected sign-in NACK, got %s %v", msg.Event, payload)
+	}
+}
+
+func TestProtocol_CreatePartyValidationErrors(t *testing.T) {
+	c := newProtocolTestClient("host-1")
+	c.handleIncomingMessage([]byte(`{"Event":"CREATE_PARTY","RequestID":"r-7","Payload":{"Title":""}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "NACK" || payload["message"] != "Validation failed" {
+		t.Fatalf("Expected validation NACK, got %s %v", msg.Event, payload)
+	}
+	if errs, _ := payload["errors"].([]interface{}); len(errs) == 0 {
+		t.Error("Expected field errors in NACK payload")
+	}
+	if fields, _ := payload["fields"].([]interface{}); len(fields) != len(payload["errors"].([]interface{})) {
+		t.Errorf("Expected one field entry per error, got %v", payload["fields"])
+	}
+}
+
+func TestParsePartyTime(t *testing.T) {
+	for _, s := range []string{"2026-05-01T20:00:00Z", "2026-05-01T20:00:00.000Z", "2026-05-01 20:00:00", "2026-05-01T20:00:00+02:00"} {
+		if parsePartyTime(s).IsZero() {
+			t.Errorf("Expected %q to parse", s)
+		}
+	}
+	if !parsePartyTime("tomorrow").IsZero() {
+		t.Error("Expected unparseable time to be zero")
+	}
+}
+
+func TestCreatePartyPayload_DurationDefault(t *testing.T) {
+	p := createPartyPayload{StartTime: "2026-05-01T20:00:00Z"}.toParty()
+	if p.DurationHours != 2 {
+		t.Errorf("Expected default duration 2, got %d", p.DurationHours)
+	}
+	four := 4.0
+	p = createPartyPayload{StartTime: "2026-05-01T20:00:00Z", DurationHours: &four}.toParty()
+	if p.DurationHours != 4 {
+		t.Errorf("Expected duration 4, got %d", p.DurationHours)
+	}
+}
+
+func TestHello_NegotiatesVersionAndFeatures(t *testing.T) {
+	c := newProtocolTestClient("user-hello")
+	if c.ProtocolVersion() != legacyProtocolVersion {
+		t.Fatalf("Expected legacy version before HELLO, got %d", c.ProtocolVersion())
+	}
+
+	c.handleIncomingMessage([]byte(`{"Event":"HELLO","RequestID":"h-1","Payload":{"Version":99,"Features":["acks","teleport"]}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "WELCOME" || msg.RequestID != "h-1" {
+		t.Fatalf("Expected WELCOME for h-1, got %s %q", msg.Event, msg.RequestID)
+	}
+	if payload["Version"] != float64(protocolVersion) || payload["ServerVersion"] != float64(protocolVersion) {
+		t.Errorf("Expected version capped at %d, got %v", protocolVersion, payload["Version"])
+	}
+	if features, _ := payload["Features"].([]interface{}); len(features) != 1 || features[0] != "acks" {
+		t.Errorf("Expected only shared features, got %v", payload["Features"])
+	}
+	if _, ok := payload["ServerTime"].(string); !ok {
+		t.Error("Expected ServerTime in WELCOME")
+	}
+	if !c.Supports("acks") || c.Supports("teleport") || c.ProtocolVersion() != protocolVersion {
+		t.Error("Expected negotiated state to be stored on the client")
+	}
+}
+
+func TestHello_RejectsOldClients(t *testing.T) {
+	os.Setenv("MIN_PROTOCOL_VERSION", "2")
+	defer os.Unsetenv("MIN_PROTOCOL_VERSION")
+
+	// Clients that skip HELLO are legacy and must upgrade
+	c := newProtocolTestClient("user-legacy")
+	c.handleIncomingMessage([]byte(`{"Event":"GET_CHATS"}`))
+	msg, payload := readReply(t, c)
+	if msg.Event != "ERROR" || payload["code"] != "UPGRADE_REQUIRED" {
+		t.Errorf("Expected UPGRADE_REQUIRED, got %s %v", msg.Event, payload)
+	}
+
+	c.handleIncomingMessage([]byte(`{"Event":"HELLO","Payload":{"Version":1}}`))
+	if msg, payload = readReply(t, c); payload["code"] != "UPGRADE_REQUIRED" {
+		t.Errorf("Expected HELLO with old version to be rejected, got %s %v", msg.Event, payload)
+	}
+
+	c.handleIncomingMessage([]byte(`{"Event":"HELLO","Payload":{"Version":2}}`))
+	if msg, _ = readReply(t, c); msg.Event != "WELCOME" {
+		t.Errorf("Expected WELCOME for current client, got %s", msg.Event)
+	}
+	if err := c.requireProtocol(protocolVersion + 1); asAPIError(err).Code != CodeUpgradeRequired {
+		t.Errorf("Expected requireProtocol to reject newer requirement, got %v", err)
+	}
+}
+
+func TestSync_RejectsTooManyChats(t *testing.T) {
+	c := newProtocolTestClient("user-sync")
+	cursors := make(map[string]int64)
+	for i := 0; i <= maxSyncChats; i++ {
+		cursors[generateDMChatId("user-sync", "peer-"+string(rune('a'+i%26))+string(rune('a'+i/26)))] = 1
+	}
+	raw, _ := json.Marshal(map[string]interface{}{"Event": "SYNC", "RequestID": "s-1", "Payload": map[string]interface{}{"Cursors": cursors}})
+	c.handleIncomingMessage(raw)
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "ERROR" || payload["code"] != "VALIDATION" {
+		t.Errorf("Expected VALIDATION error, got %s %v", msg.Event, payload)
+	}
+}
+
+func TestSync_SkipsChatsTheUserIsNotIn(t *testing.T) {
+	c := newProtocolTestClient("user-sync")
+	c.handleIncomingMessage([]byte(`{"Event":"SYNC","RequestID":"s-2","Payload":{"Cursors":{"other_someone":3}}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "SYNC_RESULT" || msg.RequestID != "s-2" {
+		t.Fatalf("Expected SYNC_RESULT for s-2, got %s %q", msg.Event, msg.RequestID)
+	}
+	if chats, _ := payload["Chats"].([]interface{}); len(chats) != 0 {
+		t.Errorf("Expected no chats for a non-member, got %v", chats)
+	}
+}
+
+func TestAckDelivery_RequiresChatAndSeq(t *testing.T) {
+	c := newProtocolTestClient("user-ack-delivery")
+	c.handleIncomingMessage([]byte(`{"Event":"ACK_DELIVERY","RequestID":"d-1","Payload":{"ChatID":"room-1"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "NACK" || payload["code"] != "VALIDATION" {
+		t.Errorf("Expected VALIDATION NACK, got %s %v", msg.Event, payload)
+	}
+}
+
+func TestSendMessage_RejectsLongClientMessageID(t *testing.T) {
+	long := strings.Repeat("x", maxClientMessageID+1)
+	for _, frame := range []string{
+		`{"Event":"SEND_MESSAGE","RequestID":"m-1","Payload":{"ChatID":"room-1","Content":"hi","ClientMessageID":"` + long + `"}}`,
+		`{"Event":"SEND_DM","RequestID":"m-1","Payload":{"RecipientID":"peer","Content":"hi","ClientMessageID":"` + long + `"}}`,
+	} {
+		c := newProtocolTestClient("user-idem")
+		c.handleIncomingMessage([]byte(frame))
+
+		msg, payload := readReply(t, c)
+		if msg.Event != "NACK" || payload["message"] != "Invalid ClientMessageID" {
+			t.Errorf("Expected ClientMessageID NACK, got %s %v", msg.Event, payload)
+		}
+	}
+}
+
+func TestSendDM_Validation(t *testing.T) {
+	for frame, code := range map[string]string{
+		`{"Event":"SEND_DM","RequestID":"dm-1","Payload":{"Content":"hi"}}`:                                    "VALIDATION",
+		`{"Event":"SEND_DM","RequestID":"dm-2","Payload":{"RecipientID":"not-a-user","Content":"hi"}}`:         "VALIDATION",
+		`{"Event":"SEND_DM","RequestID":"dm-3","Payload":{"RecipientID":"` + dmTestUser + `","Content":"hi"}}`: "VALIDATION",
+		`{"Event":"GET_CHAT_HISTORY","RequestID":"dm-4","Payload":{"ChatID":"other_someone"}}`:                 "FORBIDDEN",
+	} {
+		c := newProtocolTestClient(dmTestUser)
+		c.handleIncomingMessage([]byte(frame))
+
+		msg, payload := readReply(t, c)
+		if payload["code"] != code {
+			t.Errorf("%s: expected %s, got %s %v", frame, code, msg.Event, payload)
+		}
+	}
+}
+
+// dmTestUser is a well-formed user ID that messages itself in TestSendDM_Validation.
+const dmTestUser = "0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f"
+
+func TestMarkChatRead_Validation(t *testing.T) {
+	for frame, code := range map[string]string{
+		`{"Event":"MARK_CHAT_READ","RequestID":"mr-1","Payload":{"ChatID":"room-1","Seq":-1}}`:       "VALIDATION",
+		`{"Event":"MARK_CHAT_READ","RequestID":"mr-2","Payload":{"ChatID":"other_someone","Seq":3}}`: "FORBIDDEN",
+		`{"Event":"GET_READ_STATE","RequestID":"mr-3","Payload":{"ChatID":"other_someone"}}`:         "FORBIDDEN",
+		`{"Event":"MARK_CHAT_READ","RequestID":"mr-4","Payload":{"Seq":3}}`:                          "VALIDATION",
+	} {
+		c := newProtocolTestClient("user-reader")
+		c.handleIncomingMessage([]byte(frame))
+
+		_, payload := readReply(t, c)
+		if payload["code"] != code {
+			t.Errorf("Expected %s for %s, got %v", code, frame, payload)
+		}
+	}
+}
+
+func TestMessageEvents_Validation(t *testing.T) {
+	for frame, code := range map[string]string{
+		`{"Event":"EDIT_MESSAGE","RequestID":"e-1","Payload":{"MessageID":"m","Content":"  "}}`:          "VALIDATION",
+		`{"Event":"EDIT_MESSAGE","RequestID":"e-2","Payload":{"MessageID":"not-a-uuid","Content":"hi"}}`: "NOT_FOUND",
+		`{"Event":"DELETE_MESSAGE","RequestID":"e-3","Payload":{}}`:                                      "VALIDATION",
+		`{"Event":"DELETE_DM_MESSAGE","RequestID":"e-4","Payload":{"MessageID":"not-a-uuid"}}`:           "NOT_FOUND",
+		`{"Event":"REACT_TO_MESSAGE","RequestID":"e-5","Payload":{"MessageID":"m","Emoji":""}}`:          "VALIDATION",
+		`{"Event":"REACT_TO_MESSAGE","RequestID":"e-6","Payload":{"MessageID":"m","Emoji":"🎉 🎉"}}`:       "VALIDATION",
+		`{"Event":"GET_MESSAGE_EDITS","RequestID":"e-7","Payload":{"MessageID":"not-a-uuid"}}`:           "NOT_FOUND",
+	} {
+		c := newProtocolTestClient("user-editor")
+		c.handleIncomingMessage([]byte(frame))
+
+		_, payload := readReply(t, c)
+		if payload["code"] != code {
+			t.Errorf("Expected %s for %s, got %v", code, frame, payload)
+		}
+	}
+}
+
+func TestSendMessage_DeclinedDMRequester(t *testing.T) {
+	useTestDB(t)
+	requester, recipient := createTestDBUser(t, "requester"), createTestDBUser(t, "recipient")
+	room, _, err := GetOrCreateDMRoom(requester, recipient, DMPending)
+	if err != nil {
+		t.Fatalf("create DM: %v", err)
+	}
+	if _, err := RespondToDMRequest(room.ID, recipient, DMDeclined); err != nil {
+		t.Fatalf("decline: %v", err)
+	}
+
+	// Neither the room ID nor the pair key gets around the declined request
+	for _, chatID := range []string{room.ID, room.DMKey} {
+		c := newProtocolTestClient(requester)
+		c.handleIncomingMessage([]byte(`{"Event":"SEND_MESSAGE","RequestID":"m-1","Payload":{"ChatID":"` + chatID + `","Content":"hi again"}}`))
+
+		msg, payload := readReply(t, c)
+		if msg.Event != "NACK" || payload["code"] != "FORBIDDEN" {
+			t.Errorf("%s: expected FORBIDDEN NACK, got %s %v", chatID, msg.Event, payload)
+		}
+	}
+}
+
+func TestNewDMStatus(t *testing.T) {
+	tests := []struct {
+		privacy     DMPrivacy
+		sharesParty bool
+		want        DMStatus
+	}{
+		{DMPrivacyEveryone, true, DMAccepted},
+		{DMPrivacyEveryone, false, DMPending},
+		{DMPrivacyParties, true, DMAccepted},
+		{DMPrivacyParties, false, ""},
+		{DMPrivacyNobody, true, ""},
+	}
+	for _, tt := range tests {
+		got, err := newDMStatus(tt.privacy, tt.sharesParty)
+		if got != tt.want || (tt.want == "") != (err != nil) {
+			t.Errorf("newDMStatus(%s, %v) = %q, %v; want %q", tt.privacy, tt.sharesParty, got, err, tt.want)
+		}
+	}
+}
+
+func TestDMStatusAfterSend(t *testing.T) {
+	request := func(status DMStatus) ChatRoom {
+		return ChatRoom{DMStatus: status, DMRequestedBy: "dm-sender"}
+	}
+	tests := []struct {
+		name        string
+		room        ChatRoom
+		senderID    string
+		sharesParty bool
+		want        DMStatus
+	}{
+		{"sender follows up", request(DMPending), "dm-sender", false, DMPending},
+		{"recipient replies", request(DMPending), "dm-recipient", false, DMAccepted},
+		{"shared a party since", request(DMPending), "dm-sender", true, DMAccepted},
+		{"declined sender", request(DMDeclined), "dm-sender", false, ""},
+		{"decliner writes back", request(DMDeclined), "dm-recipient", false, DMAccepted},
+		{"accepted", request(DMAccepted), "dm-sender", false, DMAccepted},
+	}
+	for _, tt := range tests {
+		got, err := dmStatusAfterSend(tt.room, tt.senderID, tt.sharesParty)
+		if got != tt.want || (tt.want == "") != (err != nil) {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDMRequestEvents_Validation(t *testing.T) {
+	for frame, code := range map[string]string{
+		`{"Event":"ACCEPT_DM_REQUEST","RequestID":"rq-1","Payload":{}}`:                   "VALIDATION",
+		`{"Event":"DECLINE_DM_REQUEST","RequestID":"rq-2","Payload":{"ChatID":"room-1"}}`: "NOT_FOUND",
+		`{"Event":"SET_DM_PRIVACY","RequestID":"rq-3","Payload":{"DMPrivacy":"FRIENDS"}}`: "VALIDATION",
+		`{"Event":"SET_DM_PRIVACY","RequestID":"rq-4","Payload":{}}`:                      "VALIDATION",
+	} {
+		c := newProtocolTestClient("user-requests")
+		c.handleIncomingMessage([]byte(frame))
+
+		msg, payload := readReply(t, c)
+		if msg.Event != "NACK" || payload["code"] != code {
+			t.Errorf("%s: expected %s NACK, got %s %v", frame, code, msg.Event, payload)
+		}
+	}
+}
+
+func TestHistoryQuery_Validation(t *testing.T) {
+	for _, frame := range []string{
+		`{"Event":"GET_CHAT_HISTORY","RequestID":"h-1","Payload":{"ChatID":"room-1","Before":"a","After":"b"}}`,
+		`{"Event":"GET_DM_MESSAGES","RequestID":"h-2","Payload":{"OtherUserID":"peer","Around":"a","Before":"b"}}`,
+	} {
+		c := newProtocolTestClient("user-history")
+		c.handleIncomingMessage([]byte(frame))
+
+		msg, payload := readReply(t, c)
+		if msg.Event != "ERROR" || payload["code"] != "VALIDATION" {
+			t.Errorf("Expected VALIDATION for %s, got %s %v", frame, msg.Event, payload)
+		}
+	}
+
+	q := historyQuery{Limit: maxHistoryLimit + 1}
+	if err := q.validate(); err != nil || q.Limit != maxHistoryLimit {
+		t.Errorf("Expected Limit capped at %d, got %d (%v)", maxHistoryLimit, q.Limit, err)
+	}
+}
+
+func TestReplyHistory_LegacyAndPaged(t *testing.T) {
+	page := func() historyPage {
+		return historyPage{
+			ChatID:     "room-1",
+			Messages:   []ChatMessage{{ID: "m-1"}, {ID: "m-2"}},
+			HasMore:    true,
+			NextCursor: "m-1",
+		}
+	}
+
+	legacy := newProtocolTestClient("user-legacy-history")
+	replyHistory(legacy, &wsRequest{RequestID: "h-3"}, "CHAT_HISTORY", page())
+	raw := <-legacy.send
+	var list struct{ Payload []ChatMessage }
+	json.Unmarshal(raw, &list)
+	if len(list.Payload) != 2 || list.Payload[0].ID != "m-2" {
+		t.Errorf("Expected the legacy list newest first, got %s", raw)
+	}
+
+	paged := newProtocolTestClient("user-paged-history")
+	paged.features = map[string]bool{"paged_history": true}
+	replyHistory(paged, &wsRequest{RequestID: "h-4"}, "CHAT_HISTORY", page())
+	_, payload := readReply(t, paged)
+	msgs, _ := payload["Messages"].([]interface{})
+	if len(msgs) != 2 || payload["HasMore"] != true || payload["NextCursor"] != "m-1" {
+		t.Errorf("Unexpected page: %v", payload)
+	}
+	if first, _ := msgs[0].(map[string]interface{}); first["ID"] != "m-1" {
+		t.Errorf("Expected the page oldest first, got %v", msgs)
+	}
+}
+
+func TestSearchMessages_Validation(t *testing.T) {
+	for frame, code := range map[string]string{
+		`{"Event":"SEARCH_MESSAGES","RequestID":"q-1","Payload":{"Query":"   "}}`:                              "VALIDATION",
+		`{"Event":"SEARCH_MESSAGES","RequestID":"q-2","Payload":{"Query":"` + strings.Repeat("a", 201) + `"}}`: "VALIDATION",
+		`{"Event":"SEARCH_MESSAGES","RequestID":"q-3","Payload":{"Query":"address","Before":"not-a-message"}}`: "VALIDATION",
+		`{"Event":"SEARCH_MESSAGES","RequestID":"q-4","Payload":{"Query":"address","ChatID":"other_someone"}}`: "FORBIDDEN",
+	} {
+		c := newProtocolTestClient("user-search")
+		c.handleIncomingMessage([]byte(frame))
+
+		msg, payload := readReply(t, c)
+		if msg.Event != "ERROR" || payload["code"] != code {
+			t.Errorf("%s: expected %s, got %s %v", frame, code, msg.Event, payload)
+		}
+	}
+}
+
+func TestSearchMessages_EmptyForNonUUIDUser(t *testing.T) {
+	c := newProtocolTestClient("user-search")
+	c.handleIncomingMessage([]byte(`{"Event":"SEARCH_MESSAGES","RequestID":"q-5","Payload":{"Query":"address"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "MESSAGE_SEARCH_RESULTS" || payload["HasMore"] != false {
+		t.Fatalf("Expected empty MESSAGE_SEARCH_RESULTS, got %s %v", msg.Event, payload)
+	}
+	if results, ok := payload["Results"].([]interface{}); !ok || len(results) != 0 {
+		t.Errorf("Expected an empty result list, got %v", payload["Results"])
+	}
+}
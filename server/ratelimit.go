@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// attemptPolicy controls how an attemptLimiter slows down repeated failures.
+type attemptPolicy struct {
+	FreeAttempts int           // failures allowed before any delay
+	BaseDelay    time.Duration // first delay, doubled on every further failure
+	MaxFailures  int           // failures that trigger a full lockout
+	Lockout      time.Duration // lockout length; failures older than this are forgotten
+}
+
+var (
+	// Per account (email): a handful of typos are free, then backoff, then a 15 minute lockout
+	accountLoginPolicy = attemptPolicy{FreeAttempts: 5, BaseDelay: time.Second, MaxFailures: 10, Lockout: 15 * time.Minute}
+	// Per IP: looser, since many users can share a NAT
+	ipLoginPolicy = attemptPolicy{FreeAttempts: 20, BaseDelay: time.Second, MaxFailures: 100, Lockout: time.Hour}
+	// Password reset emails count every request, not just failures
+	emailResetPolicy = attemptPolicy{FreeAttempts: 3, BaseDelay: time.Minute, MaxFailures: 10, Lockout: time.Hour}
+	ipResetPolicy    = attemptPolicy{FreeAttempts: 10, BaseDelay: time.Minute, MaxFailures: 50, Lockout: time.Hour}
+)
+
+// maxTrackedKeys bounds memory; stale entries are swept when it is exceeded.
+const maxTrackedKeys = 10000
+
+type attemptState struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// attemptLimiter tracks failed attempts per key in memory with exponential
+// backoff and temporary lockout. State is per process.
+type attemptLimiter struct {
+	policy  attemptPolicy
+	mu      sync.Mutex
+	entries map[string]*attemptState
+}
+
+func newAttemptLimiter(policy attemptPolicy) *attemptLimiter {
+	return &attemptLimiter{policy: policy, entries: make(map[string]*attemptState)}
+}
+
+// Check reports how long the key must wait before its next attempt. Zero
+// means the attempt may proceed.
+func (l *attemptLimiter) Check(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(st.blockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Reserve is Check and Fail in one step: if the key may proceed, the attempt
+// is counted as failed straight away, so concurrent attempts can't all pass
+// before any of them fails. Refund or Reset the key if the attempt succeeds.
+func (l *attemptLimiter) Reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.entries[key]; ok {
+		if wait := time.Until(st.blockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	l.fail(key)
+	return 0
+}
+
+// Refund takes back one attempt counted by Reserve.
+func (l *attemptLimiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	st.failures--
+	if st.failures <= 0 {
+		delete(l.entries, key)
+		return
+	}
+	st.blockedUntil = time.Time{}
+	l.block(st)
+}
+
+// Fail records a failed attempt and updates the key's backoff.
+func (l *attemptLimiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail(key)
+}
+
+func (l *attemptLimiter) fail(key string) {
+	now := time.Now()
+	st, ok := l.entries[key]
+	if !ok || now.Sub(st.lastFailure) > l.policy.Lockout {
+		if len(l.entries) >= maxTrackedKeys {
+			l.sweep(now)
+		}
+		st = &attemptState{}
+		l.entries[key] = st
+	}
+	st.failures++
+	st.lastFailure = now
+	l.block(st)
+}
+
+// block sets the backoff for the key's failure count, from its last failure.
+func (l *attemptLimiter) block(st *attemptState) {
+	switch {
+	case st.failures >= l.policy.MaxFailures:
+		st.blockedUntil = st.lastFailure.Add(l.policy.Lockout)
+	case st.failures > l.policy.FreeAttempts:
+		delay := l.policy.BaseDelay << uint(st.failures-l.policy.FreeAttempts-1)
+		if delay <= 0 || delay > l.policy.Lockout {
+			delay = l.policy.Lockout
+		}
+		st.blockedUntil = st.lastFailure.Add(delay)
+	}
+}
+
+// Reset forgets a key's failures, e.g. after a successful login.
+func (l *attemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	delete(l.entries, key)
+	l.mu.Unlock()
+}
+
+func (l *attemptLimiter) sweep(now time.Time) {
+	for key, st := range l.entries {
+		if now.Sub(st.lastFailure) > l.policy.Lockout && now.After(st.blockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+var (
+	loginAccountLimiter = newAttemptLimiter(accountLoginPolicy)
+	loginIPLimiter      = newAttemptLimiter(ipLoginPolicy)
+	resetEmailLimiter   = newAttemptLimiter(emailResetPolicy)
+	resetIPLimiter      = newAttemptLimiter(ipResetPolicy)
+)
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash returns a bcrypt hash of a random password, compared
+// against when the email is unknown so both paths cost one bcrypt check.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		dummyHash, _ = bcrypt.GenerateFromPassword(secret, bcrypt.DefaultCost)
+	})
+	return string(dummyHash)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPolicy = attemptPolicy{FreeAttempts: 2, BaseDelay: time.Second, MaxFailures: 5, Lockout: time.Minute}
+
+func TestAttemptLimiter_FreeAttempts(t *testing.T) {
+	l := newAttemptLimiter(testPolicy)
+	l.Fail("k")
+	l.Fail("k")
+	if wait := l.Check("k"); wait != 0 {
+		t.Errorf("Expected no delay within free attempts, got %v", wait)
+	}
+}
+
+func TestAttemptLimiter_ExponentialBackoff(t *testing.T) {
+	l := newAttemptLimiter(testPolicy)
+	for i := 0; i < 3; i++ {
+		l.Fail("k")
+	}
+	first := l.Check("k")
+	if first <= 0 || first > time.Second {
+		t.Errorf("Expected ~1s delay after first paid failure, got %v", first)
+	}
+
+	l.Fail("k")
+	second := l.Check("k")
+	if second <= time.Second || second > 2*time.Second {
+		t.Errorf("Expected ~2s delay after second paid failure, got %v", second)
+	}
+}
+
+func TestAttemptLimiter_Lockout(t *testing.T) {
+	l := newAttemptLimiter(testPolicy)
+	for i := 0; i < testPolicy.MaxFailures; i++ {
+		l.Fail("k")
+	}
+	if wait := l.Check("k"); wait <= 30*time.Second {
+		t.Errorf("Expected a lockout close to %v, got %v", testPolicy.Lockout, wait)
+	}
+	if wait := l.Check("other"); wait != 0 {
+		t.Errorf("Other keys must not be affected, got %v", wait)
+	}
+}
+
+func TestAttemptLimiter_Reset(t *testing.T) {
+	l := newAttemptLimiter(testPolicy)
+	for i := 0; i < testPolicy.MaxFailures; i++ {
+		l.Fail("k")
+	}
+	l.Reset("k")
+	if wait := l.Check("k"); wait != 0 {
+		t.Errorf("Expected no delay after reset, got %v", wait)
+	}
+}
+
+func TestAttemptLimiter_ForgetsOldFailures(t *testing.T) {
+	l := newAttemptLimiter(attemptPolicy{FreeAttempts: 1, BaseDelay: time.Millisecond, MaxFailures: 3, Lockout: 20 * time.Millisecond})
+	l.Fail("k")
+	l.Fail("k")
+	time.Sleep(30 * time.Millisecond)
+	l.Fail("k")
+	if wait := l.Check("k"); wait != 0 {
+		t.Errorf("Failures outside the window should be forgotten, got %v", wait)
+	}
+}
+
+func TestAttemptLimiter_ReserveIsAtomic(t *testing.T) {
+	l := newAttemptLimiter(testPolicy)
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.Reserve("k") == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The free attempts plus the one that starts the backoff get through
+	if got := allowed.Load(); got != int32(testPolicy.FreeAttempts+1) {
+		t.Errorf("Expected %d parallel attempts to proceed, got %d", testPolicy.FreeAttempts+1, got)
+	}
+}
+
+func TestAttemptLimiter_Refund(t *testing.T) {
+	l := newAttemptLimiter(testPolicy)
+	for i := 0; i <= testPolicy.FreeAttempts; i++ {
+		l.Reserve("k")
+	}
+	if wait := l.Check("k"); wait <= 0 {
+		t.Fatalf("Expected a delay after %d reserved attempts", testPolicy.FreeAttempts+1)
+	}
+
+	l.Refund("k")
+	if wait := l.Check("k"); wait != 0 {
+		t.Errorf("Expected refunded attempt to lift the delay, got %v", wait)
+	}
+	l.Refund("k")
+	l.Refund("k")
+	l.Refund("k")
+	if _, ok := l.entries["k"]; ok {
+		t.Error("Expected key to be forgotten once every attempt is refunded")
+	}
+}
+
+func TestHandleLogin_UniformErrorThenRateLimited(t *testing.T) {
+	body := `{"email":"bruteforce-target@example.com","password":"guess"}`
+
+	var last *httptest.ResponseRecorder
+	for i := 0; i <= accountLoginPolicy.FreeAttempts; i++ {
+		last = httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(body))
+		req.RemoteAddr = "198.51.100.9:1234"
+		handleLogin(last, req)
+
+		if last.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected %d, got %d", i+1, http.StatusUnauthorized, last.Code)
+		}
+		if got := last.Body.String(); got != "{\"code\":\"UNAUTHORIZED\",\"message\":\"Invalid credentials\"}\n" {
+			t.Fatalf("Attempt %d: expected uniform error, got %q", i+1, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(body))
+	req.RemoteAddr = "198.51.100.9:1234"
+	handleLogin(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := authMiddleware(requireAdmin(handleLoginAttempts))
+
+	req := httptest.NewRequest("GET", "/admin/login-attempts", nil)
+	req.Header.Set("Authorization", "Bearer "+testAccessToken("user-1"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultShutdownTimeout = 25 * time.Second
+	// Clients spread their reconnects over this window so the remaining
+	// replicas aren't hit by every socket at once.
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 5 * time.Second
+	drainPollInterval = 20 * time.Millisecond
+)
+
+// backgroundWork tracks fire-and-forget goroutines (emails, cleanup) that
+// must finish before the database pool is closed.
+var backgroundWork sync.WaitGroup
+
+// goBackground runs fn in a goroutine that shutdown waits for.
+func goBackground(fn func()) {
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		fn()
+	}()
+}
+
+// shutdownTimeout is how long a SIGTERM may take before the process exits
+// anyway. Keep it below the orchestrator's grace period (SHUTDOWN_TIMEOUT).
+func shutdownTimeout() time.Duration {
+	if d, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "")); err == nil && d > 0 {
+		return d
+	}
+	return defaultShutdownTimeout
+}
+
+// reconnectDelay picks a jittered reconnect hint for a draining client.
+func reconnectDelay() time.Duration {
+	return minReconnectDelay + rand.N(maxReconnectDelay-minReconnectDelay)
+}
+
+// waitContext runs wait and returns once it completes or ctx is done.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeMessage is the close frame sent when a client's queue is closed.
+func (h *Hub) closeMessage() []byte {
+	if h.draining.Load() {
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	}
+	return []byte{}
+}
+
+// Draining reports whether Shutdown has started.
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+func (h *Hub) localClients() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var all []*Client
+	for _, devices := range h.clients {
+		for c := range devices {
+			all = append(all, c)
+		}
+	}
+	return all
+}
+
+// Shutdown drains the hub before the process exits. It refuses new sockets
+// and events, tells every client to reconnect elsewhere, waits for in-flight
+// handlers, flushes each send queue followed by a going-away close frame and
+// finally stops Run. Connections still open when ctx ends are closed hard.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.draining.Store(true)
+
+	clients := h.localClients()
+	for _, c := range clients {
+		c.enqueue(encodeEvent("SERVER_SHUTDOWN", map[string]interface{}{
+			"Reason":        "Server is restarting",
+			"ReconnectInMs": reconnectDelay().Milliseconds(),
+		}))
+	}
+
+	// Handlers hold the read lock; taking the write lock waits for them.
+	// Handlers started afterwards see draining and fail fast.
+	err := waitContext(ctx, func() {
+		h.work.Lock()
+		h.work.Unlock()
+	})
+
+	// Closing a queue makes writePump send what is left, then the close frame.
+	// The peer's close ends readPump, which unregisters the client.
+	for _, c := range clients {
+		c.closeSend()
+	}
+	if err == nil {
+		err = waitContext(ctx, func() {
+			for len(h.localClients()) > 0 && ctx.Err() == nil {
+				time.Sleep(drainPollInterval)
+			}
+		})
+	}
+	if err != nil {
+		log.Printf("Shutdown deadline reached with %d sockets open", len(h.localClients()))
+		for _, c := range h.localClients() {
+			if c.conn != nil {
+				c.conn.Close()
+			}
+		}
+	}
+
+	select {
+	case h.quit <- true:
+	case <-ctx.Done():
+	}
+	return err
+}
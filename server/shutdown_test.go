@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHubShutdown_NotifiesAndClosesSockets(t *testing.T) {
+	os.Setenv("ALLOW_GUEST_CONNECTIONS", "true")
+	defer os.Unsetenv("ALLOW_GUEST_CONNECTIONS")
+
+	hub := NewHub()
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?guest=true", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- hub.Shutdown(ctx) }()
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, raw, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read shutdown notice: %v", err)
+	}
+	var msg WSMessage
+	json.Unmarshal(raw, &msg)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Event != "SERVER_SHUTDOWN" {
+		t.Fatalf("Expected SERVER_SHUTDOWN, got %s", raw)
+	}
+	if delay, _ := payload["ReconnectInMs"].(float64); delay < float64(minReconnectDelay.Milliseconds()) {
+		t.Errorf("Expected a reconnect hint, got %v", payload["ReconnectInMs"])
+	}
+
+	// Reading on lets the client answer the close frame
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected a going-away close, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean drain, got %v", err)
+	}
+	if len(hub.localClients()) != 0 {
+		t.Error("Expected every socket unregistered after shutdown")
+	}
+}
+
+func TestServeWs_RefusedWhileDraining(t *testing.T) {
+	hub := NewHub()
+	hub.draining.Store(true)
+
+	rec := httptest.NewRecorder()
+	ServeWs(hub, rec, httptest.NewRequest("GET", "/ws", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After hint")
+	}
+}
+
+func TestHandleIncomingMessage_RefusedWhileDraining(t *testing.T) {
+	c := newProtocolTestClient("user-draining")
+	c.hub.draining.Store(true)
+	c.handleIncomingMessage([]byte(`{"Event":"LEAVE_ROOM","RequestID":"r-9","Payload":{"RoomID":"room-1"}}`))
+
+	msg, payload := readReply(t, c)
+	if msg.Event != "NACK" || payload["code"] != string(CodeUnavailable) {
+		t.Errorf("Expected UNAVAILABLE NACK, got %s %v", msg.Event, payload)
+	}
+}
+
+func TestShutdownTimeoutFromEnv(t *testing.T) {
+	os.Setenv("SHUTDOWN_TIMEOUT", "40s")
+	defer os.Unsetenv("SHUTDOWN_TIMEOUT")
+	if got := shutdownTimeout(); got != 40*time.Second {
+		t.Errorf("Expected 40s, got %v", got)
+	}
+	os.Setenv("SHUTDOWN_TIMEOUT", "soon")
+	if got := shutdownTimeout(); got != defaultShutdownTimeout {
+		t.Errorf("Expected default for invalid value, got %v", got)
+	}
+}
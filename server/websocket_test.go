@@ -623,11 +623,12 @@ func TestHubConcurrentAccess(t *testing.T) {
 	go func() {
 		for i := 0; i < 100; i++ {
 			hub.mu.Lock()
-			hub.clients["user-"+string(rune(i))] = &Client{
+			client := &Client{
 				UID:  "user-" + string(rune(i)),
 				send: make(chan []byte),
 				hub:  hub,
 			}
+			hub.clients[client.UID] = map[*Client]bool{client: true}
 			hub.mu.Unlock()
 		}
 		done <- true
@@ -830,7 +831,7 @@ func TestJoinRoom(t *testing.T) {
 
 // ==================== HANDLE INCOMING MESSAGE TESTS ====================
 
-func TestHandleIncomingMessage_JoinRoom(t *testing.T) {
+func TestHandleIncomingMessage_JoinRoomRequiresMembership(t *testing.T) {
 	hub := NewHub()
 	go hub.Run()
 	defer func() { hub.quit <- true }()
@@ -858,17 +859,16 @@ func TestHandleIncomingMessage_JoinRoom(t *testing.T) {
 	// Handle the message
 	client.handleIncomingMessage(msgBytes)
 
-	// Verify client joined the room
+	// Membership can't be confirmed, so the client must not be subscribed
 	hub.mu.RLock()
-	room, exists := hub.rooms["party-chat-123"]
+	_, exists := hub.rooms["party-chat-123"]
 	hub.mu.RUnlock()
 
-	if !exists {
-		t.Error("Room should exist after JOIN_ROOM")
+	if exists {
+		t.Error("JOIN_ROOM must not subscribe a client that isn't a member")
 	}
-
-	if !room[client] {
-		t.Error("Client should be in the room after JOIN_ROOM")
+	if len(client.send) != 1 {
+		t.Errorf("Expected an ERROR reply, got %d messages", len(client.send))
 	}
 }
 
@@ -1387,7 +1387,7 @@ func TestHubRunGlobalBroadcastFullBuffer(t *testing.T) {
 
 	// Register in hub clients manually since channel is full
 	hub.mu.Lock()
-	hub.clients[client.UID] = client
+	hub.clients[client.UID] = map[*Client]bool{client: true}
 	hub.mu.Unlock()
 
 	// Send global broadcast - this should trigger the default case (unregister due to full buffer)
@@ -1425,7 +1425,7 @@ func TestHubRunRoomBroadcastFullBuffer(t *testing.T) {
 
 	// Manually add to clients map
 	hub.mu.Lock()
-	hub.clients[client.UID] = client
+	hub.clients[client.UID] = map[*Client]bool{client: true}
 	hub.mu.Unlock()
 
 	// Send room broadcast - this should trigger the default case
@@ -1456,7 +1456,7 @@ func TestServeWs(t *testing.T) {
 	defer server.Close()
 
 	// Convert test server URL to WebSocket URL
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?uid=test-user-123"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + testAccessToken("test-user-123")
 
 	// Connect to WebSocket
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
@@ -1500,7 +1500,7 @@ func TestServeWsMultipleClients(t *testing.T) {
 	// Connect multiple clients
 	var conns []*websocket.Conn
 	for i := 0; i < 3; i++ {
-		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?uid=user-"+string(rune('0'+i)), nil)
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+testAccessToken("user-"+string(rune('0'+i))), nil)
 		if err != nil {
 			t.Fatalf("Failed to dial WebSocket %d: %v", i, err)
 		}
@@ -1539,14 +1539,24 @@ func TestServeWsInvalidUID(t *testing.T) {
 
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?uid=" // Empty UID
 
-	// This should still work but with empty UID
+	// A bare uid is no longer trusted; the connection must authenticate with its first frame
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
-		t.Logf("Expected error for empty UID: %v", err)
-		return
+		t.Fatalf("Failed to dial WebSocket: %v", err)
 	}
-	if ws != nil {
-		ws.Close()
+	defer ws.Close()
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"Event":"AUTH","Token":"bogus"}`))
+	ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected policy violation close, got %v", err)
+	}
+
+	hub.mu.RLock()
+	clientCount := len(hub.clients)
+	hub.mu.RUnlock()
+	if clientCount != 0 {
+		t.Errorf("Expected no registered clients, got %d", clientCount)
 	}
 }
 
@@ -1562,7 +1572,7 @@ func TestWebSocketMessageRoundTrip(t *testing.T) {
 	}))
 	defer server.Close()
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?uid=roundtrip-user"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + testAccessToken("roundtrip-user")
 
 	// Connect
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
@@ -1604,7 +1614,7 @@ func TestWebSocketInvalidJSON(t *testing.T) {
 	}))
 	defer server.Close()
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?uid=invalid-json-user"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + testAccessToken("invalid-json-user")
 
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
@@ -1652,7 +1662,7 @@ func TestWebSocketMessageFlow(t *testing.T) {
 	}))
 	defer server.Close()
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?uid=msgflow-user"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + testAccessToken("msgflow-user")
 
 	// Connect
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
@@ -1666,10 +1676,13 @@ func TestWebSocketMessageFlow(t *testing.T) {
 
 	// Verify client is registered
 	hub.mu.RLock()
-	client, ok := hub.clients["msgflow-user"]
+	var client *Client
+	for c := range hub.clients["msgflow-user"] {
+		client = c
+	}
 	hub.mu.RUnlock()
 
-	if !ok {
+	if client == nil {
 		t.Fatal("Client not registered")
 	}
 
@@ -1722,7 +1735,7 @@ func TestServeWsWithQueryParams(t *testing.T) {
 	}))
 	defer server.Close()
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?uid=test-uid&room=test-room"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + testAccessToken("test-uid") + "&room=test-room"
 
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
@@ -1741,3 +1754,92 @@ func TestServeWsWithQueryParams(t *testing.T) {
 		t.Error("Expected client to be registered")
 	}
 }
+
+// ==================== MULTI-DEVICE TESTS ====================
+
+func TestHubMultipleDevicesPerUser(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	phone := &Client{UID: "multi-user", DeviceID: "phone", send: make(chan []byte, 10), hub: hub}
+	tablet := &Client{UID: "multi-user", DeviceID: "tablet", send: make(chan []byte, 10), hub: hub}
+	hub.register <- phone
+	hub.register <- tablet
+	time.Sleep(10 * time.Millisecond)
+
+	if ids := hub.DeviceIDs("multi-user"); len(ids) != 2 || ids[0] != "phone" || ids[1] != "tablet" {
+		t.Fatalf("Expected both devices registered, got %v", ids)
+	}
+
+	msg := `{"Event":"NEW_MESSAGE","Payload":{}}`
+	hub.PublishToUser("multi-user", []byte(msg))
+	for _, c := range []*Client{phone, tablet} {
+		select {
+		case got := <-c.send:
+			if string(got) != msg {
+				t.Errorf("%s: expected %s, got %s", c.DeviceID, msg, got)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("%s: timeout waiting for user event", c.DeviceID)
+		}
+	}
+
+	// Dropping one device leaves the user online on the other
+	hub.unregister <- phone
+	time.Sleep(10 * time.Millisecond)
+	if !hub.IsOnline("multi-user") {
+		t.Error("User should stay online while a device is connected")
+	}
+	if ids := hub.DeviceIDs("multi-user"); len(ids) != 1 || ids[0] != "tablet" {
+		t.Errorf("Expected only the tablet left, got %v", ids)
+	}
+
+	// Unregistering the same connection twice must not touch the others
+	hub.unregister <- phone
+	hub.unregister <- tablet
+	time.Sleep(10 * time.Millisecond)
+	if hub.IsOnline("multi-user") {
+		t.Error("User should be offline once every device disconnects")
+	}
+}
+
+func TestHubOnlineSessions(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer func() { hub.quit <- true }()
+
+	hub.register <- &Client{UID: "sessions-user", SessionID: "s-1", send: make(chan []byte, 1), hub: hub}
+	time.Sleep(10 * time.Millisecond)
+
+	online := hub.OnlineSessions("sessions-user")
+	if !online["s-1"] || online["s-2"] {
+		t.Errorf("Expected only s-1 online, got %v", online)
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws?device_id=ipad-7", nil)
+	if got := deviceID(r, "session-1", "user-1"); got != "ipad-7" {
+		t.Errorf("Expected client device ID, got %s", got)
+	}
+	r = httptest.NewRequest("GET", "/ws", nil)
+	if got := deviceID(r, "session-1", "user-1"); got != "session-1" {
+		t.Errorf("Expected session ID fallback, got %s", got)
+	}
+	if got := deviceID(r, "", "guest-1"); got != "guest-1" {
+		t.Errorf("Expected user ID fallback for guests, got %s", got)
+	}
+}
+
+func TestParseDMChatId(t *testing.T) {
+	a, b, ok := parseDMChatId(generateDMChatId("user-b", "user-a"))
+	if !ok || a != "user-a" || b != "user-b" {
+		t.Errorf("Expected user-a/user-b, got %q %q %v", a, b, ok)
+	}
+	for _, id := range []string{"2b8f3c1e-5d6a-4f7b-9c0d-1e2f3a4b5c6d", "user-b_user-a", "_user-a", "user-a_"} {
+		if _, _, ok := parseDMChatId(id); ok {
+			t.Errorf("Expected %q not to parse as a DM key", id)
+		}
+	}
+}